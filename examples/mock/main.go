@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/revenium/revenium-middleware-anthropic-go/revenium"
+)
+
+// This example shows how application code can be tested against the middleware
+// without network access: the mock provider returns canned responses and a custom
+// metering sender captures the meter events instead of sending them to Revenium.
+func main() {
+	fmt.Println("=== Revenium Middleware - Mock Provider Example ===")
+	fmt.Println()
+
+	// Collect every meter event built by the middleware
+	var mu sync.Mutex
+	var events []map[string]interface{}
+	sender := func(ctx context.Context, payload map[string]interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, payload)
+		return nil
+	}
+
+	cfg := &revenium.Config{}
+	for _, opt := range []revenium.Option{
+		revenium.WithReveniumAPIKey("hak_test_key"),
+		revenium.WithMockResponses([]anthropic.Message{
+			{
+				ID:         "msg_mock_1",
+				Role:       "assistant",
+				StopReason: anthropic.StopReasonEndTurn,
+				Content: []anthropic.ContentBlockUnion{
+					{Type: "text", Text: "Hola!"},
+				},
+				Usage: anthropic.Usage{InputTokens: 12, OutputTokens: 3},
+			},
+		}),
+		revenium.WithMeteringSender(sender),
+		revenium.WithSynchronousMetering(true), // Meter before CreateMessage returns
+	} {
+		opt(cfg)
+	}
+
+	client, err := revenium.NewReveniumAnthropic(cfg)
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	ctx := revenium.WithUsageMetadata(context.Background(), map[string]interface{}{
+		"organizationId": "org-mock-example",
+		"taskType":       "mock-chat",
+	})
+
+	resp, err := client.Messages().CreateMessage(ctx, anthropic.MessageNewParams{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 100,
+		Messages: []anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewTextBlock("Say hello in Spanish")),
+		},
+	})
+	if err != nil {
+		log.Fatalf("Failed to create message: %v", err)
+	}
+
+	fmt.Printf("Response: %s\n", resp.Content[0].Text)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 1 {
+		log.Fatalf("Expected 1 meter event, got %d", len(events))
+	}
+	event := events[0]
+	fmt.Printf("Metered model: %v\n", event["model"])
+	fmt.Printf("Metered tokens: input=%v output=%v\n", event["inputTokenCount"], event["outputTokenCount"])
+	fmt.Printf("Metered organizationId: %v\n", event["organizationId"])
+	fmt.Println()
+	fmt.Println("Mock example completed successfully!")
+}
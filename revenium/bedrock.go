@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/rand"
+	"net/url"
 	"reflect"
 	"regexp"
 	"strings"
@@ -69,6 +71,33 @@ func ConstructFullBedrockARN(arnBase string, modelName string) (string, error) {
 	return fullARN, nil
 }
 
+// ParseBedrockARN extracts the AWS account ID and inference-profile name from a Bedrock ARN
+// Example: arn:aws:bedrock:us-east-1:123456789012:inference-profile/us.anthropic.{model}-v1:0
+// returns ("123456789012", "us.anthropic.{model}-v1:0"). Values that are not a full ARN
+// (e.g. anthropic.{model}-v2:0) yield empty strings; the profile is empty for non-profile resources
+func ParseBedrockARN(modelID string) (accountID string, inferenceProfile string) {
+	if !strings.HasPrefix(modelID, "arn:aws:bedrock:") {
+		return "", ""
+	}
+
+	// arn:aws:bedrock:{region}:{account-id}:{resource}
+	parts := strings.SplitN(modelID, ":", 6)
+	if len(parts) < 6 {
+		return "", ""
+	}
+	accountID = parts[4]
+
+	resource := parts[5]
+	for _, prefix := range []string{"inference-profile/", "application-inference-profile/"} {
+		if strings.HasPrefix(resource, prefix) {
+			inferenceProfile = strings.TrimPrefix(resource, prefix)
+			break
+		}
+	}
+
+	return accountID, inferenceProfile
+}
+
 // GetBedrockModelID converts Anthropic model names to Bedrock ARNs
 // If AWS_MODEL_ARN_ID is configured, it constructs the full ARN automatically
 // Otherwise, it uses the standard Bedrock format: anthropic.{model_name}
@@ -166,8 +195,19 @@ func NewBedrockAdapter(cfg *Config) (*BedrockAdapter, error) {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
 
-	// Create Bedrock Runtime client
-	client := bedrockruntime.NewFromConfig(awsCfg)
+	// Create Bedrock Runtime client, honoring a custom (VPC/FIPS) endpoint if configured
+	var clientOpts []func(*bedrockruntime.Options)
+	if cfg.BedrockEndpointURL != "" {
+		if err := ValidateBedrockEndpointURL(cfg.BedrockEndpointURL); err != nil {
+			return nil, err
+		}
+		endpoint := cfg.BedrockEndpointURL
+		clientOpts = append(clientOpts, func(o *bedrockruntime.Options) {
+			o.BaseEndpoint = aws.String(endpoint)
+		})
+		Debug("Using custom Bedrock endpoint: %s", endpoint)
+	}
+	client := bedrockruntime.NewFromConfig(awsCfg, clientOpts...)
 
 	adapter := &BedrockAdapter{
 		config: cfg,
@@ -179,6 +219,19 @@ func NewBedrockAdapter(cfg *Config) (*BedrockAdapter, error) {
 	return adapter, nil
 }
 
+// ValidateBedrockEndpointURL checks that a custom Bedrock endpoint is an absolute
+// http(s) URL with a host, e.g. https://bedrock-runtime-fips.us-east-1.amazonaws.com
+func ValidateBedrockEndpointURL(endpoint string) error {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return NewConfigError("invalid Bedrock endpoint URL", err)
+	}
+	if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return NewConfigError(fmt.Sprintf("invalid Bedrock endpoint URL %q: expected an absolute http(s) URL", endpoint), nil)
+	}
+	return nil
+}
+
 // loadAWSConfig loads AWS configuration from environment or config
 func loadAWSConfig(cfg *Config) (aws.Config, error) {
 	opts := []func(*config.LoadOptions) error{
@@ -304,12 +357,19 @@ func (ba *BedrockAdapter) CreateMessageStream(ctx context.Context, params anthro
 
 // TransformRequestToBedrockFormat converts an Anthropic request to Bedrock format
 func (ba *BedrockAdapter) TransformRequestToBedrockFormat(params anthropic.MessageNewParams) map[string]interface{} {
+	messages, systemFromMessages := transformMessages(params.Messages)
+
 	// Build Bedrock request payload
 	payload := map[string]interface{}{
-		"messages":          transformMessages(params.Messages),
+		"messages":          messages,
 		"anthropic_version": "bedrock-2023-05-31",
 	}
 
+	// Bedrock only accepts the system prompt as the top-level system field
+	if system := append(transformSystem(params.System), systemFromMessages...); len(system) > 0 {
+		payload["system"] = system
+	}
+
 	// Add optional parameters if provided
 	if params.MaxTokens != 0 {
 		payload["max_tokens"] = params.MaxTokens
@@ -327,15 +387,19 @@ func (ba *BedrockAdapter) TransformRequestToBedrockFormat(params anthropic.Messa
 	return payload
 }
 
-// transformMessages converts Anthropic messages to Bedrock format
-func transformMessages(messages []anthropic.MessageParam) []map[string]interface{} {
+// transformMessages converts Anthropic messages to Bedrock format. Bedrock accepts only
+// user and assistant roles, so any system-role message is returned separately as
+// system blocks, and consecutive messages with the same role are merged into one
+// turn. A trailing assistant message is kept as-is as a prefill
+func transformMessages(messages []anthropic.MessageParam) ([]map[string]interface{}, []map[string]interface{}) {
 	var bedrockMessages []map[string]interface{}
+	var system []map[string]interface{}
 
 	for _, msg := range messages {
-		bedrockMsg := map[string]interface{}{}
-
-		// Determine role
-		bedrockMsg["role"] = string(msg.Role)
+		role := string(msg.Role)
+		if role == "" {
+			role = string(anthropic.MessageParamRoleUser)
+		}
 
 		// Extract content from message content blocks using JSON marshaling
 		content := []map[string]interface{}{}
@@ -351,6 +415,23 @@ func transformMessages(messages []anthropic.MessageParam) []map[string]interface
 			}
 		}
 
+		// System instructions sent as a message move to the top-level system field
+		if role == "system" {
+			for _, block := range content {
+				if block["type"] == "text" {
+					system = append(system, block)
+				}
+			}
+			continue
+		}
+
+		// Merge consecutive messages from the same role into a single turn
+		if n := len(bedrockMessages); n > 0 && bedrockMessages[n-1]["role"] == role {
+			previous := bedrockMessages[n-1]["content"].([]map[string]interface{})
+			bedrockMessages[n-1]["content"] = append(previous, content...)
+			continue
+		}
+
 		// Fallback if no content was extracted
 		if len(content) == 0 {
 			content = append(content, map[string]interface{}{
@@ -359,11 +440,32 @@ func transformMessages(messages []anthropic.MessageParam) []map[string]interface
 			})
 		}
 
-		bedrockMsg["content"] = content
-		bedrockMessages = append(bedrockMessages, bedrockMsg)
+		bedrockMessages = append(bedrockMessages, map[string]interface{}{
+			"role":    role,
+			"content": content,
+		})
+	}
+
+	return bedrockMessages, system
+}
+
+// transformSystem converts the request's system prompt blocks to Bedrock format
+func transformSystem(system []anthropic.TextBlockParam) []map[string]interface{} {
+	if len(system) == 0 {
+		return nil
 	}
 
-	return bedrockMessages
+	systemJSON, err := json.Marshal(system)
+	if err != nil {
+		Warn("Failed to serialize system prompt for Bedrock: %v", err)
+		return nil
+	}
+	var blocks []map[string]interface{}
+	if err := json.Unmarshal(systemJSON, &blocks); err != nil {
+		Warn("Failed to convert system prompt for Bedrock: %v", err)
+		return nil
+	}
+	return blocks
 }
 
 // TransformResponseFromBedrockFormat converts a Bedrock response to Anthropic format
@@ -415,6 +517,8 @@ func (ba *BedrockAdapter) TransformResponseFromBedrockFormat(bedrockResp map[str
 	if usage, ok := bedrockResp["usage"].(map[string]interface{}); ok {
 		inputTokens := int64(0)
 		outputTokens := int64(0)
+		cacheCreationTokens := int64(0)
+		cacheReadTokens := int64(0)
 
 		if it, ok := usage["input_tokens"].(float64); ok {
 			inputTokens = int64(it)
@@ -422,12 +526,20 @@ func (ba *BedrockAdapter) TransformResponseFromBedrockFormat(bedrockResp map[str
 		if ot, ok := usage["output_tokens"].(float64); ok {
 			outputTokens = int64(ot)
 		}
+		if cc, ok := usage["cache_creation_input_tokens"].(float64); ok {
+			cacheCreationTokens = int64(cc)
+		}
+		if cr, ok := usage["cache_read_input_tokens"].(float64); ok {
+			cacheReadTokens = int64(cr)
+		}
 
 		// Set usage fields via reflection
 		usageField := reflect.ValueOf(msg).Elem().FieldByName("Usage")
 		if usageField.IsValid() && usageField.CanSet() {
 			usageField.FieldByName("InputTokens").SetInt(inputTokens)
 			usageField.FieldByName("OutputTokens").SetInt(outputTokens)
+			usageField.FieldByName("CacheCreationInputTokens").SetInt(cacheCreationTokens)
+			usageField.FieldByName("CacheReadInputTokens").SetInt(cacheReadTokens)
 		}
 	}
 
@@ -444,6 +556,8 @@ func convertBedrockStopReason(bedrockReason string) string {
 		return "max_tokens"
 	case "stop_sequence":
 		return "stop_sequence"
+	case "refusal":
+		return "refusal"
 	default:
 		return "end_turn"
 	}
@@ -549,6 +663,7 @@ type RetryConfig struct {
 	InitialBackoff    time.Duration
 	MaxBackoff        time.Duration
 	BackoffMultiplier float64
+	Jitter            bool // Randomize each wait to avoid synchronized retries across clients
 }
 
 // DefaultRetryConfig returns default retry configuration
@@ -558,9 +673,20 @@ func DefaultRetryConfig() RetryConfig {
 		InitialBackoff:    100 * time.Millisecond,
 		MaxBackoff:        5 * time.Second,
 		BackoffMultiplier: 2.0,
+		Jitter:            true,
 	}
 }
 
+// jitterBackoff applies "equal jitter" to a backoff: half the wait is kept and the
+// other half is randomized, so clients recovering from an outage spread their retries
+func jitterBackoff(backoff time.Duration) time.Duration {
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
 // RetryWithBackoff retries a function with exponential backoff
 func RetryWithBackoff(ctx context.Context, cfg RetryConfig, fn func() error) error {
 	var lastErr error
@@ -590,8 +716,12 @@ func RetryWithBackoff(ctx context.Context, cfg RetryConfig, fn func() error) err
 		// Don't sleep after last attempt
 		if attempt < cfg.MaxRetries {
 			Debug("Retry attempt %d/%d", attempt+1, cfg.MaxRetries)
+			wait := backoff
+			if cfg.Jitter {
+				wait = jitterBackoff(backoff)
+			}
 			select {
-			case <-time.After(backoff):
+			case <-time.After(wait):
 			case <-ctx.Done():
 				return ctx.Err()
 			}
@@ -0,0 +1,108 @@
+package revenium
+
+import (
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestParseBedrockARN(t *testing.T) {
+	tests := []struct {
+		name        string
+		modelID     string
+		wantAccount string
+		wantProfile string
+	}{
+		{"inference profile", "arn:aws:bedrock:us-east-1:123456789012:inference-profile/us.anthropic.claude-3-5-haiku-20241022-v1:0", "123456789012", "us.anthropic.claude-3-5-haiku-20241022-v1:0"},
+		{"application inference profile", "arn:aws:bedrock:eu-west-1:210987654321:application-inference-profile/abc123", "210987654321", "abc123"},
+		{"foundation model", "arn:aws:bedrock:us-east-1:123456789012:foundation-model/anthropic.claude-v2", "123456789012", ""},
+		{"bare model ID", "anthropic.claude-3-5-haiku-20241022-v1:0", "", ""},
+		{"truncated ARN", "arn:aws:bedrock:us-east-1", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			account, profile := ParseBedrockARN(tt.modelID)
+			if account != tt.wantAccount || profile != tt.wantProfile {
+				t.Errorf("ParseBedrockARN(%q) = %q, %q; want %q, %q", tt.modelID, account, profile, tt.wantAccount, tt.wantProfile)
+			}
+		})
+	}
+}
+
+func TestJitterBackoffStaysWithinEqualJitterRange(t *testing.T) {
+	backoff := 200 * time.Millisecond
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		wait := jitterBackoff(backoff)
+		if wait < backoff/2 || wait > backoff {
+			t.Fatalf("jitterBackoff(%v) = %v, want within [%v, %v]", backoff, wait, backoff/2, backoff)
+		}
+		seen[wait] = true
+	}
+	if len(seen) < 2 {
+		t.Error("jitterBackoff did not randomize the wait")
+	}
+
+	// Backoffs too small to split are returned unchanged
+	if got := jitterBackoff(time.Nanosecond); got != time.Nanosecond {
+		t.Errorf("jitterBackoff(1ns) = %v, want 1ns", got)
+	}
+}
+
+func TestValidateBedrockEndpointURL(t *testing.T) {
+	tests := []struct {
+		endpoint string
+		valid    bool
+	}{
+		{"https://bedrock-runtime-fips.us-east-1.amazonaws.com", true},
+		{"https://vpce-0123.bedrock-runtime.us-east-1.vpce.amazonaws.com", true},
+		{"http://localhost:4566", true},
+		{"bedrock-runtime.us-east-1.amazonaws.com", false},
+		{"ftp://bedrock.example.com", false},
+		{"https://", false},
+		{"://bad", false},
+	}
+	for _, tt := range tests {
+		err := ValidateBedrockEndpointURL(tt.endpoint)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidateBedrockEndpointURL(%q) = %v, want valid %v", tt.endpoint, err, tt.valid)
+		}
+		if err != nil && !IsConfigError(err) {
+			t.Errorf("ValidateBedrockEndpointURL(%q) returned %T, want a config error", tt.endpoint, err)
+		}
+	}
+}
+
+func TestTransformRequestToBedrockFormatMapsRoles(t *testing.T) {
+	params := anthropic.MessageNewParams{
+		Model:     "claude-3-5-haiku-latest",
+		MaxTokens: 16,
+		System:    []anthropic.TextBlockParam{{Text: "Be brief"}},
+		Messages: []anthropic.MessageParam{
+			{Role: "system", Content: []anthropic.ContentBlockParamUnion{anthropic.NewTextBlock("Answer in French")}},
+			anthropic.NewUserMessage(anthropic.NewTextBlock("hello")),
+			anthropic.NewUserMessage(anthropic.NewTextBlock("again")),
+			anthropic.NewAssistantMessage(anthropic.NewTextBlock("Bonjour")),
+		},
+	}
+	payload := (&BedrockAdapter{}).TransformRequestToBedrockFormat(params)
+
+	// System-role messages join the top-level system prompt
+	system, _ := payload["system"].([]map[string]interface{})
+	if len(system) != 2 || system[0]["text"] != "Be brief" || system[1]["text"] != "Answer in French" {
+		t.Errorf("system = %v, want the system prompt then the system message", system)
+	}
+
+	// Consecutive user messages merge into one turn; the trailing assistant prefill stays
+	messages, _ := payload["messages"].([]map[string]interface{})
+	if len(messages) != 2 {
+		t.Fatalf("got %d Bedrock messages, want 2: %v", len(messages), messages)
+	}
+	if messages[0]["role"] != "user" || len(messages[0]["content"].([]map[string]interface{})) != 2 {
+		t.Errorf("first message = %v, want one user turn with both blocks", messages[0])
+	}
+	if messages[1]["role"] != "assistant" {
+		t.Errorf("last message role = %v, want assistant", messages[1]["role"])
+	}
+}
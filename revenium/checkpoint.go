@@ -0,0 +1,57 @@
+package revenium
+
+import "time"
+
+// StreamCheckpoint is an interim snapshot of a stream in progress, passed to the
+// function set with WithStreamCheckpoint so a crash-recovery store can persist it and
+// replay metering if the process dies before the stream is closed
+type StreamCheckpoint struct {
+	TransactionID string
+	Model         string
+	Provider      string
+	StartTime     time.Time
+	// Tokens holds the counts reported so far; output tokens usually arrive only with
+	// the final message_delta, so OutputChars is the better progress signal
+	Tokens      TokenCounts
+	OutputChars int
+	// Content is the accumulated response text, only populated with prompt capture
+	Content string
+	// Closed is true for the final checkpoint sent from Close, after which the stored
+	// checkpoint can be discarded because the stream was metered normally
+	Closed bool
+}
+
+// checkpointLocked returns a checkpoint when one is due, or nil. Must be called with sw.mu held
+func (sw *StreamingWrapper) checkpointLocked(closed bool) *StreamCheckpoint {
+	if sw.config == nil || sw.config.StreamCheckpointFunc == nil {
+		return nil
+	}
+	last := sw.lastCheckpoint
+	if last.IsZero() {
+		last = sw.startTime
+	}
+	if !closed && time.Since(last) < sw.config.StreamCheckpointInterval {
+		return nil
+	}
+	sw.lastCheckpoint = time.Now()
+
+	checkpoint := &StreamCheckpoint{
+		Model:     sw.model,
+		Provider:  resolveProviderName(sw.config, sw.provider),
+		StartTime: sw.startTime,
+		Tokens: TokenCounts{
+			Input:         int64(sw.inputTokens),
+			Output:        int64(sw.outputTokens),
+			Total:         int64(sw.totalTokens),
+			CacheCreation: int64(sw.cacheCreationTokens),
+			CacheRead:     int64(sw.cacheReadTokens),
+		},
+		OutputChars: sw.outputCharCount,
+		Content:     sw.accumulatedContent,
+		Closed:      closed,
+	}
+	if transactionID, ok := sw.metadata["transactionId"].(string); ok {
+		checkpoint.TransactionID = transactionID
+	}
+	return checkpoint
+}
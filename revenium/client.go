@@ -1,7 +1,12 @@
 package revenium
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
+	"time"
 )
 
 // ClientManager manages thread-safe access to Revenium and Bedrock clients
@@ -70,23 +75,104 @@ func (cm *ClientManager) RemoveBedrockClient(key string) {
 	delete(cm.bedrockClients, key)
 }
 
-// CloseAll closes all clients and cleans up resources
+// CloseAll closes all clients and cleans up resources, waiting at most the longest
+// metering timeout of the cached clients (see CloseAllContext for a custom bound).
+// Every client is closed even if some fail; the errors are combined
 func (cm *ClientManager) CloseAll() error {
-	cm.mu.Lock()
-	defer cm.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), cm.closeTimeout())
+	defer cancel()
+	return cm.CloseAllContext(ctx)
+}
+
+// closeTimeout returns the longest metering timeout of the cached clients, which
+// bounds how long flushing their pending metering can take
+func (cm *ClientManager) closeTimeout() time.Duration {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
 
-	// Close all Revenium clients
+	timeout := meteringContextTimeout
 	for _, client := range cm.reveniumClients {
-		if err := client.Close(); err != nil {
-			return err
+		if cfg := client.GetConfig(); cfg != nil && cfg.MeteringTimeout > timeout {
+			timeout = cfg.MeteringTimeout
 		}
 	}
+	return timeout
+}
+
+// CloseAllContext closes all clients concurrently, flushing their pending metering,
+// and gives up waiting when ctx is done. Errors from every client are combined
+func (cm *ClientManager) CloseAllContext(ctx context.Context) error {
+	cm.mu.Lock()
+	closers := make([]io.Closer, 0, len(cm.reveniumClients))
+	for _, client := range cm.reveniumClients {
+		closers = append(closers, client)
+	}
 
 	// Clear caches
 	cm.reveniumClients = make(map[string]*ReveniumAnthropic)
 	cm.bedrockClients = make(map[string]interface{})
+	cm.mu.Unlock()
+
+	return closeAll(ctx, closers)
+}
+
+// CloserGroup closes several clients (or any io.Closer) together on shutdown
+type CloserGroup struct {
+	mu      sync.Mutex
+	closers []io.Closer
+}
+
+// NewCloserGroup creates a CloserGroup with the given closers registered
+func NewCloserGroup(closers ...io.Closer) *CloserGroup {
+	return &CloserGroup{closers: closers}
+}
+
+// Add registers a closer with the group
+func (g *CloserGroup) Add(closer io.Closer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closers = append(g.closers, closer)
+}
+
+// CloseAll closes every registered closer concurrently and waits until they finish
+// or ctx is done. It continues past failures and returns the combined errors,
+// including a timeout error when some closers had not finished
+func (g *CloserGroup) CloseAll(ctx context.Context) error {
+	g.mu.Lock()
+	closers := g.closers
+	g.closers = nil
+	g.mu.Unlock()
+
+	return closeAll(ctx, closers)
+}
+
+// closeAll closes closers concurrently, collecting every error
+func closeAll(ctx context.Context, closers []io.Closer) error {
+	if len(closers) == 0 {
+		return nil
+	}
+
+	results := make(chan error, len(closers))
+	for _, closer := range closers {
+		go func(c io.Closer) {
+			results <- c.Close()
+		}(closer)
+	}
+
+	var errs []error
+	for pending := len(closers); pending > 0; pending-- {
+		select {
+		case err := <-results:
+			if err != nil {
+				errs = append(errs, err)
+			}
+		case <-ctx.Done():
+			errs = append(errs, NewMeteringError(fmt.Sprintf("%d client(s) did not close in time", pending), ctx.Err()))
+			return errors.Join(errs...)
+		}
+	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 // GetClientCount returns the number of cached clients
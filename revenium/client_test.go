@@ -0,0 +1,69 @@
+package revenium
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCloser is an io.Closer that takes delay to close and then returns err
+type testCloser struct {
+	delay  time.Duration
+	err    error
+	closed atomic.Bool
+}
+
+func (c *testCloser) Close() error {
+	time.Sleep(c.delay)
+	c.closed.Store(true)
+	return c.err
+}
+
+func TestCloserGroupClosesAllWithOneSlow(t *testing.T) {
+	fast := &testCloser{}
+	failing := &testCloser{err: errors.New("flush failed")}
+	slow := &testCloser{delay: time.Second}
+	group := NewCloserGroup(fast, slow)
+	group.Add(failing)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := group.CloseAll(ctx)
+
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("CloseAll waited %v for the slow closer", elapsed)
+	}
+	if !fast.closed.Load() || !failing.closed.Load() {
+		t.Error("a failing or slow closer stopped the others from closing")
+	}
+	if err == nil || !strings.Contains(err.Error(), "flush failed") || !strings.Contains(err.Error(), "1 client(s) did not close in time") {
+		t.Errorf("CloseAll error = %v, want the failure and the timeout combined", err)
+	}
+}
+
+func TestClientManagerCloseAllIsBounded(t *testing.T) {
+	cm := NewClientManager()
+	if got := cm.closeTimeout(); got != meteringContextTimeout {
+		t.Errorf("default close timeout = %v, want %v", got, meteringContextTimeout)
+	}
+
+	for key, timeout := range map[string]time.Duration{"a": time.Second, "b": time.Minute} {
+		if _, err := cm.GetReveniumClient(key, &Config{ReveniumAPIKey: "hak_test", MeteringTimeout: timeout}); err != nil {
+			t.Fatalf("GetReveniumClient: %v", err)
+		}
+	}
+	if got := cm.closeTimeout(); got != time.Minute {
+		t.Errorf("close timeout = %v, want the longest metering timeout", got)
+	}
+
+	if err := cm.CloseAll(); err != nil {
+		t.Fatalf("CloseAll: %v", err)
+	}
+	if revenium, _ := cm.GetClientCount(); revenium != 0 {
+		t.Errorf("%d clients still cached after CloseAll", revenium)
+	}
+}
@@ -1,17 +1,28 @@
 package revenium
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/joho/godotenv"
 )
 
 // Config holds all configuration for the Revenium middleware
 type Config struct {
 	// Anthropic API configuration
-	AnthropicAPIKey string
-	BaseURL         string
+	AnthropicAPIKey  string
+	BaseURL          string
+	AnthropicClient  *anthropic.Client // Pre-configured client used instead of building one from AnthropicAPIKey
+	AnthropicVersion string            // Optional anthropic-version header override
 
 	// Revenium metering configuration
 	ReveniumAPIKey    string
@@ -19,6 +30,133 @@ type Config struct {
 	ReveniumOrgID     string
 	ReveniumProductID string
 
+	// SynchronousMetering sends metering before returning to the caller instead of in the background
+	SynchronousMetering bool
+	// MeteringTimeout bounds the time spent sending one metering event, including retries (default 30s)
+	MeteringTimeout time.Duration
+
+	// OperationTypeEndpoints maps a payload operationType (e.g., "EMBED") to an endpoint path
+	OperationTypeEndpoints map[string]string
+
+	// MeteringRequestSigner is invoked on each metering request before it is sent
+	MeteringRequestSigner func(req *http.Request, body []byte)
+
+	// MeteringHeaderFunc supplies additional headers for each metering request
+	MeteringHeaderFunc func() map[string]string
+
+	// MeteringBodyTransform reshapes the payload just before it is marshaled and sent
+	MeteringBodyTransform func(payload map[string]interface{}) (interface{}, error)
+
+	// MeteringContentType overrides the Content-Type header of metering requests
+	MeteringContentType string
+
+	// MeteringSerializer replaces encoding/json for marshaling metering bodies
+	MeteringSerializer func(v interface{}) ([]byte, error)
+
+	// PayloadFieldCase selects the casing of top-level payload keys ("camel" or "snake")
+	PayloadFieldCase string
+
+	// PayloadHistorySize is the number of recent payloads kept for RecentPayloads (0 disables)
+	PayloadHistorySize int
+
+	// ContextMetadataKey is an additional context key to read usage metadata from
+	ContextMetadataKey interface{}
+
+	// DisableBackoffJitter makes metering and Bedrock retry backoff deterministic
+	DisableBackoffJitter bool
+
+	// StructuredResponseCapture captures response content blocks as JSON instead of flattened text
+	StructuredResponseCapture bool
+
+	// ModelPricing is the per-model price table used for cost estimates
+	ModelPricing map[string]ModelPricing
+
+	// ProviderModelPricing holds provider-specific rates that take precedence over ModelPricing
+	ProviderModelPricing map[Provider]map[string]ModelPricing
+
+	// HeartbeatInterval enables a periodic heartbeat meter event when positive
+	HeartbeatInterval time.Duration
+
+	// TruncationStrategy selects which part of long captured prompts is kept ("head", "tail" or "middle")
+	TruncationStrategy string
+
+	// MinimalPayload sends only the billing fields, omitting metadata, attributes and prompts
+	MinimalPayload bool
+
+	// MetricsRecorder receives per-request token and duration measurements (e.g. OpenTelemetry)
+	MetricsRecorder MetricsRecorder
+	// MetricsOnly skips the Revenium HTTP call when a MetricsRecorder is set
+	MetricsOnly bool
+
+	// RequestDedupWindow enables flagging of duplicate requests seen within the window
+	RequestDedupWindow time.Duration
+
+	// PayloadInterceptors adjust each payload just before it is sent, before the blocklist
+	PayloadInterceptors []func(payload map[string]interface{})
+
+	// MeteringWorkers bounds the number of concurrent metering sends (0 is unbounded)
+	MeteringWorkers int
+
+	// StreamCheckpointFunc receives periodic snapshots of in-progress streams
+	StreamCheckpointFunc func(StreamCheckpoint)
+	// StreamCheckpointInterval is the minimum time between stream checkpoints
+	StreamCheckpointInterval time.Duration
+
+	// EnvironmentEndpoints maps environment metadata values to Revenium base URLs
+	EnvironmentEndpoints map[string]string
+
+	// ConfigFingerprint adds a configFingerprint attribute hashing the metering-relevant settings
+	ConfigFingerprint bool
+	fingerprint       string // Computed once when the client is built
+
+	// MeteredModels limits metering to these models (empty meters every model)
+	MeteredModels []string
+
+	// MaxInputTokens rejects requests with a larger estimated input token count (0 disables)
+	MaxInputTokens int
+
+	// TransactionIDGenerator generates transactionIds not supplied in metadata (default: UUID)
+	TransactionIDGenerator func() string
+
+	// FieldNameMap renames top-level payload fields (camelCase name -> custom name) before sending
+	FieldNameMap map[string]string
+
+	// StreamAutoReconnectAttempts is the number of times a dropped stream is re-issued (0 disables)
+	StreamAutoReconnectAttempts int
+
+	// SubscriberAggregation enables local per-subscriber request/token tallies
+	SubscriberAggregation bool
+
+	// GuardToolNames lists safety/guard tool names whose use is labeled in metering
+	GuardToolNames []string
+
+	// AutoDetectEnvironment fills environment/region from the runtime when metadata omits them
+	AutoDetectEnvironment bool
+
+	// MockResponses are canned responses served by ProviderMock instead of calling a provider
+	MockResponses []anthropic.Message
+
+	// MeteringSender replaces the HTTP metering call, receiving each final payload
+	MeteringSender func(ctx context.Context, payload map[string]interface{}) error
+
+	// BaggageKeys lists baggage members forwarded as meter event attributes
+	BaggageKeys []string
+	// BaggageReader returns the baggage members carried by a context
+	BaggageReader func(ctx context.Context) map[string]string
+
+	// StreamSummaryCallback receives a final summary when a stream is closed
+	StreamSummaryCallback func(StreamSummary)
+
+	// MaxImagesPerRequest rejects requests with more images than this (0 disables)
+	MaxImagesPerRequest int
+
+	// MeteringEnabled sets the process-wide metering kill switch when Initialize runs
+	// (nil leaves it unchanged)
+	MeteringEnabled *bool
+
+	// AllowInsecureMetering permits plain http:// metering endpoints on non-local hosts
+	AllowInsecureMetering bool
+
 	// AWS Bedrock configuration
 	AWSAccessKeyID     string
 	AWSSecretAccessKey string
@@ -26,13 +164,42 @@ type Config struct {
 	AWSProfile         string
 	AWSModelARNBase    string // Base ARN format: arn:aws:bedrock:{region}:{account-id}
 	BedrockDisabled    bool
+	BedrockEndpointURL string // Custom Bedrock Runtime endpoint (VPC endpoint or FIPS)
 
 	// Logging and debug configuration
 	LogLevel       string
 	VerboseStartup bool
 
+	// Startup self-test configuration
+	StartupSelfTest     bool // Validate configuration during initialization
+	StartupSelfTestPing bool // Also check that the Revenium base URL responds
+
 	// Prompt capture configuration (opt-in)
 	CapturePrompts bool
+
+	// DisableInputTokenEstimate reports 0 input tokens for streams until real usage arrives
+	DisableInputTokenEstimate bool
+
+	// PerToolMetering emits an additional zero-token meter event per tool_use block (opt-in)
+	PerToolMetering bool
+
+	// MeterErrors emits meter events for failed and cancelled requests (opt-in)
+	MeterErrors bool
+
+	// CorrelationIDExtractor derives a traceId from the request context when metadata lacks one
+	CorrelationIDExtractor func(ctx context.Context) string
+
+	// Metadata defaults keyed by model name, applied beneath per-request metadata
+	ModelMetadataDefaults map[string]map[string]interface{}
+
+	// Provider display name overrides, applied on top of the default normalization
+	ProviderNameOverrides map[string]string
+
+	// Model aliases mapping friendly names (e.g. "fast") to Anthropic model names
+	ModelAliases map[string]string
+
+	// Metadata keys that are never sent to Revenium
+	MetadataBlocklist []string
 }
 
 // Option is a functional option for configuring Config
@@ -45,6 +212,24 @@ func WithAnthropicAPIKey(key string) Option {
 	}
 }
 
+// WithAnthropicClient sets a pre-configured Anthropic client
+// When set, the client is used verbatim instead of constructing one from the API key,
+// which allows custom request options or a mocked transport
+func WithAnthropicClient(client anthropic.Client) Option {
+	return func(c *Config) {
+		c.AnthropicClient = &client
+	}
+}
+
+// WithAnthropicVersion pins the anthropic-version header sent on Anthropic requests
+// Changing it may alter the usage and response shapes that token extraction depends on,
+// so only override it when a specific API version is required
+func WithAnthropicVersion(version string) Option {
+	return func(c *Config) {
+		c.AnthropicVersion = version
+	}
+}
+
 // WithReveniumAPIKey sets the Revenium API key
 func WithReveniumAPIKey(key string) Option {
 	return func(c *Config) {
@@ -59,6 +244,432 @@ func WithReveniumBaseURL(url string) Option {
 	}
 }
 
+// WithAllowInsecureMetering allows sending metering data to a non-HTTPS endpoint
+// By default, http:// base URLs are only accepted for localhost and 127.0.0.1
+func WithAllowInsecureMetering(allow bool) Option {
+	return func(c *Config) {
+		c.AllowInsecureMetering = allow
+	}
+}
+
+// WithSynchronousMetering sends metering data before CreateMessage returns (or before
+// stream Close returns) instead of in a background goroutine. Useful for short-lived
+// processes such as serverless functions, where the metering timeout is capped by the
+// request context's remaining deadline
+func WithSynchronousMetering(enabled bool) Option {
+	return func(c *Config) {
+		c.SynchronousMetering = enabled
+	}
+}
+
+// WithMeteringTimeout sets the maximum time spent sending one metering event, including retries
+func WithMeteringTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.MeteringTimeout = timeout
+	}
+}
+
+// WithOperationTypeEndpoints routes metering payloads to endpoint paths by operationType
+// Paths are appended to the Revenium base URL. Unmapped types use DefaultMeteringEndpointPath
+func WithOperationTypeEndpoints(endpoints map[string]string) Option {
+	return func(c *Config) {
+		c.OperationTypeEndpoints = endpoints
+	}
+}
+
+// WithMeteringRequestSigner sets a function that signs metering requests before sending
+// It receives the outgoing request and the final JSON body, and may add headers
+// (e.g., an HMAC signature) for self-hosted or proxied Revenium deployments
+func WithMeteringRequestSigner(signer func(req *http.Request, body []byte)) Option {
+	return func(c *Config) {
+		c.MeteringRequestSigner = signer
+	}
+}
+
+// WithMeteringHeaderFunc sets a function called for every metering request to supply
+// extra headers, e.g. short-lived tokens for a proxy in front of Revenium. The
+// required x-api-key and Content-Type headers always take precedence
+func WithMeteringHeaderFunc(headers func() map[string]string) Option {
+	return func(c *Config) {
+		c.MeteringHeaderFunc = headers
+	}
+}
+
+// WithMeteringSerializer replaces encoding/json.Marshal for metering request bodies,
+// e.g. with jsoniter or sonic to reduce CPU at high volume. The serializer must
+// produce standard JSON; pre-encoded body transform output is still sent as-is
+func WithMeteringSerializer(marshal func(v interface{}) ([]byte, error)) Option {
+	return func(c *Config) {
+		c.MeteringSerializer = marshal
+	}
+}
+
+// WithMeteringBodyTransform sets a function that reshapes each metering payload right
+// before JSON marshaling, e.g. to rename fields for a downstream collector. Retries and
+// signing still apply to the transformed body. A transform error fails the send without retry
+func WithMeteringBodyTransform(transform func(payload map[string]interface{}) (interface{}, error)) Option {
+	return func(c *Config) {
+		c.MeteringBodyTransform = transform
+	}
+}
+
+// WithMeteringContentType sets the Content-Type header sent with metering requests
+// (default "application/json; charset=utf-8"). Combine it with WithMeteringBodyTransform
+// returning []byte or string to send non-JSON encodings such as NDJSON
+func WithMeteringContentType(contentType string) Option {
+	return func(c *Config) {
+		c.MeteringContentType = contentType
+	}
+}
+
+// Payload field casing values for WithPayloadFieldCase
+const (
+	PayloadFieldCaseCamel = "camel"
+	PayloadFieldCaseSnake = "snake"
+)
+
+// WithPayloadFieldCase sets the casing of top-level metering payload keys
+// The default "camel" matches the Node.js middleware; "snake" targets backends that
+// expect snake_case. Unknown values fall back to camelCase
+func WithPayloadFieldCase(fieldCase string) Option {
+	return func(c *Config) {
+		switch fieldCase {
+		case PayloadFieldCaseCamel, PayloadFieldCaseSnake:
+			c.PayloadFieldCase = fieldCase
+		default:
+			Warn("Unknown payload field case %q, using camelCase", fieldCase)
+			c.PayloadFieldCase = PayloadFieldCaseCamel
+		}
+	}
+}
+
+// WithPayloadHistory keeps the last size metering payloads in memory for inspection
+// via RecentPayloads, without enabling debug logging. Disabled by default
+func WithPayloadHistory(size int) Option {
+	return func(c *Config) {
+		c.PayloadHistorySize = size
+	}
+}
+
+// WithContextMetadataKey reads usage metadata from an additional, caller-specified
+// context key, for applications that already store request metadata in the context.
+// Metadata set with WithUsageMetadata takes precedence over values under this key
+func WithContextMetadataKey(key interface{}) Option {
+	return func(c *Config) {
+		c.ContextMetadataKey = key
+	}
+}
+
+// WithMeteringBackoffJitter enables or disables randomized retry backoff (default on)
+// Jitter spreads retries from many clients after a Revenium outage instead of having
+// them retry in lockstep. It applies to metering sends and Bedrock request retries
+func WithMeteringBackoffJitter(enabled bool) Option {
+	return func(c *Config) {
+		c.DisableBackoffJitter = !enabled
+	}
+}
+
+// WithStructuredResponseCapture captures outputResponse as a JSON array of content
+// blocks, preserving the interleaving of text and tool_use blocks. By default the
+// response text blocks are flattened into a single newline-joined string
+func WithStructuredResponseCapture(enabled bool) Option {
+	return func(c *Config) {
+		c.StructuredResponseCapture = enabled
+	}
+}
+
+// WithBedrockEndpointURL sets a custom Bedrock Runtime endpoint, such as a VPC
+// interface endpoint or a FIPS endpoint. The URL must be an absolute http(s) URL
+func WithBedrockEndpointURL(endpoint string) Option {
+	return func(c *Config) {
+		c.BedrockEndpointURL = endpoint
+	}
+}
+
+// WithModelPricing sets per-model token prices (USD per million tokens) used for
+// estimates such as estimatedCacheSavings. Keys are model names; Bedrock model IDs
+// also match their Anthropic equivalent
+func WithModelPricing(pricing map[string]ModelPricing) Option {
+	return func(c *Config) {
+		c.ModelPricing = pricing
+	}
+}
+
+// WithProviderModelPricing sets per-model token prices (USD per million tokens) that
+// apply only when the model is served by provider, e.g. Bedrock rates that differ
+// from Anthropic direct. Models missing here fall back to WithModelPricing
+func WithProviderModelPricing(provider Provider, pricing map[string]ModelPricing) Option {
+	return func(c *Config) {
+		if c.ProviderModelPricing == nil {
+			c.ProviderModelPricing = make(map[Provider]map[string]ModelPricing)
+		}
+		c.ProviderModelPricing[provider] = pricing
+	}
+}
+
+// WithHeartbeat sends a heartbeat event (operationType HEARTBEAT, no model or token
+// fields) to DefaultHeartbeatEndpointPath every interval, so dashboards can detect a
+// silent outage of the integration during quiet periods without heartbeats showing
+// up as usage. Off by default; the heartbeat stops on Close
+func WithHeartbeat(interval time.Duration) Option {
+	return func(c *Config) {
+		c.HeartbeatInterval = interval
+	}
+}
+
+// WithTruncationStrategy sets which portion of captured prompts and responses is kept
+// when they exceed MaxPromptLength: "head" (default) keeps the beginning, "tail" the
+// end (e.g. the latest turn) and "middle" both ends. Unknown values fall back to head
+func WithTruncationStrategy(strategy string) Option {
+	return func(c *Config) {
+		switch strategy {
+		case TruncationStrategyHead, TruncationStrategyTail, TruncationStrategyMiddle:
+			c.TruncationStrategy = strategy
+		default:
+			Warn("Unknown truncation strategy %q, using head", strategy)
+			c.TruncationStrategy = TruncationStrategyHead
+		}
+	}
+}
+
+// WithMinimalPayload strips meter events down to the fields required to compute cost
+// (token counts, model, provider, timestamps) to minimize data egress. Metadata,
+// attributes (including vision flags) and captured prompts are omitted; heartbeats,
+// which carry no request data, are sent unchanged. WithEnvironmentEndpoints routing
+// still applies
+func WithMinimalPayload(enabled bool) Option {
+	return func(c *Config) {
+		c.MinimalPayload = enabled
+	}
+}
+
+// WithMetricsRecorder records each meter event's token counts and durations as
+// metrics (revenium.tokens.input, revenium.tokens.output, revenium.request.duration, ...)
+// through recorder. The otelmetrics subpackage provides a recorder backed by an
+// OpenTelemetry MeterProvider. With replaceHTTP the Revenium HTTP call is skipped;
+// otherwise metrics are recorded alongside it
+func WithMetricsRecorder(recorder MetricsRecorder, replaceHTTP bool) Option {
+	return func(c *Config) {
+		c.MetricsRecorder = recorder
+		c.MetricsOnly = replaceHTTP
+	}
+}
+
+// WithRequestDedup tags meter events with duplicateRequest when an identical request
+// (same input fingerprint) was already issued within window, surfacing wasteful
+// retries. Duplicates are only flagged, never blocked. Disabled by default
+func WithRequestDedup(window time.Duration) Option {
+	return func(c *Config) {
+		c.RequestDedupWindow = window
+	}
+}
+
+// WithPayloadInterceptor adds a hook that can adjust each metering payload just before
+// it is sent, after every middleware field (including streaming and prompt capture
+// fields) has been populated (see payload.go for the full precedence). Interceptors
+// run in registration order; WithMetadataBlocklist keys are still stripped afterwards
+func WithPayloadInterceptor(intercept func(payload map[string]interface{})) Option {
+	return func(c *Config) {
+		c.PayloadInterceptors = append(c.PayloadInterceptors, intercept)
+	}
+}
+
+// WithMeteringWorkers bounds metering to workers concurrent sends. Events beyond that
+// wait for a free worker, and the time spent waiting is reported as the
+// meteringQueueWaitMs attribute so a backed-up pipeline is visible. The metering
+// timeout starts once a worker is free, so queued events are not timed out by the
+// wait. Only sends are bounded: each metered request still starts its own
+// goroutine, which blocks while queued. Unbounded by default
+func WithMeteringWorkers(workers int) Option {
+	return func(c *Config) {
+		c.MeteringWorkers = workers
+	}
+}
+
+// WithStreamCheckpoint passes a snapshot of each in-progress stream (interim token
+// counts and, with prompt capture, the accumulated content) to checkpoint at most once
+// per interval, so a crash-recovery store can replay metering for streams lost to a
+// crash. Checkpoints are taken as events arrive; a final one with Closed set is sent
+// from Close. The function runs on the goroutine consuming the stream, so keep it fast
+func WithStreamCheckpoint(interval time.Duration, checkpoint func(StreamCheckpoint)) Option {
+	return func(c *Config) {
+		c.StreamCheckpointInterval = interval
+		c.StreamCheckpointFunc = checkpoint
+	}
+}
+
+// WithEnvironmentEndpoints routes each meter event to the Revenium base URL mapped to
+// its environment metadata value (e.g. "staging"), so one process can meter several
+// environments to separate projects. Unmapped environments use the default base URL
+func WithEnvironmentEndpoints(endpoints map[string]string) Option {
+	return func(c *Config) {
+		c.EnvironmentEndpoints = endpoints
+	}
+}
+
+// WithConfigFingerprint adds a configFingerprint attribute to every meter event: a short
+// hash of the settings that shape metering (provider routing, model aliases, capture and
+// payload options). Events can then be grouped by configuration version. Credentials are
+// never part of the hash
+func WithConfigFingerprint(enabled bool) Option {
+	return func(c *Config) {
+		c.ConfigFingerprint = enabled
+	}
+}
+
+// WithMeteringOnlyForModels meters only requests to the listed models, e.g. to skip
+// experimental models. Requests to other models run normally but their meter events
+// are skipped (and counted as skipped in MeteringStats). Models are matched after
+// alias resolution; an empty list meters every model
+func WithMeteringOnlyForModels(models []string) Option {
+	return func(c *Config) {
+		c.MeteredModels = models
+	}
+}
+
+// WithMaxInputTokens rejects requests whose estimated input tokens exceed n, with a
+// validation error reporting the estimate, before the provider is called. Text, tool
+// results and tool definitions are estimated at ~4 characters per token and each image
+// at a fixed ~1,600 tokens. Setting 0 disables the check
+func WithMaxInputTokens(n int) Option {
+	return func(c *Config) {
+		c.MaxInputTokens = n
+	}
+}
+
+// WithTransactionIDGenerator sets the function used to generate a transactionId when
+// the request metadata does not supply one, so IDs follow an existing scheme (ULID,
+// Snowflake). The default generates a random UUID; an empty result also falls back to it
+func WithTransactionIDGenerator(generator func() string) Option {
+	return func(c *Config) {
+		c.TransactionIDGenerator = generator
+	}
+}
+
+// WithFieldNameMap renames specific top-level payload fields before they are sent, for
+// self-hosted Revenium variants with a different schema (e.g. "inputTokenCount" ->
+// "input_tokens"). Keys are the default camelCase names and take precedence over
+// WithPayloadFieldCase; unmapped fields are unchanged. For reshaping the whole body,
+// use WithMeteringBodyTransform
+func WithFieldNameMap(names map[string]string) Option {
+	return func(c *Config) {
+		c.FieldNameMap = names
+	}
+}
+
+// WithStreamAutoReconnect re-issues an Anthropic streaming request up to maxAttempts
+// times when it fails mid-stream with a transient error (network drop, 429, 5xx).
+//
+// Caveats: the request is sent again from the beginning, so the resumed stream starts
+// a new message (a fresh message_start and content from the start) rather than
+// continuing the dropped one, and callers must be prepared to discard partial output.
+// Both attempts are billed, so metering reports the total tokens across attempts with
+// the reconnected and reconnectCount attributes. Disabled by default
+func WithStreamAutoReconnect(maxAttempts int) Option {
+	return func(c *Config) {
+		c.StreamAutoReconnectAttempts = maxAttempts
+	}
+}
+
+// WithSubscriberAggregation enables an in-memory tally of requests and tokens per
+// subscriber ID, readable via SubscriberStats, e.g. for soft local quotas between
+// Revenium syncs. At most 10,000 subscribers are tracked; the least recently seen is evicted
+func WithSubscriberAggregation(enabled bool) Option {
+	return func(c *Config) {
+		c.SubscriberAggregation = enabled
+	}
+}
+
+// WithGuardToolNames sets the names of guard tools (e.g. a prompt-injection checker)
+// When one of them appears as a tool_use block in the request conversation or the
+// response, the meter event is labeled with the guardToolInvoked attribute
+func WithGuardToolNames(names []string) Option {
+	return func(c *Config) {
+		c.GuardToolNames = names
+	}
+}
+
+// WithAutoDetectEnvironment fills the environment and region fields from the runtime
+// when metadata omits them: environment from ENV, ENVIRONMENT or DEPLOY_ENV, and region
+// from AWS_REGION/AWS_DEFAULT_REGION or the EC2 instance metadata service. Detection
+// runs once per process, when the client is initialized, so the metadata service
+// lookup never delays a request. Detected values override configured global and model
+// defaults; per-request metadata always wins
+func WithAutoDetectEnvironment(enabled bool) Option {
+	return func(c *Config) {
+		c.AutoDetectEnvironment = enabled
+	}
+}
+
+// WithMockResponses selects ProviderMock, which returns the given responses in order
+// from CreateMessage without any network access while still running the full metering
+// pipeline. Combine with WithMeteringSender to capture the meter events in tests.
+// Streaming is not supported by the mock provider
+func WithMockResponses(responses []anthropic.Message) Option {
+	return func(c *Config) {
+		c.MockResponses = responses
+	}
+}
+
+// WithMeteringSender replaces the HTTP call to Revenium with a custom sender, which
+// receives each payload after it is built (retries and counters still apply)
+func WithMeteringSender(sender func(ctx context.Context, payload map[string]interface{}) error) Option {
+	return func(c *Config) {
+		c.MeteringSender = sender
+	}
+}
+
+// WithBaggageKeys forwards the named baggage members (e.g. tenant, feature-flag state)
+// from the request context to meter event attributes. The middleware does not depend on
+// OpenTelemetry, so the baggage is read through a reader, for example:
+//
+//	revenium.WithBaggageReader(func(ctx context.Context) map[string]string {
+//		members := map[string]string{}
+//		for _, m := range baggage.FromContext(ctx).Members() {
+//			members[m.Key()] = m.Value()
+//		}
+//		return members
+//	})
+func WithBaggageKeys(keys []string) Option {
+	return func(c *Config) {
+		c.BaggageKeys = keys
+	}
+}
+
+// WithBaggageReader sets how baggage members are read from a context (see WithBaggageKeys)
+func WithBaggageReader(reader func(ctx context.Context) map[string]string) Option {
+	return func(c *Config) {
+		c.BaggageReader = reader
+	}
+}
+
+// WithStreamSummaryCallback sets a callback invoked once when a stream is closed, with
+// its final tokens, duration, time to first token, stop reason and estimated cost.
+// It runs synchronously in Close, so it should return quickly
+func WithStreamSummaryCallback(callback func(StreamSummary)) Option {
+	return func(c *Config) {
+		c.StreamSummaryCallback = callback
+	}
+}
+
+// WithMaxImagesPerRequest rejects requests containing more than n images with a
+// validation error before the provider is called, capping runaway vision costs.
+// Setting 0 disables the check
+func WithMaxImagesPerRequest(n int) Option {
+	return func(c *Config) {
+		c.MaxImagesPerRequest = n
+	}
+}
+
+// WithMeteringEnabled sets the process-wide metering kill switch when Initialize runs,
+// overriding REVENIUM_METERING_ENABLED. Clients built with NewReveniumAnthropic leave the
+// switch alone; use SetMeteringEnabled to change it at runtime
+func WithMeteringEnabled(enabled bool) Option {
+	return func(c *Config) {
+		c.MeteringEnabled = &enabled
+	}
+}
+
 // WithAWSRegion sets the AWS region
 func WithAWSRegion(region string) Option {
 	return func(c *Config) {
@@ -82,6 +693,95 @@ func WithCapturePrompts(capture bool) Option {
 	}
 }
 
+// WithInputTokenEstimateDisabled disables the synthetic input token estimate for streaming
+// When disabled, input tokens are reported as 0 until the stream reports real usage.
+// When the estimate is used, the payload carries an inputTokensEstimated attribute
+func WithInputTokenEstimateDisabled(disabled bool) Option {
+	return func(c *Config) {
+		c.DisableInputTokenEstimate = disabled
+	}
+}
+
+// WithMeterErrors enables metering of failed and cancelled requests
+// Cancelled requests are reported with stopReason CANCELLED and zero output tokens,
+// other failures with stopReason ERROR and the error message as errorReason
+func WithMeterErrors(enabled bool) Option {
+	return func(c *Config) {
+		c.MeterErrors = enabled
+	}
+}
+
+// WithPerToolMetering enables an additional meter event per tool_use block in the response
+// Each event is tagged with the tool name and linked to the request's event through
+// parentTransactionId. Token counts stay on the parent event to avoid double counting.
+// Applies to non-streaming requests
+func WithPerToolMetering(enabled bool) Option {
+	return func(c *Config) {
+		c.PerToolMetering = enabled
+	}
+}
+
+// WithCorrelationIDExtractor sets a function that extracts a correlation ID (e.g., X-Request-ID)
+// from the request context. The result is used as traceId when metadata doesn't supply one
+func WithCorrelationIDExtractor(extractor func(ctx context.Context) string) Option {
+	return func(c *Config) {
+		c.CorrelationIDExtractor = extractor
+	}
+}
+
+// WithModelMetadataDefaults sets default metadata per model
+// The defaults for the resolved model are merged beneath per-request metadata, so
+// explicit metadata always wins. Precedence: per-request > model defaults > global defaults
+func WithModelMetadataDefaults(defaults map[string]map[string]interface{}) Option {
+	return func(c *Config) {
+		c.ModelMetadataDefaults = defaults
+	}
+}
+
+// WithProviderNameOverrides sets how provider names are presented in Revenium
+// Keys may be internal provider names ("AWS", "Anthropic") or default display names
+// ("Amazon Bedrock"); unmapped providers keep the default normalization
+func WithProviderNameOverrides(overrides map[string]string) Option {
+	return func(c *Config) {
+		c.ProviderNameOverrides = overrides
+	}
+}
+
+// WithModelAliases maps friendly model names to real Anthropic models
+// Aliases are resolved before Bedrock conversion, so the resolved model is what gets
+// called and metered. Models without an alias pass through unchanged
+func WithModelAliases(aliases map[string]string) Option {
+	return func(c *Config) {
+		c.ModelAliases = aliases
+	}
+}
+
+// WithMetadataBlocklist prevents the listed keys from ever being sent to Revenium
+// Matching keys are dropped from metadata and stripped from the payload and its
+// attributes, as a safety net against accidentally including sensitive fields
+func WithMetadataBlocklist(keys []string) Option {
+	return func(c *Config) {
+		c.MetadataBlocklist = keys
+	}
+}
+
+// WithStartupSelfTest enables non-destructive configuration checks during initialization
+// Checks the Revenium key format and base URL, and for Bedrock the AWS configuration
+// and base ARN. All problems are reported together in a single error
+func WithStartupSelfTest(enabled bool) Option {
+	return func(c *Config) {
+		c.StartupSelfTest = enabled
+	}
+}
+
+// WithStartupSelfTestPing makes the startup self-test also send a HEAD request to the
+// Revenium base URL to confirm it is reachable
+func WithStartupSelfTestPing(enabled bool) Option {
+	return func(c *Config) {
+		c.StartupSelfTestPing = enabled
+	}
+}
+
 // loadFromEnv loads configuration from environment variables and .env files
 func (c *Config) loadFromEnv() error {
 	// First, try to load .env files automatically
@@ -114,6 +814,17 @@ func (c *Config) loadFromEnv() error {
 		Debug("Anthropic API key loaded (length: %d)", len(c.AnthropicAPIKey))
 	}
 
+	// Runtime kill switch, applied by Initialize (REVENIUM_METERING_ENABLED=false
+	// disables all metering, true re-enables it)
+	switch os.Getenv("REVENIUM_METERING_ENABLED") {
+	case "true", "1":
+		enabled := true
+		c.MeteringEnabled = &enabled
+	case "false", "0":
+		enabled := false
+		c.MeteringEnabled = &enabled
+	}
+
 	if os.Getenv("REVENIUM_BEDROCK_DISABLE") == "1" || os.Getenv("REVENIUM_BEDROCK_DISABLE") == "true" {
 		c.BedrockDisabled = true
 	}
@@ -179,6 +890,70 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// RunStartupSelfTest performs non-destructive validation of the configuration
+// It returns a config error aggregating every problem found, or nil if all checks pass
+func RunStartupSelfTest(cfg *Config) error {
+	if cfg == nil {
+		return NewConfigError("config cannot be nil", nil)
+	}
+
+	var problems []error
+
+	// Revenium API key format
+	if !isValidAPIKeyFormat(cfg.ReveniumAPIKey) {
+		problems = append(problems, errors.New("revenium API key must start with \"hak_\""))
+	}
+
+	// Revenium base URL
+	baseURL := cfg.ReveniumBaseURL
+	if baseURL == "" {
+		baseURL = "https://api.revenium.ai"
+	}
+	if err := ValidateMeteringURL(baseURL, cfg.AllowInsecureMetering); err != nil {
+		problems = append(problems, err)
+	} else if cfg.StartupSelfTestPing {
+		if err := pingMeteringURL(baseURL); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	// AWS Bedrock configuration, only when Bedrock is the selected provider
+	if DetectProvider(cfg) == ProviderBedrock {
+		if _, err := loadAWSConfig(cfg); err != nil {
+			problems = append(problems, err)
+		}
+		if cfg.AWSModelARNBase != "" {
+			if err := ValidateBedrockBaseARN(cfg.AWSModelARNBase); err != nil {
+				problems = append(problems, err)
+			}
+		}
+		if cfg.BedrockEndpointURL != "" {
+			if err := ValidateBedrockEndpointURL(cfg.BedrockEndpointURL); err != nil {
+				problems = append(problems, err)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return NewConfigError(fmt.Sprintf("startup self-test found %d problem(s)", len(problems)), errors.Join(problems...))
+	}
+
+	Debug("Startup self-test passed")
+	return nil
+}
+
+// pingMeteringURL sends a HEAD request to the base URL to confirm it is reachable
+// Any HTTP response counts as reachable; only transport failures are reported
+func pingMeteringURL(baseURL string) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Head(baseURL)
+	if err != nil {
+		return fmt.Errorf("revenium base URL %s is not reachable: %w", baseURL, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
 // isValidAPIKeyFormat checks if the API key has a valid format
 func isValidAPIKeyFormat(key string) bool {
 	// Revenium API keys should start with "hak_"
@@ -196,6 +971,37 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return defaultValue
 }
 
+// ValidateMeteringURL checks that a metering base URL is safe to send prompt data to
+// HTTPS is always accepted. Plain HTTP is accepted for localhost/loopback addresses,
+// or for any host when allowInsecure is set
+func ValidateMeteringURL(baseURL string, allowInsecure bool) error {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || parsed.Host == "" {
+		return NewConfigError(fmt.Sprintf("invalid Revenium base URL: %s", baseURL), err)
+	}
+
+	switch strings.ToLower(parsed.Scheme) {
+	case "https":
+		return nil
+	case "http":
+		if allowInsecure || isLoopbackHost(parsed.Hostname()) {
+			return nil
+		}
+		return NewConfigError(fmt.Sprintf("refusing to send metering data over insecure HTTP to %s (use https or WithAllowInsecureMetering(true))", parsed.Host), nil)
+	default:
+		return NewConfigError(fmt.Sprintf("unsupported Revenium base URL scheme: %s", parsed.Scheme), nil)
+	}
+}
+
+// isLoopbackHost reports whether host refers to the local machine
+func isLoopbackHost(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // NormalizeReveniumBaseURL normalizes the base URL to a consistent format
 // It handles various input formats and returns a normalized base URL without trailing slash
 // The endpoint path (/meter/v2/ai/completions) is appended by sendMeteringRequest
@@ -0,0 +1,96 @@
+package revenium
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateMeteringURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		baseURL       string
+		allowInsecure bool
+		wantErr       bool
+	}{
+		{"https allowed", "https://api.revenium.ai", false, false},
+		{"http localhost allowed", "http://localhost:8080", false, false},
+		{"http loopback IP allowed", "http://127.0.0.1:8080", false, false},
+		{"http remote rejected", "http://metering.example.com", false, true},
+		{"http remote allowed with override", "http://metering.example.com", true, false},
+		{"unsupported scheme rejected", "ftp://metering.example.com", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateMeteringURL(tt.baseURL, tt.allowInsecure)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateMeteringURL(%q, %v) error = %v, wantErr %v", tt.baseURL, tt.allowInsecure, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSendMeteringRequestRejectsInsecureURL(t *testing.T) {
+	client, err := NewReveniumAnthropic(&Config{
+		ReveniumAPIKey:  "hak_test",
+		ReveniumBaseURL: "http://metering.example.com",
+	})
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	defer client.Close()
+
+	// Rejected before any connection is attempted
+	err = client.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"model": "test"})
+	if err == nil || !IsConfigError(err) {
+		t.Fatalf("sendMeteringRequest error = %v, want a config error", err)
+	}
+}
+
+func TestRunStartupSelfTest(t *testing.T) {
+	valid := &Config{ReveniumAPIKey: "hak_test", ReveniumBaseURL: "https://api.revenium.ai", BedrockDisabled: true}
+	if err := RunStartupSelfTest(valid); err != nil {
+		t.Fatalf("RunStartupSelfTest(valid) = %v", err)
+	}
+
+	// Every problem is reported at once
+	invalid := &Config{ReveniumAPIKey: "sk_wrong", ReveniumBaseURL: "http://metering.example.com", BedrockDisabled: true}
+	err := RunStartupSelfTest(invalid)
+	if !IsConfigError(err) {
+		t.Fatalf("RunStartupSelfTest(invalid) = %v, want a config error", err)
+	}
+	for _, want := range []string{"2 problem(s)", `revenium API key must start with "hak_"`, "metering.example.com"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+}
+
+func TestStartupSelfTestPing(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound) // Any response counts as reachable
+	}))
+	cfg := &Config{ReveniumAPIKey: "hak_test", ReveniumBaseURL: server.URL, BedrockDisabled: true, StartupSelfTestPing: true}
+	if err := RunStartupSelfTest(cfg); err != nil {
+		t.Errorf("RunStartupSelfTest(reachable) = %v", err)
+	}
+
+	server.Close()
+	if err := RunStartupSelfTest(cfg); err == nil || !strings.Contains(err.Error(), "is not reachable") {
+		t.Errorf("RunStartupSelfTest(unreachable) = %v, want a reachability problem", err)
+	}
+}
+
+func TestStartupSelfTestRunsWhenClientIsBuilt(t *testing.T) {
+	cfg := &Config{ReveniumAPIKey: "sk_wrong", BedrockDisabled: true}
+	if _, err := NewReveniumAnthropic(cfg); err != nil {
+		t.Fatalf("NewReveniumAnthropic without the self-test: %v", err)
+	}
+
+	cfg.StartupSelfTest = true
+	if _, err := NewReveniumAnthropic(cfg); !IsConfigError(err) {
+		t.Errorf("NewReveniumAnthropic with the self-test = %v, want a config error", err)
+	}
+}
@@ -4,14 +4,21 @@ import (
 	"context"
 )
 
-// contextKey is a type for context keys to avoid collisions
+// contextKey is an unexported type for context keys, so a plain string key with the
+// same text (e.g. "revenium_usage_metadata") can never collide with ours
 type contextKey string
 
 const (
 	usageMetadataKey contextKey = "revenium_usage_metadata"
 	subscriberKey    contextKey = "revenium_subscriber"
+	requestIDKey     contextKey = "revenium_request_id"
+	providerKey      contextKey = "revenium_provider_override"
+	sourceKey        contextKey = "revenium_request_source"
 )
 
+// RequestIDHeader is the header that carries the request ID on Anthropic calls
+const RequestIDHeader = "X-Request-Id"
+
 // UsageMetadata represents metadata about API usage
 type UsageMetadata struct {
 	OrganizationID string                 `json:"organization_id,omitempty"`
@@ -42,6 +49,70 @@ func GetUsageMetadata(ctx context.Context) map[string]interface{} {
 	return make(map[string]interface{})
 }
 
+// GetUsageMetadataFromKey retrieves metadata stored under a caller-specified context key
+// Only map[string]interface{} and map[string]string values are recognized
+func GetUsageMetadataFromKey(ctx context.Context, key interface{}) map[string]interface{} {
+	if key == nil {
+		return nil
+	}
+	switch value := ctx.Value(key).(type) {
+	case map[string]interface{}:
+		return value
+	case map[string]string:
+		metadata := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			metadata[k] = v
+		}
+		return metadata
+	default:
+		return nil
+	}
+}
+
+// WithRequestID returns a new context carrying a request ID that is sent to Anthropic
+// in the X-Request-Id header and used as the meter event's transactionId, giving one
+// correlating ID across both systems
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// GetRequestID retrieves the request ID from context, or "" if none is set
+func GetRequestID(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		return id
+	}
+	return ""
+}
+
+// WithProviderOverride returns a new context that routes a single request to provider
+// (e.g. ProviderAnthropic for a model not available on Bedrock), overriding the
+// client's detected provider
+func WithProviderOverride(ctx context.Context, provider Provider) context.Context {
+	return context.WithValue(ctx, providerKey, provider)
+}
+
+// GetProviderOverride retrieves the per-request provider override, if any
+func GetProviderOverride(ctx context.Context) (Provider, bool) {
+	provider, ok := ctx.Value(providerKey).(Provider)
+	return provider, ok && provider != ""
+}
+
+// WithRequestSource returns a new context carrying the request's origin, such as the
+// originating client IP or a source identifier in a multi-tenant gateway. It is
+// metered as the source attribute (and clientIp when it is an IP address) unless the
+// usage metadata already sets source
+func WithRequestSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey, source)
+}
+
+// GetRequestSource retrieves the request source from context, or "" if none is set
+func GetRequestSource(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceKey).(string); ok {
+		return source
+	}
+	return ""
+}
+
 // WithSubscriber returns a new context with subscriber information
 func WithSubscriber(ctx context.Context, subscriber *Subscriber) context.Context {
 	return context.WithValue(ctx, subscriberKey, subscriber)
@@ -84,3 +155,59 @@ func ExtractMetadata(ctx context.Context, paramMetadata map[string]interface{})
 	contextMetadata := GetUsageMetadata(ctx)
 	return MergeMetadata(contextMetadata, paramMetadata)
 }
+
+// metadataKeyAliases maps snake_case metadata keys (as used by the Node.js and Python
+// middleware) to the camelCase keys expected by the metering payload
+var metadataKeyAliases = map[string]string{
+	"organization_id":           "organizationId",
+	"product_id":                "productId",
+	"task_type":                 "taskType",
+	"subscription_id":           "subscriptionId",
+	"trace_id":                  "traceId",
+	"task_id":                   "taskId",
+	"response_quality_score":    "responseQualityScore",
+	"transaction_id":            "transactionId",
+	"trace_type":                "traceType",
+	"trace_name":                "traceName",
+	"retry_number":              "retryNumber",
+	"credential_alias":          "credentialAlias",
+	"parent_transaction_id":     "parentTransactionId",
+	"model_source":              "modelSource",
+	"mediation_latency":         "mediationLatency",
+	"system_fingerprint":        "systemFingerprint",
+	"input_token_cost":          "inputTokenCost",
+	"output_token_cost":         "outputTokenCost",
+	"cache_creation_token_cost": "cacheCreationTokenCost",
+	"cache_read_token_cost":     "cacheReadTokenCost",
+	"total_cost":                "totalCost",
+	"error_reason":              "errorReason",
+}
+
+// NormalizeMetadataKeys returns a copy of metadata with known snake_case keys renamed
+// to their camelCase equivalents. When both forms are present the camelCase value wins
+func NormalizeMetadataKeys(metadata map[string]interface{}) map[string]interface{} {
+	if metadata == nil {
+		return nil
+	}
+
+	normalized := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		if _, isAlias := metadataKeyAliases[k]; !isAlias {
+			normalized[k] = v
+		}
+	}
+	for k, v := range metadata {
+		camel, isAlias := metadataKeyAliases[k]
+		if !isAlias {
+			continue
+		}
+		if _, exists := normalized[camel]; exists {
+			Debug("Metadata key %s ignored, %s is already set", k, camel)
+			continue
+		}
+		Debug("Metadata key %s remapped to %s", k, camel)
+		normalized[camel] = v
+	}
+
+	return normalized
+}
@@ -0,0 +1,50 @@
+package revenium
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormalizeMetadataKeys(t *testing.T) {
+	got := NormalizeMetadataKeys(map[string]interface{}{
+		"organization_id": "org-snake",
+		"task_type":       "summarize",
+		"trace_id":        "trace-snake",
+		"traceId":         "trace-camel",
+		"customField":     "kept",
+	})
+
+	want := map[string]interface{}{
+		"organizationId": "org-snake",
+		"taskType":       "summarize",
+		"traceId":        "trace-camel",
+		"customField":    "kept",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("normalized metadata = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if NormalizeMetadataKeys(nil) != nil {
+		t.Error("nil metadata was not returned as nil")
+	}
+}
+
+func TestProviderOverrideRoutesSingleRequest(t *testing.T) {
+	m := &MessagesInterface{provider: ProviderBedrock}
+
+	if got := m.requestProvider(context.Background()); got != ProviderBedrock {
+		t.Errorf("requestProvider without override = %v, want the detected provider", got)
+	}
+	if got := m.requestProvider(WithProviderOverride(context.Background(), ProviderAnthropic)); got != ProviderAnthropic {
+		t.Errorf("requestProvider with override = %v, want %v", got, ProviderAnthropic)
+	}
+
+	// An empty override is ignored
+	if _, ok := GetProviderOverride(WithProviderOverride(context.Background(), "")); ok {
+		t.Error("GetProviderOverride reported an empty provider as set")
+	}
+}
@@ -0,0 +1,65 @@
+package revenium
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTrackedFingerprints bounds the memory used by the duplicate request guard
+const maxTrackedFingerprints = 10000
+
+// requestDedup remembers recent request fingerprints to flag duplicate (replayed)
+// requests issued within a time window
+type requestDedup struct {
+	mu        sync.Mutex
+	window    time.Duration
+	seen      map[string]time.Time // fingerprint -> last time it was seen
+	lastSweep time.Time
+}
+
+// newRequestDedup returns a dedup guard, or nil when window is not positive
+func newRequestDedup(window time.Duration) *requestDedup {
+	if window <= 0 {
+		return nil
+	}
+	return &requestDedup{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// isDuplicate records fingerprint and reports whether it was already seen within the window
+func (d *requestDedup) isDuplicate(fingerprint string) bool {
+	if d == nil || fingerprint == "" {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.sweep(now)
+
+	last, ok := d.seen[fingerprint]
+	d.seen[fingerprint] = now
+	return ok && now.Sub(last) <= d.window
+}
+
+// sweep drops expired fingerprints once per window, or immediately when the map is
+// full. Must be called with d.mu held
+func (d *requestDedup) sweep(now time.Time) {
+	if len(d.seen) < maxTrackedFingerprints && now.Sub(d.lastSweep) < d.window {
+		return
+	}
+	for fingerprint, last := range d.seen {
+		if now.Sub(last) > d.window {
+			delete(d.seen, fingerprint)
+		}
+	}
+	d.lastSweep = now
+
+	// Still full of live entries: start over rather than grow without bound
+	if len(d.seen) >= maxTrackedFingerprints {
+		d.seen = make(map[string]time.Time)
+	}
+}
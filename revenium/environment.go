@@ -0,0 +1,98 @@
+package revenium
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imdsBaseURL is the AWS instance metadata service endpoint
+const imdsBaseURL = "http://169.254.169.254"
+
+// imdsTimeout bounds each instance metadata request so detection never stalls startup
+// on hosts that are not EC2 instances
+const imdsTimeout = 300 * time.Millisecond
+
+var (
+	runtimeMetadataOnce sync.Once
+	runtimeMetadata     map[string]interface{}
+)
+
+// detectRuntimeMetadata returns environment and region detected from the runtime,
+// computed once per process:
+//   - environment from ENV, ENVIRONMENT or DEPLOY_ENV (first non-empty)
+//   - region from AWS_REGION or AWS_DEFAULT_REGION, falling back to EC2 IMDS
+func detectRuntimeMetadata() map[string]interface{} {
+	runtimeMetadataOnce.Do(func() {
+		runtimeMetadata = make(map[string]interface{})
+
+		if environment := firstEnv("ENV", "ENVIRONMENT", "DEPLOY_ENV"); environment != "" {
+			runtimeMetadata["environment"] = environment
+		}
+
+		region := firstEnv("AWS_REGION", "AWS_DEFAULT_REGION")
+		if region == "" {
+			region = imdsRegion(imdsBaseURL)
+		}
+		if region != "" {
+			runtimeMetadata["region"] = region
+		}
+
+		Debug("Detected runtime metadata: %v", runtimeMetadata)
+	})
+	return runtimeMetadata
+}
+
+// firstEnv returns the value of the first non-empty environment variable
+func firstEnv(names ...string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// imdsRegion queries the EC2 instance metadata service (IMDSv2) for the region
+// It returns "" when the service is unreachable, e.g. outside EC2
+func imdsRegion(baseURL string) string {
+	client := &http.Client{Timeout: imdsTimeout}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*imdsTimeout)
+	defer cancel()
+
+	tokenReq, err := http.NewRequestWithContext(ctx, http.MethodPut, baseURL+"/latest/api/token", nil)
+	if err != nil {
+		return ""
+	}
+	tokenReq.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	tokenResp, err := client.Do(tokenReq)
+	if err != nil {
+		Debug("Instance metadata service unavailable: %v", err)
+		return ""
+	}
+	token, _ := io.ReadAll(tokenResp.Body)
+	tokenResp.Body.Close()
+	if tokenResp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	regionReq, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL+"/latest/meta-data/placement/region", nil)
+	if err != nil {
+		return ""
+	}
+	regionReq.Header.Set("X-aws-ec2-metadata-token", string(token))
+	regionResp, err := client.Do(regionReq)
+	if err != nil {
+		return ""
+	}
+	defer regionResp.Body.Close()
+	if regionResp.StatusCode != http.StatusOK {
+		return ""
+	}
+	region, _ := io.ReadAll(regionResp.Body)
+	return strings.TrimSpace(string(region))
+}
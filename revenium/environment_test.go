@@ -0,0 +1,40 @@
+package revenium
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIMDSRegionUsesSessionToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			w.Write([]byte("token-1"))
+		case r.URL.Path == "/latest/meta-data/placement/region" && r.Header.Get("X-aws-ec2-metadata-token") == "token-1":
+			w.Write([]byte("eu-west-1\n"))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	if got := imdsRegion(server.URL); got != "eu-west-1" {
+		t.Errorf("imdsRegion = %q, want eu-west-1", got)
+	}
+
+	// Outside EC2 the service is unreachable and no region is reported
+	server.Close()
+	if got := imdsRegion(server.URL); got != "" {
+		t.Errorf("imdsRegion with no metadata service = %q, want none", got)
+	}
+}
+
+func TestFirstEnvSkipsEmptyValues(t *testing.T) {
+	t.Setenv("ENV", " ")
+	t.Setenv("ENVIRONMENT", "staging")
+	t.Setenv("DEPLOY_ENV", "production")
+	if got := firstEnv("ENV", "ENVIRONMENT", "DEPLOY_ENV"); got != "staging" {
+		t.Errorf("firstEnv = %q, want staging", got)
+	}
+}
@@ -0,0 +1,91 @@
+package revenium
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// canonicalJSON serializes v with object keys sorted at every level, so identical
+// logical values always produce identical bytes regardless of map iteration order
+// or struct field order. Numbers are preserved exactly
+func canonicalJSON(v interface{}) ([]byte, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var generic interface{}
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+
+	// encoding/json writes map keys in sorted order
+	return json.Marshal(generic)
+}
+
+// InputFingerprint returns a stable SHA-256 hex digest of the request parameters,
+// computed over a canonical serialization. Identical requests always share a
+// fingerprint, which makes it suitable for deduplication and idempotency keys
+func InputFingerprint(params anthropic.MessageNewParams) (string, error) {
+	fingerprint, _, err := requestFingerprint(params)
+	return fingerprint, err
+}
+
+// requestFingerprint returns the input fingerprint and serialized size of a request
+// from a single canonical serialization, so neither needs its own marshal
+func requestFingerprint(params anthropic.MessageNewParams) (string, int, error) {
+	canonical, err := canonicalJSON(params)
+	if err != nil {
+		return "", 0, err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), len(canonical), nil
+}
+
+// configFingerprintLength is the number of hex characters kept from the config digest
+const configFingerprintLength = 12
+
+// configFingerprint returns a short hex digest of the config fields that shape metering
+// payloads. Credentials are excluded and function-valued fields contribute only whether
+// they are set, so the fingerprint is stable across processes with the same settings
+func configFingerprint(cfg *Config) string {
+	fields := map[string]interface{}{
+		"reveniumBaseUrl":           cfg.ReveniumBaseURL,
+		"reveniumOrgId":             cfg.ReveniumOrgID,
+		"reveniumProductId":         cfg.ReveniumProductID,
+		"anthropicVersion":          cfg.AnthropicVersion,
+		"awsRegion":                 cfg.AWSRegion,
+		"awsModelArnBase":           cfg.AWSModelARNBase,
+		"bedrockDisabled":           cfg.BedrockDisabled,
+		"modelAliases":              cfg.ModelAliases,
+		"providerNameOverrides":     cfg.ProviderNameOverrides,
+		"modelMetadataDefaults":     cfg.ModelMetadataDefaults,
+		"metadataBlocklist":         cfg.MetadataBlocklist,
+		"capturePrompts":            cfg.CapturePrompts,
+		"structuredResponseCapture": cfg.StructuredResponseCapture,
+		"truncationStrategy":        cfg.TruncationStrategy,
+		"minimalPayload":            cfg.MinimalPayload,
+		"payloadFieldCase":          cfg.PayloadFieldCase,
+		"fieldNameMap":              cfg.FieldNameMap,
+		"disableInputTokenEstimate": cfg.DisableInputTokenEstimate,
+		"perToolMetering":           cfg.PerToolMetering,
+		"meterErrors":               cfg.MeterErrors,
+		"operationTypeEndpoints":    cfg.OperationTypeEndpoints,
+		"environmentEndpoints":      cfg.EnvironmentEndpoints,
+		"meteredModels":             cfg.MeteredModels,
+		"payloadInterceptors":       len(cfg.PayloadInterceptors),
+		"meteringBodyTransform":     cfg.MeteringBodyTransform != nil,
+	}
+	canonical, err := canonicalJSON(fields)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])[:configFingerprintLength]
+}
@@ -0,0 +1,30 @@
+package revenium
+
+import "testing"
+
+func TestInputFingerprintIsStable(t *testing.T) {
+	first, err := InputFingerprint(textRequest("hello"))
+	if err != nil {
+		t.Fatalf("InputFingerprint: %v", err)
+	}
+	second, _ := InputFingerprint(textRequest("hello"))
+	if first != second || len(first) != 64 {
+		t.Errorf("fingerprints %q and %q, want the same 64-character digest", first, second)
+	}
+	if other, _ := InputFingerprint(textRequest("goodbye")); other == first {
+		t.Error("different requests share a fingerprint")
+	}
+}
+
+func TestCanonicalJSONSortsKeysAndKeepsNumbers(t *testing.T) {
+	got, err := canonicalJSON(map[string]interface{}{
+		"b": 1,
+		"a": map[string]interface{}{"z": 12345678901234567890.0, "y": "x"},
+	})
+	if err != nil {
+		t.Fatalf("canonicalJSON: %v", err)
+	}
+	if want := `{"a":{"y":"x","z":12345678901234567000},"b":1}`; string(got) != want {
+		t.Errorf("canonicalJSON = %s, want %s", got, want)
+	}
+}
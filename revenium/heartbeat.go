@@ -0,0 +1,108 @@
+package revenium
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// heartbeat periodically sends a heartbeat event to the Revenium health endpoint so
+// dashboards can tell an idle integration from a silent outage of the middleware itself
+type heartbeat struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// startHeartbeat begins sending heartbeats for r every interval. It returns nil
+// when interval is not positive (heartbeats are off by default)
+func startHeartbeat(r *ReveniumAnthropic, interval time.Duration) *heartbeat {
+	if interval <= 0 {
+		return nil
+	}
+
+	hb := &heartbeat{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(hb.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.sendHeartbeat(interval)
+			case <-hb.stop:
+				return
+			}
+		}
+	}()
+
+	Debug("Heartbeat started with interval %v", interval)
+	return hb
+}
+
+// close stops the heartbeat and waits for any in-progress send to finish
+func (hb *heartbeat) close() {
+	if hb == nil {
+		return
+	}
+	hb.once.Do(func() { close(hb.stop) })
+	<-hb.done
+}
+
+// sendHeartbeat sends one heartbeat event through the regular send path (worker
+// bound, MetricsOnly, panic recovery). Heartbeats honor the metering kill switch
+// but are not counted in MeteringStats or recorded in payload history
+func (r *ReveniumAnthropic) sendHeartbeat(interval time.Duration) {
+	if !IsMeteringEnabled() {
+		return
+	}
+
+	m := r.Messages()
+	m.counters, m.history, m.subs = nil, nil, nil
+	payload := buildHeartbeatPayload(m.config, m.provider, interval)
+
+	if err := m.sendMeteringWithRetry(context.Background(), payload); err != nil {
+		Warn("Failed to send heartbeat: %v", err)
+	}
+}
+
+// heartbeatOperationType is the operationType of heartbeat events, which are a
+// separate event type from completions
+const heartbeatOperationType = "HEARTBEAT"
+
+// isHeartbeatPayload reports whether a payload is a heartbeat event
+func isHeartbeatPayload(payload map[string]interface{}) bool {
+	operationType, _ := payload["operationType"].(string)
+	return operationType == heartbeatOperationType
+}
+
+// buildHeartbeatPayload returns a heartbeat event. It carries no model, token or cost
+// fields, so it can never be mistaken for a zero-token completion in usage data
+func buildHeartbeatPayload(cfg *Config, provider Provider, interval time.Duration) map[string]interface{} {
+	providerName := "Anthropic"
+	switch {
+	case provider.IsBedrock():
+		providerName = "AWS"
+	case provider.IsMock():
+		providerName = "Mock"
+	}
+
+	payload := map[string]interface{}{
+		"operationType":       heartbeatOperationType,
+		"provider":            resolveProviderName(cfg, providerName),
+		"middlewareSource":    GetMiddlewareSource(),
+		"timestamp":           time.Now().UTC().Format(meteringTimeFormat),
+		"heartbeatIntervalMs": interval.Milliseconds(),
+	}
+
+	// Keep the environment so WithEnvironmentEndpoints routes heartbeats like usage
+	if environment, ok := resolveMetadataDefaults(cfg, "", nil)["environment"]; ok {
+		payload["environment"] = environment
+	}
+	return payload
+}
@@ -0,0 +1,141 @@
+package revenium
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingRecorder is a MetricsRecorder that counts recorded values
+type countingRecorder struct {
+	counters int
+}
+
+func (c *countingRecorder) AddCounter(context.Context, string, int64, map[string]string) {
+	c.counters++
+}
+
+func (c *countingRecorder) RecordHistogram(context.Context, string, float64, map[string]string) {}
+
+func TestHeartbeatRecoversFromPanickingSender(t *testing.T) {
+	client, err := NewReveniumAnthropic(&Config{
+		ReveniumAPIKey: "hak_test",
+		MeteringSender: func(context.Context, map[string]interface{}) error { panic("serializer bug") },
+	})
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	defer client.Close()
+
+	// Must not crash the process
+	client.sendHeartbeat(time.Minute)
+
+	if stats := client.MeteringStats(); stats.Sent != 0 || stats.Failed != 0 {
+		t.Errorf("heartbeat was counted in MeteringStats: %+v", stats)
+	}
+}
+
+func TestHeartbeatHonorsMetricsOnly(t *testing.T) {
+	sent := 0
+	recorder := &countingRecorder{}
+	client, err := NewReveniumAnthropic(&Config{
+		ReveniumAPIKey:  "hak_test",
+		MetricsRecorder: recorder,
+		MetricsOnly:     true,
+		MeteringSender: func(context.Context, map[string]interface{}) error {
+			sent++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	defer client.Close()
+
+	client.sendHeartbeat(time.Minute)
+
+	if sent != 0 {
+		t.Errorf("heartbeat was sent to Revenium in metrics-only mode")
+	}
+	if recorder.counters != 0 {
+		t.Errorf("heartbeat was recorded as a request metric")
+	}
+}
+
+func TestHeartbeatIsASeparateEventType(t *testing.T) {
+	var body map[string]interface{}
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	m := &MessagesInterface{config: &Config{
+		ReveniumAPIKey:       "hak_test",
+		ReveniumBaseURL:      "https://api.revenium.invalid",
+		MinimalPayload:       true,
+		EnvironmentEndpoints: map[string]string{"staging": server.URL + "/staging"},
+	}}
+	payload := buildHeartbeatPayload(m.config, ProviderAnthropic, time.Minute)
+	payload["environment"] = "staging"
+
+	if err := m.sendMeteringRequest(context.Background(), payload); err != nil {
+		t.Fatalf("sendMeteringRequest: %v", err)
+	}
+
+	// Heartbeats go to the health endpoint of their environment, never the usage one
+	if path != "/staging"+DefaultHeartbeatEndpointPath {
+		t.Errorf("heartbeat sent to %q, want the staging heartbeat endpoint", path)
+	}
+	if body["operationType"] != "HEARTBEAT" || body["heartbeatIntervalMs"] != 60000.0 {
+		t.Errorf("heartbeat body = %v", body)
+	}
+	for _, key := range []string{"model", "inputTokenCount", "outputTokenCount", "costType"} {
+		if _, ok := body[key]; ok {
+			t.Errorf("heartbeat carries usage field %q", key)
+		}
+	}
+}
+
+func TestHeartbeatFiresAtIntervalAndStopsOnClose(t *testing.T) {
+	var mu sync.Mutex
+	var beats []time.Time
+	client, err := NewReveniumAnthropic(&Config{
+		ReveniumAPIKey:    "hak_test",
+		HeartbeatInterval: 20 * time.Millisecond,
+		MeteringSender: func(_ context.Context, payload map[string]interface{}) error {
+			if isHeartbeatPayload(payload) {
+				mu.Lock()
+				beats = append(beats, time.Now())
+				mu.Unlock()
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+
+	time.Sleep(110 * time.Millisecond)
+	client.Close()
+	mu.Lock()
+	fired := len(beats)
+	mu.Unlock()
+
+	// About one heartbeat per interval, allowing for scheduler jitter
+	if fired < 2 || fired > 8 {
+		t.Errorf("got %d heartbeats in 110ms at a 20ms interval", fired)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(beats) != fired {
+		t.Errorf("%d heartbeats fired after Close", len(beats)-fired)
+	}
+}
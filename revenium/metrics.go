@@ -0,0 +1,46 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+)
+
+// Metric instrument names recorded through a MetricsRecorder
+const (
+	MetricInputTokens         = "revenium.tokens.input"                // Counter
+	MetricOutputTokens        = "revenium.tokens.output"               // Counter
+	MetricCacheCreationTokens = "revenium.tokens.cache_creation"       // Counter
+	MetricCacheReadTokens     = "revenium.tokens.cache_read"           // Counter
+	MetricRequests            = "revenium.requests"                    // Counter
+	MetricRequestDuration     = "revenium.request.duration"            // Histogram, milliseconds
+	MetricTimeToFirstToken    = "revenium.request.time_to_first_token" // Histogram, milliseconds (streams only)
+)
+
+// MetricsRecorder receives per-request measurements. The middleware itself does not
+// depend on OpenTelemetry; otelmetrics.NewRecorder adapts an OTel MeterProvider
+type MetricsRecorder interface {
+	// AddCounter adds value to the named monotonic counter
+	AddCounter(ctx context.Context, name string, value int64, attrs map[string]string)
+	// RecordHistogram records value in the named histogram
+	RecordHistogram(ctx context.Context, name string, value float64, attrs map[string]string)
+}
+
+// recordPayloadMetrics records one meter event's token counts and timings
+func recordPayloadMetrics(ctx context.Context, recorder MetricsRecorder, payload map[string]interface{}) {
+	attrs := map[string]string{}
+	for _, key := range []string{"model", "provider", "stopReason"} {
+		if value, ok := payload[key]; ok && value != nil {
+			attrs[key] = fmt.Sprint(value)
+		}
+	}
+
+	recorder.AddCounter(ctx, MetricRequests, 1, attrs)
+	recorder.AddCounter(ctx, MetricInputTokens, toInt64(payload["inputTokenCount"]), attrs)
+	recorder.AddCounter(ctx, MetricOutputTokens, toInt64(payload["outputTokenCount"]), attrs)
+	recorder.AddCounter(ctx, MetricCacheCreationTokens, toInt64(payload["cacheCreationTokenCount"]), attrs)
+	recorder.AddCounter(ctx, MetricCacheReadTokens, toInt64(payload["cacheReadTokenCount"]), attrs)
+	recorder.RecordHistogram(ctx, MetricRequestDuration, float64(toInt64(payload["requestDuration"])), attrs)
+	if isStreamed, _ := payload["isStreamed"].(bool); isStreamed {
+		recorder.RecordHistogram(ctx, MetricTimeToFirstToken, float64(toInt64(payload["timeToFirstToken"])), attrs)
+	}
+}
@@ -3,13 +3,20 @@ package revenium
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/anthropics/anthropic-sdk-go"
 	"github.com/anthropics/anthropic-sdk-go/option"
@@ -23,12 +30,38 @@ type ReveniumAnthropic struct {
 	provider Provider
 	mu       sync.RWMutex
 	wg       sync.WaitGroup // WaitGroup for tracking in-flight metering goroutines
+	counters meteringCounters
+	history  *payloadHistory // Recent payloads, when WithPayloadHistory is set
+	subs     *subscriberAggregator
+	mock     *mockResponder // Canned responses for ProviderMock
+	beat     *heartbeat     // Background heartbeat, when WithHeartbeat is set
+	dedup    *requestDedup  // Duplicate request guard, when WithRequestDedup is set
+	workers  chan struct{}  // Metering send slots, when WithMeteringWorkers is set
 }
 
+// DefaultMeteringEndpointPath is the Revenium endpoint path for AI completion events
+const DefaultMeteringEndpointPath = "/meter/v2/ai/completions"
+
+// DefaultHeartbeatEndpointPath is the Revenium health endpoint path for heartbeat events
+const DefaultHeartbeatEndpointPath = "/meter/v2/health/heartbeat"
+
+// DefaultMeteringContentType is the Content-Type header sent with metering requests
+const DefaultMeteringContentType = "application/json; charset=utf-8"
+
+// meteringTimeFormat is the timestamp layout for metering payloads: RFC 3339 with
+// fixed millisecond precision, so events within the same second stay ordered
+const meteringTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// meteringContextTimeout is the default bound on the total time spent sending one
+// metering event, including retries
+const meteringContextTimeout = 30 * time.Second
+
+// The global client is published through an atomic pointer so GetClient never blocks
+// and never observes a client that Reset has started closing. globalMu only
+// serializes Initialize and Reset against each other
 var (
-	globalClient *ReveniumAnthropic
-	globalMu     sync.RWMutex
-	initialized  bool
+	globalClient atomic.Pointer[ReveniumAnthropic]
+	globalMu     sync.Mutex
 )
 
 // Initialize sets up the global Revenium middleware with configuration
@@ -36,7 +69,7 @@ func Initialize(opts ...Option) error {
 	globalMu.Lock()
 	defer globalMu.Unlock()
 
-	if initialized {
+	if globalClient.Load() != nil {
 		return nil
 	}
 
@@ -44,59 +77,64 @@ func Initialize(opts ...Option) error {
 	InitializeLogger()
 	Info("Initializing Revenium middleware...")
 
+	// Environment values first, so explicit options override them
 	cfg := &Config{}
+	if err := cfg.loadFromEnv(); err != nil {
+		Warn("Failed to load configuration from environment: %v", err)
+	}
 	for _, opt := range opts {
 		opt(cfg)
 	}
-	// Load from environment if not provided
-	if err := cfg.loadFromEnv(); err != nil {
-		Warn("Failed to load configuration from environment: %v", err)
+
+	client, err := newClient(cfg)
+	if err != nil {
+		return err
 	}
 
-	// Validate required fields
-	if cfg.ReveniumAPIKey == "" {
-		return NewConfigError("REVENIUM_METERING_API_KEY is required", nil)
+	// Apply the configured kill switch for the process-wide client
+	if cfg.MeteringEnabled != nil {
+		SetMeteringEnabled(*cfg.MeteringEnabled)
+	}
+
+	globalClient.Store(client)
+	Info("Revenium middleware initialized successfully")
+	return nil
+}
+
+// newAnthropicClient returns the injected Anthropic client if one was configured,
+// otherwise it builds a new client from the configured API key
+func newAnthropicClient(cfg *Config) anthropic.Client {
+	if cfg.AnthropicClient != nil {
+		// Used verbatim; the AnthropicVersion header is applied per request instead
+		Debug("Using injected Anthropic client")
+		return *cfg.AnthropicClient
 	}
 
-	// Create Anthropic client
 	clientOpts := []option.RequestOption{}
 	if cfg.AnthropicAPIKey != "" {
 		clientOpts = append(clientOpts, option.WithAPIKey(cfg.AnthropicAPIKey))
 	}
-
-	anthropicClient := anthropic.NewClient(clientOpts...)
-
-	// Detect provider
-	provider := DetectProvider(cfg)
-
-	globalClient = &ReveniumAnthropic{
-		client:   anthropicClient,
-		config:   cfg,
-		provider: provider,
+	if cfg.AnthropicVersion != "" {
+		Debug("Pinning anthropic-version header to %s", cfg.AnthropicVersion)
+		clientOpts = append(clientOpts, option.WithHeader("anthropic-version", cfg.AnthropicVersion))
 	}
 
-	initialized = true
-	Info("Revenium middleware initialized successfully")
-	return nil
+	return anthropic.NewClient(clientOpts...)
 }
 
 // IsInitialized checks if the middleware is properly initialized
 func IsInitialized() bool {
-	globalMu.RLock()
-	defer globalMu.RUnlock()
-	return initialized
+	return globalClient.Load() != nil
 }
 
 // GetClient returns the global Revenium client
 func GetClient() (*ReveniumAnthropic, error) {
-	globalMu.RLock()
-	defer globalMu.RUnlock()
-
-	if !initialized {
+	client := globalClient.Load()
+	if client == nil {
 		return nil, NewConfigError("middleware not initialized, call Initialize() first", nil)
 	}
 
-	return globalClient, nil
+	return client, nil
 }
 
 // NewReveniumAnthropic creates a new Revenium client with explicit configuration
@@ -105,27 +143,53 @@ func NewReveniumAnthropic(cfg *Config) (*ReveniumAnthropic, error) {
 		return nil, NewConfigError("config cannot be nil", nil)
 	}
 
+	return newClient(cfg)
+}
+
+// newClient validates cfg and builds a client from it. Initialize and
+// NewReveniumAnthropic share it so every option is wired the same way in both
+func newClient(cfg *Config) (*ReveniumAnthropic, error) {
 	// Validate required fields
 	if cfg.ReveniumAPIKey == "" {
 		return nil, NewConfigError("REVENIUM_METERING_API_KEY is required", nil)
 	}
 
-	// Create Anthropic client
-	clientOpts := []option.RequestOption{}
-	if cfg.AnthropicAPIKey != "" {
-		clientOpts = append(clientOpts, option.WithAPIKey(cfg.AnthropicAPIKey))
+	// Optionally verify the configuration before accepting requests
+	if cfg.StartupSelfTest {
+		if err := RunStartupSelfTest(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	// Detect runtime metadata up front so the IMDS lookup never lands on a request path
+	if cfg.AutoDetectEnvironment {
+		detectRuntimeMetadata()
+	}
+
+	// Hash the configuration once rather than on every event
+	if cfg.ConfigFingerprint {
+		cfg.fingerprint = configFingerprint(cfg)
 	}
 
-	anthropicClient := anthropic.NewClient(clientOpts...)
+	// Create Anthropic client
+	anthropicClient := newAnthropicClient(cfg)
 
 	// Detect provider
 	provider := DetectProvider(cfg)
 
-	return &ReveniumAnthropic{
+	client := &ReveniumAnthropic{
 		client:   anthropicClient,
 		config:   cfg,
 		provider: provider,
-	}, nil
+		history:  newPayloadHistory(cfg.PayloadHistorySize),
+		subs:     newSubscriberAggregator(cfg.SubscriberAggregation),
+		mock:     newMockResponder(cfg.MockResponses),
+		dedup:    newRequestDedup(cfg.RequestDedupWindow),
+		workers:  newMeteringWorkers(cfg.MeteringWorkers),
+	}
+	client.beat = startHeartbeat(client, cfg.HeartbeatInterval)
+
+	return client, nil
 }
 
 // GetConfig returns the configuration
@@ -159,19 +223,66 @@ func (r *ReveniumAnthropic) Messages() *MessagesInterface {
 		config:   r.config,
 		provider: r.provider,
 		wg:       &r.wg,
+		counters: &r.counters,
+		history:  r.history,
+		subs:     r.subs,
+		mock:     r.mock,
+		dedup:    r.dedup,
+		workers:  r.workers,
 	}
 }
 
+// MeteringStats returns a snapshot of the client's metering counters
+func (r *ReveniumAnthropic) MeteringStats() MeteringStats {
+	return r.counters.snapshot()
+}
+
+// LatencyStats returns p50/p95/p99 request durations over the client's recent
+// requests (streams are measured from creation to Close)
+func (r *ReveniumAnthropic) LatencyStats() LatencyQuantiles {
+	return r.counters.requestQuantiles()
+}
+
+// RecentPayloads returns copies of the most recently built metering payloads, oldest
+// first. It returns nil unless payload history was enabled with WithPayloadHistory
+func (r *ReveniumAnthropic) RecentPayloads() []map[string]interface{} {
+	return r.history.recent()
+}
+
+// SubscriberStats returns locally aggregated request and token counts keyed by
+// subscriber ID. It returns nil unless enabled with WithSubscriberAggregation
+func (r *ReveniumAnthropic) SubscriberStats() map[string]SubscriberUsage {
+	return r.subs.snapshot()
+}
+
 // Flush waits for all in-flight metering goroutines to complete.
 // Call this before shutdown to ensure all metering data is sent.
 func (r *ReveniumAnthropic) Flush() {
 	r.wg.Wait()
 }
 
+// FlushWithTimeout waits for in-flight metering goroutines like Flush, but gives up
+// after timeout and returns a MeteringError if events are still pending
+func (r *ReveniumAnthropic) FlushWithTimeout(timeout time.Duration) error {
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return NewMeteringError("timed out flushing metering", fmt.Errorf("pending metering after %v", timeout))
+	}
+}
+
 // Close closes the client and cleans up resources.
 // It waits for all in-flight metering goroutines to complete before returning.
 func (r *ReveniumAnthropic) Close() error {
-	r.Flush() // Wait for all metering goroutines to complete
+	r.beat.close() // Stop the heartbeat, if any, before waiting on metering
+	r.Flush()      // Wait for all metering goroutines to complete
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -184,22 +295,105 @@ type MessagesInterface struct {
 	client   anthropic.Client
 	config   *Config
 	provider Provider
-	wg       *sync.WaitGroup // Shared WaitGroup from ReveniumAnthropic
+	wg       *sync.WaitGroup   // Shared WaitGroup from ReveniumAnthropic
+	counters *meteringCounters // Shared metering counters from ReveniumAnthropic
+	history  *payloadHistory   // Shared payload history from ReveniumAnthropic
+	subs     *subscriberAggregator
+	mock     *mockResponder // Canned responses for ProviderMock
+	dedup    *requestDedup  // Shared duplicate request guard from ReveniumAnthropic
+	workers  chan struct{}  // Shared metering send slots from ReveniumAnthropic
+}
+
+// TokenCounts holds normalized token counts for a completed request
+type TokenCounts struct {
+	Input         int64
+	Output        int64
+	Total         int64
+	CacheCreation int64
+	CacheRead     int64
+	Reasoning     int64 // Always 0 for Anthropic models (no separate reasoning count)
+}
+
+// MessageResult wraps a message response with the details the middleware computed for it
+type MessageResult struct {
+	// Message is the response returned by the provider
+	Message *anthropic.Message
+	// Provider is the provider that served the request (e.g., "Anthropic", "Amazon Bedrock")
+	Provider string
+	// FallbackOccurred indicates the request fell back from Bedrock to Anthropic
+	FallbackOccurred bool
+	// Duration is the total request duration
+	Duration time.Duration
+	// Model is the resolved model that served the request
+	Model string
+	// TransactionID is the transactionId reported to Revenium
+	TransactionID string
+	// Tokens contains the normalized token counts, including cache tokens
+	Tokens TokenCounts
+}
+
+// newMessageResult builds a MessageResult from a provider response
+func newMessageResult(cfg *Config, resp *anthropic.Message, provider string, duration time.Duration, transactionID string) *MessageResult {
+	return &MessageResult{
+		Message:       resp,
+		Provider:      resolveProviderName(cfg, provider),
+		Duration:      duration,
+		Model:         string(resp.Model),
+		TransactionID: transactionID,
+		Tokens: TokenCounts{
+			Input:         resp.Usage.InputTokens,
+			Output:        resp.Usage.OutputTokens,
+			Total:         resp.Usage.InputTokens + resp.Usage.OutputTokens,
+			CacheCreation: resp.Usage.CacheCreationInputTokens,
+			CacheRead:     resp.Usage.CacheReadInputTokens,
+		},
+	}
 }
 
 // CreateMessage creates a message with automatic metering
 func (m *MessagesInterface) CreateMessage(ctx context.Context, params anthropic.MessageNewParams) (*anthropic.Message, error) {
+	result, err := m.createMessage(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return result.Message, nil
+}
+
+// CreateMessageDetailed creates a message with automatic metering and returns the
+// response together with the provider, timing, transaction ID and token counts
+func (m *MessagesInterface) CreateMessageDetailed(ctx context.Context, params anthropic.MessageNewParams) (*MessageResult, error) {
+	return m.createMessage(ctx, params)
+}
+
+// createMessage routes a non-streaming request to the configured provider
+func (m *MessagesInterface) createMessage(ctx context.Context, params anthropic.MessageNewParams) (*MessageResult, error) {
 	// Extract metadata from context
-	metadata := GetUsageMetadata(ctx)
+	metadata := m.requestMetadata(ctx)
+
+	// Resolve model aliases before provider conversion and metering, keeping the
+	// requested model for reconciliation against the served one
+	metadata = MergeMetadata(metadata, map[string]interface{}{"requestedModel": string(params.Model)})
+	params.Model = m.resolveModelAlias(params.Model)
+
+	// Reject requests exceeding configured limits before calling the provider
+	if err := m.checkRequestLimits(params); err != nil {
+		return nil, err
+	}
+
+	// Fingerprint the request once, flagging (but never blocking) replays
+	metadata = m.fingerprintRequest(params, metadata)
 
-	// Call the appropriate provider
-	switch m.provider {
+	// Call the appropriate provider, honoring a per-request override
+	provider := m.requestProvider(ctx)
+	switch provider {
 	case ProviderAnthropic:
 		return m.createMessageAnthropic(ctx, params, metadata)
 	case ProviderBedrock:
 		return m.createMessageBedrock(ctx, params, metadata)
+	case ProviderMock:
+		return m.createMessageMock(ctx, params, metadata)
 	default:
-		return nil, NewProviderError("unknown provider: %v", fmt.Errorf("provider: %v", m.provider))
+		return nil, NewProviderError("unknown provider: %v", fmt.Errorf("provider: %v", provider))
 	}
 }
 
@@ -207,28 +401,207 @@ func (m *MessagesInterface) CreateMessage(ctx context.Context, params anthropic.
 // Returns a stream that can be iterated over to get events
 func (m *MessagesInterface) CreateMessageStream(ctx context.Context, params anthropic.MessageNewParams) (interface{}, error) {
 	// Extract metadata from context
-	metadata := GetUsageMetadata(ctx)
+	metadata := m.requestMetadata(ctx)
+
+	// Resolve model aliases before provider conversion and metering, keeping the
+	// requested model for reconciliation against the served one
+	metadata = MergeMetadata(metadata, map[string]interface{}{"requestedModel": string(params.Model)})
+	params.Model = m.resolveModelAlias(params.Model)
+
+	// Reject requests exceeding configured limits before calling the provider
+	if err := m.checkRequestLimits(params); err != nil {
+		return nil, err
+	}
+
+	// Fingerprint the request once, flagging (but never blocking) replays
+	metadata = m.fingerprintRequest(params, metadata)
+
+	// Assign the transactionId up front so the stream summary and meter event share it
+	metadata, _ = ensureTransactionID(m.config, metadata)
 
-	// Call the appropriate provider
-	switch m.provider {
+	// Call the appropriate provider, honoring a per-request override
+	provider := m.requestProvider(ctx)
+	switch provider {
 	case ProviderAnthropic:
 		return m.createMessageStreamAnthropic(ctx, params, metadata)
 	case ProviderBedrock:
 		return m.createMessageStreamBedrock(ctx, params, metadata)
+	case ProviderMock:
+		return nil, NewProviderError("streaming is not supported by the mock provider", nil)
 	default:
-		return nil, NewProviderError("unknown provider: %v", fmt.Errorf("provider: %v", m.provider))
+		return nil, NewProviderError("unknown provider: %v", fmt.Errorf("provider: %v", provider))
+	}
+}
+
+// requestProvider returns the provider for a request: the WithProviderOverride value
+// when set, otherwise the client's detected provider
+func (m *MessagesInterface) requestProvider(ctx context.Context) Provider {
+	if provider, ok := GetProviderOverride(ctx); ok {
+		Debug("Routing request to %s via provider override", provider)
+		return provider
+	}
+	return m.provider
+}
+
+// fingerprintRequest computes the request's input fingerprint and serialized size once,
+// carrying them in metadata so the meter event reuses them. It also marks metadata
+// when the same request was already issued within the WithRequestDedup window; the
+// request is never blocked
+func (m *MessagesInterface) fingerprintRequest(params anthropic.MessageNewParams, metadata map[string]interface{}) map[string]interface{} {
+	fingerprint, size, err := requestFingerprint(params)
+	if err != nil {
+		Debug("Failed to compute input fingerprint: %v", err)
+		return metadata
+	}
+	shape := map[string]interface{}{
+		"inputFingerprint": fingerprint,
+		"requestSizeBytes": size,
+	}
+	if m.dedup != nil && m.dedup.isDuplicate(fingerprint) {
+		Debug("Duplicate request detected (fingerprint %s)", fingerprint)
+		shape["duplicateRequest"] = true
+	}
+	return MergeMetadata(metadata, shape)
+}
+
+// checkRequestLimits enforces configured per-request guards: the image cap and the
+// estimated input token cap
+func (m *MessagesInterface) checkRequestLimits(params anthropic.MessageNewParams) error {
+	if m.config == nil {
+		return nil
+	}
+	if m.config.MaxImagesPerRequest > 0 {
+		if vision := DetectVisionContent(params); vision.ImageCount > m.config.MaxImagesPerRequest {
+			return NewValidationError(fmt.Sprintf("request contains %d images, exceeding the limit of %d", vision.ImageCount, m.config.MaxImagesPerRequest), nil)
+		}
+	}
+	if m.config.MaxInputTokens > 0 {
+		if estimate := estimateRequestInputTokens(params); estimate > m.config.MaxInputTokens {
+			return NewValidationError(fmt.Sprintf("request has an estimated %d input tokens, exceeding the limit of %d", estimate, m.config.MaxInputTokens), nil)
+		}
+	}
+	return nil
+}
+
+// resolveModelAlias maps a configured alias (e.g. "fast") to the real Anthropic model
+// Models without an alias are returned unchanged
+func (m *MessagesInterface) resolveModelAlias(model anthropic.Model) anthropic.Model {
+	if m.config == nil || len(m.config.ModelAliases) == 0 {
+		return model
+	}
+	if resolved, ok := m.config.ModelAliases[string(model)]; ok && resolved != "" {
+		Debug("Resolved model alias %s to %s", model, resolved)
+		return anthropic.Model(resolved)
+	}
+	return model
+}
+
+// extractResponseContent captures the response for prompt capture, either flattened to
+// text (default) or as structured JSON blocks when WithStructuredResponseCapture is set
+func (m *MessagesInterface) extractResponseContent(resp *anthropic.Message, promptsTruncated bool) PromptData {
+	strategy := truncationStrategy(m.config)
+	if m.config != nil && m.config.StructuredResponseCapture {
+		return extractStructuredResponseContent(resp, promptsTruncated, strategy)
+	}
+	return extractResponseContent(resp, promptsTruncated, strategy)
+}
+
+// truncationStrategy returns the configured prompt truncation strategy
+func truncationStrategy(cfg *Config) string {
+	if cfg == nil || cfg.TruncationStrategy == "" {
+		return TruncationStrategyHead
+	}
+	return cfg.TruncationStrategy
+}
+
+// selectBaggage returns the baggage members whose keys are listed in keys
+func selectBaggage(baggage map[string]string, keys []string) map[string]string {
+	selected := make(map[string]string)
+	for _, key := range keys {
+		if value, ok := baggage[key]; ok && value != "" {
+			selected[key] = value
+		}
+	}
+	return selected
+}
+
+// anthropicRequestOptions returns the per-request options for an Anthropic call:
+// the retry counter, the pinned anthropic-version header (which also applies to an
+// injected client) and, when set, the X-Request-Id header from WithRequestID
+func anthropicRequestOptions(ctx context.Context, cfg *Config, retries *retryCounter) []option.RequestOption {
+	opts := []option.RequestOption{retries.option()}
+	if cfg != nil && cfg.AnthropicVersion != "" {
+		opts = append(opts, option.WithHeader("anthropic-version", cfg.AnthropicVersion))
+	}
+	if requestID := GetRequestID(ctx); requestID != "" {
+		opts = append(opts, option.WithHeader(RequestIDHeader, requestID))
+	}
+	return opts
+}
+
+// requestMetadata returns the metering metadata for a request, combining the usage
+// metadata stored in ctx with values derived from the context by configured extractors
+func (m *MessagesInterface) requestMetadata(ctx context.Context) map[string]interface{} {
+	metadata := GetUsageMetadata(ctx)
+
+	// Layer metadata from the application's own context key beneath WithUsageMetadata
+	if m.config != nil && m.config.ContextMetadataKey != nil {
+		if external := GetUsageMetadataFromKey(ctx, m.config.ContextMetadataKey); len(external) > 0 {
+			metadata = MergeMetadata(external, metadata)
+		}
+	}
+	metadata = NormalizeMetadataKeys(metadata)
+
+	// A request ID from WithRequestID doubles as the transactionId
+	if requestID := GetRequestID(ctx); requestID != "" {
+		if existing, ok := metadata["transactionId"]; ok && existing != requestID {
+			Debug("Request ID %s overrides metadata transactionId %v", requestID, existing)
+		}
+		metadata = MergeMetadata(metadata, map[string]interface{}{"transactionId": requestID})
+	}
+
+	// A request source from WithRequestSource fills in source unless metadata sets it
+	if source := GetRequestSource(ctx); source != "" {
+		if _, ok := metadata["source"]; !ok {
+			metadata = MergeMetadata(metadata, map[string]interface{}{"source": source})
+		}
+	}
+
+	if m.config == nil {
+		return metadata
+	}
+
+	// Forward selected OpenTelemetry baggage members as meter event attributes
+	if len(m.config.BaggageKeys) > 0 && m.config.BaggageReader != nil {
+		if baggage := selectBaggage(m.config.BaggageReader(ctx), m.config.BaggageKeys); len(baggage) > 0 {
+			metadata = MergeMetadata(metadata, map[string]interface{}{"baggage": baggage})
+		}
+	}
+
+	// Link the meter event to the application's correlation ID unless traceId is set
+	if m.config.CorrelationIDExtractor != nil {
+		if _, ok := metadata["traceId"]; !ok {
+			if correlationID := m.config.CorrelationIDExtractor(ctx); correlationID != "" {
+				metadata = MergeMetadata(metadata, map[string]interface{}{"traceId": correlationID})
+			}
+		}
 	}
+
+	return metadata
 }
 
 // createMessageAnthropic creates a message using Anthropic native API
-func (m *MessagesInterface) createMessageAnthropic(ctx context.Context, params anthropic.MessageNewParams, metadata map[string]interface{}) (*anthropic.Message, error) {
+func (m *MessagesInterface) createMessageAnthropic(ctx context.Context, params anthropic.MessageNewParams, metadata map[string]interface{}) (*MessageResult, error) {
 	// Record start time for duration calculation
 	startTime := time.Now()
 
+	// Assign the transactionId up front so it can be returned to the caller
+	metadata, transactionID := ensureTransactionID(m.config, metadata)
+
 	// Extract prompts if capture is enabled
 	var promptData *PromptData
 	if m.config.CapturePrompts {
-		data := ExtractPromptsFromParams(params)
+		data := extractPromptsFromParams(params, truncationStrategy(m.config))
 		promptData = &data
 	}
 
@@ -244,9 +617,15 @@ func (m *MessagesInterface) createMessageAnthropic(ctx context.Context, params a
 		params.Model = anthropic.Model(convertedModel)
 	}
 
-	// Call Anthropic API
-	resp, err := m.client.Messages.New(ctx, params)
+	// Call Anthropic API, counting SDK-level retries (e.g., 529 overloaded)
+	retries := &retryCounter{}
+	resp, err := m.client.Messages.New(ctx, params, anthropicRequestOptions(ctx, m.config, retries)...)
+	metadata = withRetryNumber(metadata, retries.retries())
+	if orgID := retries.organizationID(); orgID != "" {
+		metadata = MergeMetadata(metadata, map[string]interface{}{"anthropicOrganizationId": orgID})
+	}
 	if err != nil {
+		m.meterFailedRequest(ctx, err, metadata, false, "Anthropic", startTime, &params)
 		return nil, err
 	}
 
@@ -255,34 +634,38 @@ func (m *MessagesInterface) createMessageAnthropic(ctx context.Context, params a
 
 	// Extract response content if prompt capture is enabled
 	if promptData != nil && m.config.CapturePrompts {
-		responseData := ExtractResponseContent(resp, promptData.PromptsTruncated)
+		responseData := m.extractResponseContent(resp, promptData.PromptsTruncated)
 		promptData.OutputResponse = responseData.OutputResponse
 		promptData.PromptsTruncated = responseData.PromptsTruncated
+		promptData.OutputResponseTruncated = responseData.OutputResponseTruncated
+		promptData.ResponseID = responseData.ResponseID
+		promptData.ResponseModel = responseData.ResponseModel
+		promptData.ResponseRole = responseData.ResponseRole
+		promptData.ToolCalls = responseData.ToolCalls
 	}
 
 	// Send metering data asynchronously (fire-and-forget) with WaitGroup tracking
-	if m.wg != nil {
-		m.wg.Add(1)
-		go func() {
-			defer m.wg.Done()
-			m.sendMeteringDataWithPrompts(ctx, resp, metadata, false, duration, "Anthropic", startTime, &params, promptData)
-		}()
-	} else {
-		go m.sendMeteringDataWithPrompts(ctx, resp, metadata, false, duration, "Anthropic", startTime, &params, promptData)
-	}
+	m.goMetering(string(params.Model), func() {
+		m.sendMeteringDataWithPrompts(ctx, resp, metadata, false, duration, "Anthropic", startTime, &params, promptData)
+	})
 
-	return resp, nil
+	m.counters.recordRequest(duration)
+
+	return newMessageResult(m.config, resp, "Anthropic", duration, transactionID), nil
 }
 
 // createMessageBedrock creates a message using AWS Bedrock with fallback to Anthropic
-func (m *MessagesInterface) createMessageBedrock(ctx context.Context, params anthropic.MessageNewParams, metadata map[string]interface{}) (*anthropic.Message, error) {
+func (m *MessagesInterface) createMessageBedrock(ctx context.Context, params anthropic.MessageNewParams, metadata map[string]interface{}) (*MessageResult, error) {
 	// Record start time for duration calculation
 	startTime := time.Now()
 
+	// Assign the transactionId up front so it is shared with a possible fallback
+	metadata, transactionID := ensureTransactionID(m.config, metadata)
+
 	// Extract prompts if capture is enabled
 	var promptData *PromptData
 	if m.config.CapturePrompts {
-		data := ExtractPromptsFromParams(params)
+		data := extractPromptsFromParams(params, truncationStrategy(m.config))
 		promptData = &data
 	}
 
@@ -298,15 +681,18 @@ func (m *MessagesInterface) createMessageBedrock(ctx context.Context, params ant
 		}
 		fallbackParams.Model = anthropic.Model(convertedModel)
 		Info("Converted Bedrock model '%s' to Anthropic model '%s' for fallback", params.Model, fallbackParams.Model)
-		return m.createMessageAnthropic(ctx, fallbackParams, metadata)
+		return m.fallbackToAnthropic(ctx, fallbackParams, metadata, err)
 	}
 
 	// Try Bedrock with retry logic
 	retryConfig := DefaultRetryConfig()
+	retryConfig.Jitter = !m.config.DisableBackoffJitter
 	var resp *anthropic.Message
+	attempts := 0
 
 	err = RetryWithBackoff(ctx, retryConfig, func() error {
 		var bedrockErr error
+		attempts++
 		resp, bedrockErr = bedrockAdapter.CreateMessage(ctx, params)
 		return bedrockErr
 	})
@@ -321,31 +707,56 @@ func (m *MessagesInterface) createMessageBedrock(ctx context.Context, params ant
 		}
 		fallbackParams.Model = anthropic.Model(convertedModel)
 		Info("Converted Bedrock model '%s' to Anthropic model '%s' for fallback", params.Model, fallbackParams.Model)
-		return m.createMessageAnthropic(ctx, fallbackParams, metadata)
+		return m.fallbackToAnthropic(ctx, fallbackParams, metadata, err)
 	}
 
 	// Calculate duration
 	duration := time.Since(startTime)
 
+	// Record Bedrock retries performed by the middleware
+	metadata = withRetryNumber(metadata, attempts-1)
+
 	// Extract response content if prompt capture is enabled
 	if promptData != nil && m.config.CapturePrompts {
-		responseData := ExtractResponseContent(resp, promptData.PromptsTruncated)
+		responseData := m.extractResponseContent(resp, promptData.PromptsTruncated)
 		promptData.OutputResponse = responseData.OutputResponse
 		promptData.PromptsTruncated = responseData.PromptsTruncated
+		promptData.OutputResponseTruncated = responseData.OutputResponseTruncated
+		promptData.ResponseID = responseData.ResponseID
+		promptData.ResponseModel = responseData.ResponseModel
+		promptData.ResponseRole = responseData.ResponseRole
+		promptData.ToolCalls = responseData.ToolCalls
 	}
 
 	// Send metering data asynchronously (fire-and-forget) with WaitGroup tracking
-	if m.wg != nil {
-		m.wg.Add(1)
-		go func() {
-			defer m.wg.Done()
-			m.sendMeteringDataWithPrompts(ctx, resp, metadata, false, duration, "AWS", startTime, &params, promptData)
-		}()
-	} else {
-		go m.sendMeteringDataWithPrompts(ctx, resp, metadata, false, duration, "AWS", startTime, &params, promptData)
-	}
+	m.goMetering(string(params.Model), func() {
+		m.sendMeteringDataWithPrompts(ctx, resp, metadata, false, duration, "AWS", startTime, &params, promptData)
+	})
+
+	m.counters.recordRequest(duration)
+
+	return newMessageResult(m.config, resp, "AWS", duration, transactionID), nil
+}
 
-	return resp, nil
+// fallbackToAnthropic retries a failed Bedrock request against the Anthropic API.
+// If the fallback fails too, the returned error joins both failures, and the Bedrock
+// error is carried into the error meter event (when WithMeterErrors is on)
+func (m *MessagesInterface) fallbackToAnthropic(ctx context.Context, params anthropic.MessageNewParams, metadata map[string]interface{}, bedrockErr error) (*MessageResult, error) {
+	if bedrockErr != nil {
+		metadata = MergeMetadata(metadata, map[string]interface{}{"bedrockError": bedrockErr.Error()})
+	}
+	result, err := m.createMessageAnthropic(ctx, params, metadata)
+	if err != nil {
+		if bedrockErr == nil {
+			return nil, err
+		}
+		return nil, errors.Join(
+			fmt.Errorf("bedrock request failed: %w", bedrockErr),
+			fmt.Errorf("anthropic fallback failed: %w", err),
+		)
+	}
+	result.FallbackOccurred = true
+	return result, nil
 }
 
 // createMessageStreamAnthropic creates a streaming message using Anthropic native API
@@ -353,7 +764,7 @@ func (m *MessagesInterface) createMessageStreamAnthropic(ctx context.Context, pa
 	// Extract prompts if capture is enabled
 	var promptData *PromptData
 	if m.config.CapturePrompts {
-		data := ExtractPromptsFromParams(params)
+		data := extractPromptsFromParams(params, truncationStrategy(m.config))
 		promptData = &data
 	}
 
@@ -369,8 +780,9 @@ func (m *MessagesInterface) createMessageStreamAnthropic(ctx context.Context, pa
 		params.Model = anthropic.Model(convertedModel)
 	}
 
-	// Call Anthropic streaming API
-	stream := m.client.Messages.NewStreaming(ctx, params)
+	// Call Anthropic streaming API, counting SDK-level connection retries
+	retries := &retryCounter{}
+	stream := m.client.Messages.NewStreaming(ctx, params, anthropicRequestOptions(ctx, m.config, retries)...)
 
 	// Prepare metadata with model information
 	streamMetadata := make(map[string]interface{})
@@ -389,6 +801,7 @@ func (m *MessagesInterface) createMessageStreamAnthropic(ctx context.Context, pa
 	// Wrap stream for metering tracking
 	wrapper := &StreamingWrapper{
 		stream:      stream,
+		ctx:         ctx,
 		config:      m.config,
 		metadata:    streamMetadata,
 		startTime:   time.Now(),
@@ -397,12 +810,23 @@ func (m *MessagesInterface) createMessageStreamAnthropic(ctx context.Context, pa
 		provider:    "Anthropic",
 		params:      &params,
 		promptData:  promptData,
+		retries:     retries,
 	}
 
-	// Estimate input tokens (this is an approximation)
+	// Re-issue the request on transient mid-stream drops when enabled
+	if m.config.StreamAutoReconnectAttempts > 0 {
+		wrapper.maxReconnects = m.config.StreamAutoReconnectAttempts
+		wrapper.reopen = func() interface{} {
+			// Reconnections are reported separately, so they don't count toward retryNumber
+			return m.client.Messages.NewStreaming(ctx, params, anthropicRequestOptions(ctx, m.config, &retryCounter{})...)
+		}
+	}
+
+	// Estimate input tokens until real usage arrives (this is an approximation)
 	// In a real implementation, you might want to use a tokenizer
-	inputTokens := estimateInputTokens(params)
-	wrapper.SetInputTokens(inputTokens)
+	if !m.config.DisableInputTokenEstimate {
+		wrapper.setEstimatedInputTokens(estimateInputTokens(params))
+	}
 
 	return wrapper, nil
 }
@@ -412,7 +836,7 @@ func (m *MessagesInterface) createMessageStreamBedrock(ctx context.Context, para
 	// Extract prompts if capture is enabled
 	var promptData *PromptData
 	if m.config.CapturePrompts {
-		data := ExtractPromptsFromParams(params)
+		data := extractPromptsFromParams(params, truncationStrategy(m.config))
 		promptData = &data
 	}
 
@@ -433,6 +857,7 @@ func (m *MessagesInterface) createMessageStreamBedrock(ctx context.Context, para
 
 	// Try Bedrock streaming with retry logic
 	retryConfig := DefaultRetryConfig()
+	retryConfig.Jitter = !m.config.DisableBackoffJitter
 	var stream interface{}
 
 	err = RetryWithBackoff(ctx, retryConfig, func() error {
@@ -471,6 +896,7 @@ func (m *MessagesInterface) createMessageStreamBedrock(ctx context.Context, para
 	// Wrap Bedrock stream for metering tracking
 	wrapper := &StreamingWrapper{
 		stream:      stream,
+		ctx:         ctx,
 		config:      m.config,
 		metadata:    streamMetadata,
 		startTime:   time.Now(),
@@ -481,16 +907,18 @@ func (m *MessagesInterface) createMessageStreamBedrock(ctx context.Context, para
 		promptData:  promptData,
 	}
 
-	// Estimate input tokens for Bedrock
-	inputTokens := estimateInputTokens(params)
-	wrapper.SetInputTokens(inputTokens)
+	// Estimate input tokens for Bedrock until real usage arrives
+	if !m.config.DisableInputTokenEstimate {
+		wrapper.setEstimatedInputTokens(estimateInputTokens(params))
+	}
 
 	return wrapper, nil
 }
 
 // StreamingWrapper wraps a streaming response to capture metering data
 type StreamingWrapper struct {
-	stream         interface{} // *anthropic.MessageStream
+	stream         interface{}     // *anthropic.MessageStream
+	ctx            context.Context // Request context; its deadline caps synchronous metering
 	config         *Config
 	metadata       map[string]interface{}
 	startTime      time.Time
@@ -499,17 +927,49 @@ type StreamingWrapper struct {
 	messagesAPI    *MessagesInterface // Reference to MessagesInterface for metering
 
 	// Token counting for streaming
-	inputTokens  int
-	outputTokens int
-	totalTokens  int
-	model        string
-	provider     string                        // Provider name (Anthropic or AWS)
-	stopReason   string                        // Stop reason from streaming events
-	params       *anthropic.MessageNewParams   // Original request params for vision detection
+	inputTokens          int
+	inputTokensEstimated bool // True while inputTokens holds the synthetic estimate
+	startUsageSeen       bool // True once message_start reported input and cache usage
+	outputTokens         int
+	totalTokens          int
+	cacheCreationTokens  int
+	cacheReadTokens      int
+	model                string
+	provider             string                      // Provider name (Anthropic or AWS)
+	stopReason           string                      // Stop reason from streaming events
+	stopSequence         string                      // Custom stop sequence matched, if any
+	sawEvent             bool                        // True once any stream event has been consumed
+	completed            bool                        // True once message_stop has been received
+	params               *anthropic.MessageNewParams // Original request params for vision detection
 
 	// Prompt capture tracking
 	promptData         *PromptData
 	accumulatedContent string
+
+	// Citation tracking (citations_delta events)
+	citationCount int
+
+	// Characters of streamed text output
+	outputCharCount int
+
+	// Ensures the summary callback runs once even if Close is called again
+	summaryOnce sync.Once
+
+	// Ensures the stream duration is recorded once for LatencyStats
+	latencyOnce sync.Once
+
+	// Periodic checkpoints (WithStreamCheckpoint)
+	lastCheckpoint time.Time
+	checkpointOnce sync.Once
+
+	// SDK-level retry tracking (nil for Bedrock streams)
+	retries *retryCounter
+
+	// Automatic reconnection (WithStreamAutoReconnect, Anthropic streams only)
+	reopen        func() interface{} // Re-issues the original streaming request
+	maxReconnects int
+	reconnects    int
+	base          TokenCounts // Tokens accumulated by attempts dropped before the current one
 }
 
 // Next returns the next event from the stream
@@ -530,6 +990,9 @@ func (sw *StreamingWrapper) Next() bool {
 			if len(result) > 0 {
 				// Check if result is a bool
 				if b, ok := result[0].Interface().(bool); ok {
+					if !b && sw.reconnect() {
+						return sw.Next()
+					}
 					return b
 				}
 			}
@@ -539,6 +1002,96 @@ func (sw *StreamingWrapper) Next() bool {
 	return false
 }
 
+// reconnect re-issues the streaming request after a retryable mid-stream error, when
+// auto-reconnect is enabled and attempts remain. Tokens reported by the dropped
+// attempt are kept so metering reflects the total across all attempts; captured
+// content and character counts restart with the new attempt
+func (sw *StreamingWrapper) reconnect() bool {
+	if sw.reopen == nil {
+		return false
+	}
+
+	streamErr := sw.Err()
+	if !isRetryableStreamError(streamErr) {
+		return false
+	}
+
+	sw.mu.Lock()
+	if sw.reconnects >= sw.maxReconnects {
+		sw.mu.Unlock()
+		Warn("Stream dropped after %d reconnection(s), giving up: %v", sw.reconnects, streamErr)
+		return false
+	}
+	sw.reconnects++
+	sw.base = TokenCounts{
+		Input:         int64(sw.inputTokens),
+		Output:        int64(sw.outputTokens),
+		CacheCreation: int64(sw.cacheCreationTokens),
+		CacheRead:     int64(sw.cacheReadTokens),
+	}
+	sw.startUsageSeen = false
+	// The re-issued request streams its response from the beginning, so discard the
+	// partial output of the dropped attempt (token counts above are summed instead)
+	sw.accumulatedContent = ""
+	sw.outputCharCount = 0
+	sw.citationCount = 0
+	oldStream := sw.stream
+	attempt := sw.reconnects
+	sw.mu.Unlock()
+
+	Warn("Stream dropped (%v), reconnecting (attempt %d/%d)", streamErr, attempt, sw.maxReconnects)
+	if err := closeStream(oldStream); err != nil {
+		Debug("Failed to close dropped stream: %v", err)
+	}
+
+	newStream := sw.reopen()
+	sw.mu.Lock()
+	sw.stream = newStream
+	sw.mu.Unlock()
+	return true
+}
+
+// isRetryableStreamError reports whether a mid-stream error is transient: network
+// failures, truncated responses, rate limiting and server-side (5xx) errors.
+// Cancellation and deadline errors are never retried
+func isRetryableStreamError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *anthropic.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// closeStream calls Close on an underlying stream via reflection
+func closeStream(stream interface{}) error {
+	if stream == nil {
+		return nil
+	}
+	streamVal := reflect.ValueOf(stream)
+	if streamVal.Kind() == reflect.Ptr {
+		closeMethod := streamVal.MethodByName("Close")
+		if closeMethod.IsValid() {
+			result := closeMethod.Call(nil)
+			if len(result) > 0 {
+				if e, ok := result[0].Interface().(error); ok {
+					return e
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // Current returns the current event
 func (sw *StreamingWrapper) Current() interface{} {
 	if sw.stream == nil {
@@ -560,6 +1113,13 @@ func (sw *StreamingWrapper) Current() interface{} {
 				// Debug: log event type
 				Debug("Streaming event type: %T", event)
 
+				if event != nil {
+					sw.sawEvent = true
+				}
+				if isMessageStopEvent(event) {
+					sw.completed = true
+				}
+
 				// Check for content events to record first token time
 				if isContentEvent(event) {
 					if sw.firstTokenTime == nil {
@@ -567,20 +1127,50 @@ func (sw *StreamingWrapper) Current() interface{} {
 						sw.firstTokenTime = &now
 					}
 
-					// Accumulate content for prompt capture (if enabled)
-					if sw.promptData != nil {
-						if text := extractTextFromContentEvent(event); text != "" {
+					// Count output characters, and accumulate content for prompt capture (if enabled)
+					if text := extractTextFromContentEvent(event); text != "" {
+						sw.outputCharCount += utf8.RuneCountInString(text)
+						if sw.promptData != nil {
 							sw.accumulatedContent += text
 						}
 					}
 				}
 
+				// message_start carries the authoritative input and cache token counts,
+				// which are known up front; usage is per attempt, so add dropped attempts
+				if isMessageStartEvent(event) {
+					if usage := extractMessageStartUsage(event); usage != nil {
+						sw.inputTokens = int(sw.base.Input + usage.InputTokens)
+						sw.inputTokensEstimated = false
+						sw.cacheCreationTokens = int(sw.base.CacheCreation + usage.CacheCreationInputTokens)
+						sw.cacheReadTokens = int(sw.base.CacheRead + usage.CacheReadInputTokens)
+						sw.outputTokens = int(sw.base.Output + usage.OutputTokens)
+						sw.totalTokens = sw.inputTokens + sw.outputTokens
+						sw.startUsageSeen = true
+						Debug("Stream start usage extracted: input=%d, cacheCreation=%d, cacheRead=%d", sw.inputTokens, sw.cacheCreationTokens, sw.cacheReadTokens)
+					}
+				}
+
 				// Check for message_delta events that contain real usage data
 				if isMessageDeltaEvent(event) {
 					usage := extractUsageFromEvent(event)
 					if usage != nil {
-						sw.inputTokens = int(usage.InputTokens)
-						sw.outputTokens = int(usage.OutputTokens)
+						// Input and cache counts from message_start are authoritative; otherwise
+						// only replace them when the delta actually reports them
+						if !sw.startUsageSeen {
+							if usage.InputTokens > 0 {
+								sw.inputTokens = int(sw.base.Input + usage.InputTokens)
+								sw.inputTokensEstimated = false
+							}
+							if usage.CacheCreationInputTokens > 0 {
+								sw.cacheCreationTokens = int(sw.base.CacheCreation + usage.CacheCreationInputTokens)
+							}
+							if usage.CacheReadInputTokens > 0 {
+								sw.cacheReadTokens = int(sw.base.CacheRead + usage.CacheReadInputTokens)
+							}
+						}
+						// Output usage is cumulative per attempt, so add tokens from dropped attempts
+						sw.outputTokens = int(sw.base.Output + usage.OutputTokens)
 						sw.totalTokens = sw.inputTokens + sw.outputTokens
 						Debug("Real token usage extracted: input=%d, output=%d, total=%d", sw.inputTokens, sw.outputTokens, sw.totalTokens)
 					}
@@ -591,10 +1181,25 @@ func (sw *StreamingWrapper) Current() interface{} {
 						sw.stopReason = stopReason
 						Debug("Stop reason extracted from streaming: %s", stopReason)
 					}
+					if stopSequence := extractStopSequenceFromEvent(event); stopSequence != "" {
+						sw.stopSequence = stopSequence
+						Debug("Stop sequence extracted from streaming: %q", stopSequence)
+					}
+				}
+
+				// Count citations streamed as citations_delta events
+				if isCitationDeltaEvent(event) {
+					sw.citationCount++
 				}
 
+				checkpoint := sw.checkpointLocked(false)
 				sw.mu.Unlock()
 
+				// Hand interim progress to the crash-recovery store outside the lock
+				if checkpoint != nil {
+					sw.config.StreamCheckpointFunc(*checkpoint)
+				}
+
 				return event
 			}
 		}
@@ -629,9 +1234,38 @@ func (sw *StreamingWrapper) SetInputTokens(tokens int) {
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
 	sw.inputTokens = tokens
+	sw.inputTokensEstimated = false
+	sw.totalTokens = sw.inputTokens + sw.outputTokens
+}
+
+// setEstimatedInputTokens sets a synthetic input token estimate that is replaced
+// once the stream reports real usage
+func (sw *StreamingWrapper) setEstimatedInputTokens(tokens int) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.inputTokens = tokens
+	sw.inputTokensEstimated = true
 	sw.totalTokens = sw.inputTokens + sw.outputTokens
 }
 
+// requestContext returns the context the stream was requested with
+func (sw *StreamingWrapper) requestContext() context.Context {
+	if sw.ctx == nil {
+		return context.Background()
+	}
+	return sw.ctx
+}
+
+// requestedModel returns the resolved model the stream was requested with
+func (sw *StreamingWrapper) requestedModel() string {
+	if sw.params != nil && sw.params.Model != "" {
+		return string(sw.params.Model)
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.model
+}
+
 // SetModel sets the model name
 func (sw *StreamingWrapper) SetModel(model string) {
 	sw.mu.Lock()
@@ -646,27 +1280,29 @@ func (sw *StreamingWrapper) GetTokenCounts() (input, output, total int) {
 	return sw.inputTokens, sw.outputTokens, sw.totalTokens
 }
 
+// GetDetailedTokenCounts returns the current token counts including cache tokens
+// reported by message_delta usage, matching what the meter event will contain
+func (sw *StreamingWrapper) GetDetailedTokenCounts() TokenCounts {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return TokenCounts{
+		Input:         int64(sw.inputTokens),
+		Output:        int64(sw.outputTokens),
+		Total:         int64(sw.totalTokens),
+		CacheCreation: int64(sw.cacheCreationTokens),
+		CacheRead:     int64(sw.cacheReadTokens),
+	}
+}
+
 // Close closes the stream and sends metering data
 func (sw *StreamingWrapper) Close() error {
+	// Capture any mid-stream error before closing the underlying stream
+	streamErr := sw.Err()
+
 	sw.mu.Lock()
-	defer sw.mu.Unlock()
 
-	var err error
-	if sw.stream != nil {
-		// Call Close() method using reflection
-		streamVal := reflect.ValueOf(sw.stream)
-		if streamVal.Kind() == reflect.Ptr {
-			closeMethod := streamVal.MethodByName("Close")
-			if closeMethod.IsValid() {
-				result := closeMethod.Call(nil)
-				if len(result) > 0 {
-					if e, ok := result[0].Interface().(error); ok {
-						err = e
-					}
-				}
-			}
-		}
-	}
+	// Call Close() on the underlying stream using reflection
+	err := closeStream(sw.stream)
 
 	// Calculate metrics
 	duration := time.Since(sw.startTime)
@@ -675,6 +1311,9 @@ func (sw *StreamingWrapper) Close() error {
 		timeToFirstToken = sw.firstTokenTime.Sub(sw.startTime)
 	}
 
+	// Release the lock before metering, which may run inline with synchronous metering
+	sw.mu.Unlock()
+
 	// Send metering data asynchronously (fire-and-forget) with WaitGroup tracking
 	meteringFunc := func() {
 		defer func() {
@@ -686,21 +1325,32 @@ func (sw *StreamingWrapper) Close() error {
 		// Get actual token counts and stop reason from streaming
 		sw.mu.Lock()
 		inputTokens := sw.inputTokens
+		inputTokensEstimated := sw.inputTokensEstimated
+		citationCount := sw.citationCount
 		outputTokens := sw.outputTokens
 		totalTokens := sw.totalTokens
+		cacheCreationTokens := sw.cacheCreationTokens
+		cacheReadTokens := sw.cacheReadTokens
 		model := sw.model
 		provider := sw.provider
 		startTime := sw.startTime
 		streamStopReason := sw.stopReason
+		streamStopSequence := sw.stopSequence
+		abandoned := sw.sawEvent && !sw.completed
+		reconnects := sw.reconnects
+		outputCharCount := sw.outputCharCount
 		sw.mu.Unlock()
 
 		// Build metering payload for streaming using actual token counts
 		// Note: We need to use reflection to set StopReason since it's not exported
 		mockResp := &anthropic.Message{
-			Model: anthropic.Model(model),
+			Model:        anthropic.Model(model),
+			StopSequence: streamStopSequence,
 			Usage: anthropic.Usage{
-				InputTokens:  int64(inputTokens),
-				OutputTokens: int64(outputTokens),
+				InputTokens:              int64(inputTokens),
+				OutputTokens:             int64(outputTokens),
+				CacheCreationInputTokens: int64(cacheCreationTokens),
+				CacheReadInputTokens:     int64(cacheReadTokens),
 			},
 		}
 
@@ -717,14 +1367,14 @@ func (sw *StreamingWrapper) Close() error {
 		}
 
 		// Use the same payload builder as non-streaming
-		payload := buildMeteringPayload(mockResp, sw.metadata, true, duration, provider, startTime, sw.params)
+		payload := buildMeteringPayload(sw.config, mockResp, sw.metadata, true, duration, provider, startTime, sw.params)
 
 		// Override streaming-specific fields with actual timing data
 		payload["timeToFirstToken"] = timeToFirstToken.Milliseconds()
 
 		// Calculate correct completion start time for streaming (when first token arrived)
 		if sw.firstTokenTime != nil {
-			payload["completionStartTime"] = sw.firstTokenTime.Format(time.RFC3339)
+			payload["completionStartTime"] = sw.firstTokenTime.Format(meteringTimeFormat)
 		}
 
 		// Ensure token counts are correct (override with actual counts)
@@ -735,6 +1385,57 @@ func (sw *StreamingWrapper) Close() error {
 			payload["model"] = model
 		}
 
+		// Surface mid-stream failures, keeping the tokens counted before the failure.
+		// Streams abandoned before message_stop (client disconnect, cancelled context)
+		// are metered as CANCELLED with the partial tokens generated so far
+		switch {
+		case streamErr != nil && (errors.Is(streamErr, context.Canceled) || errors.Is(streamErr, context.DeadlineExceeded)):
+			payload["stopReason"] = "CANCELLED"
+			payload["errorReason"] = streamErr.Error()
+		case streamErr != nil:
+			payload["stopReason"] = "ERROR"
+			payload["errorReason"] = streamErr.Error()
+		case abandoned:
+			Debug("Stream closed before completion, metering partial usage as CANCELLED")
+			payload["stopReason"] = "CANCELLED"
+		}
+
+		// Record SDK-level retries made while opening the stream
+		if sw.retries != nil && sw.retries.retries() > 0 {
+			payload["retryNumber"] = sw.retries.retries()
+		}
+
+		// Correlate with the Anthropic organization that served the stream
+		if sw.retries != nil && sw.retries.organizationID() != "" {
+			setPayloadAttribute(payload, "anthropicOrganizationId", sw.retries.organizationID())
+		}
+
+		// Distinguish the synthetic estimate from authoritative counts
+		if inputTokensEstimated {
+			setPayloadAttribute(payload, "inputTokensEstimated", true)
+		}
+
+		if citationCount > 0 {
+			setPayloadAttribute(payload, "hasCitations", true)
+			setPayloadAttribute(payload, "citationCount", citationCount)
+		}
+
+		// Streaming throughput covers generation only, from the first token to the end
+		if tps, ok := outputTokensPerSecond(int64(outputTokens), duration-timeToFirstToken); ok {
+			setPayloadAttribute(payload, "outputTokensPerSecond", tps)
+		}
+
+		// Streamed responses have no content blocks, so use the counted text deltas
+		if outputCharCount > 0 {
+			setPayloadAttribute(payload, "outputCharCount", outputCharCount)
+		}
+
+		// Flag streams that were transparently re-issued after a drop
+		if reconnects > 0 {
+			setPayloadAttribute(payload, "reconnected", true)
+			setPayloadAttribute(payload, "reconnectCount", reconnects)
+		}
+
 		// Add prompt capture data if enabled
 		sw.mu.Lock()
 		promptData := sw.promptData
@@ -742,39 +1443,50 @@ func (sw *StreamingWrapper) Close() error {
 		sw.mu.Unlock()
 
 		if promptData != nil {
-			// Add input prompts
-			if promptData.SystemPrompt != "" {
-				payload["systemPrompt"] = promptData.SystemPrompt
-			}
-			if promptData.InputMessages != "" {
-				payload["inputMessages"] = promptData.InputMessages
-			}
-
-			// Extract streaming response content
-			responseData := ExtractStreamingResponseContent(accumulatedContent, promptData.PromptsTruncated)
-			if responseData.OutputResponse != "" {
-				payload["outputResponse"] = responseData.OutputResponse
-			}
-			if responseData.PromptsTruncated {
-				payload["promptsTruncated"] = true
-			}
+			// Combine input prompts with the streamed response content
+			responseData := extractStreamingResponseContent(accumulatedContent, promptData.PromptsTruncated, truncationStrategy(sw.config))
+			capturedData := *promptData
+			capturedData.OutputResponse = responseData.OutputResponse
+			capturedData.PromptsTruncated = responseData.PromptsTruncated
+			capturedData.OutputResponseTruncated = responseData.OutputResponseTruncated
+			AddPromptDataToPayload(payload, capturedData)
 		}
 
 		// Send to Revenium API with retry logic
 		if sw.messagesAPI != nil {
-			if err := sw.messagesAPI.sendMeteringWithRetry(payload); err != nil {
+			if err := sw.messagesAPI.sendMeteringWithRetry(sw.requestContext(), payload); err != nil {
 				Error("Failed to send streaming metering data: %v", err)
 			}
 		}
 	}
 
+	// Tell the crash-recovery store the stream was closed and metered normally
+	if sw.config != nil && sw.config.StreamCheckpointFunc != nil {
+		sw.checkpointOnce.Do(func() {
+			sw.mu.Lock()
+			checkpoint := sw.checkpointLocked(true)
+			sw.mu.Unlock()
+			sw.config.StreamCheckpointFunc(*checkpoint)
+		})
+	}
+
+	// Record the stream duration for the client's latency percentiles
+	if sw.messagesAPI != nil {
+		sw.latencyOnce.Do(func() {
+			sw.messagesAPI.counters.recordRequest(duration)
+		})
+	}
+
+	// Hand the application a final summary of the stream
+	if sw.config != nil && sw.config.StreamSummaryCallback != nil {
+		sw.summaryOnce.Do(func() {
+			sw.config.StreamSummaryCallback(sw.buildSummary(duration, timeToFirstToken, streamErr))
+		})
+	}
+
 	// Launch goroutine with WaitGroup tracking if available
-	if sw.messagesAPI != nil && sw.messagesAPI.wg != nil {
-		sw.messagesAPI.wg.Add(1)
-		go func() {
-			defer sw.messagesAPI.wg.Done()
-			meteringFunc()
-		}()
+	if sw.messagesAPI != nil {
+		sw.messagesAPI.goMetering(sw.requestedModel(), meteringFunc)
 	} else {
 		go meteringFunc()
 	}
@@ -782,6 +1494,72 @@ func (sw *StreamingWrapper) Close() error {
 	return err
 }
 
+// StreamSummary is the final breakdown of a stream, passed to the callback set with
+// WithStreamSummaryCallback when the stream is closed
+type StreamSummary struct {
+	TransactionID       string
+	Model               string
+	Provider            string
+	InputTokens         int64
+	OutputTokens        int64
+	TotalTokens         int64
+	CacheCreationTokens int64
+	CacheReadTokens     int64
+	Duration            time.Duration
+	TimeToFirstToken    time.Duration
+	// StopReason is the Revenium stop reason (END, TOKEN_LIMIT, ERROR, CANCELLED, ...)
+	StopReason string
+	// EstimatedCost is the USD cost from the WithModelPricing table (0 when not priced)
+	EstimatedCost float64
+	// Err is the mid-stream error, if the stream failed
+	Err error
+}
+
+// buildSummary computes the stream's final metrics
+func (sw *StreamingWrapper) buildSummary(duration, timeToFirstToken time.Duration, streamErr error) StreamSummary {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+
+	summary := StreamSummary{
+		Model:               sw.model,
+		Provider:            resolveProviderName(sw.config, sw.provider),
+		InputTokens:         int64(sw.inputTokens),
+		OutputTokens:        int64(sw.outputTokens),
+		TotalTokens:         int64(sw.totalTokens),
+		CacheCreationTokens: int64(sw.cacheCreationTokens),
+		CacheReadTokens:     int64(sw.cacheReadTokens),
+		Duration:            duration,
+		TimeToFirstToken:    timeToFirstToken,
+		StopReason:          "END",
+		Err:                 streamErr,
+	}
+	if transactionID, ok := sw.metadata["transactionId"].(string); ok {
+		summary.TransactionID = transactionID
+	}
+
+	switch {
+	case streamErr != nil && (errors.Is(streamErr, context.Canceled) || errors.Is(streamErr, context.DeadlineExceeded)):
+		summary.StopReason = "CANCELLED"
+	case streamErr != nil:
+		summary.StopReason = "ERROR"
+	case sw.sawEvent && !sw.completed:
+		summary.StopReason = "CANCELLED"
+	case sw.stopReason != "":
+		summary.StopReason = mapStopReasonToRevenium(sw.stopReason)
+	}
+
+	if pricing, ok := lookupModelPricing(sw.config, sw.provider, sw.model); ok {
+		summary.EstimatedCost = estimateCost(pricing, TokenCounts{
+			Input:         summary.InputTokens,
+			Output:        summary.OutputTokens,
+			CacheCreation: summary.CacheCreationTokens,
+			CacheRead:     summary.CacheReadTokens,
+		})
+	}
+
+	return summary
+}
+
 // isContentEvent checks if an event is a content event
 func isContentEvent(event interface{}) bool {
 	if event == nil {
@@ -883,6 +1661,74 @@ func isMessageDeltaEvent(event interface{}) bool {
 	return false
 }
 
+// isMessageStartEvent checks if an event is the message_start event carrying initial usage
+func isMessageStartEvent(event interface{}) bool {
+	if event == nil {
+		return false
+	}
+
+	eventValue := reflect.ValueOf(event)
+	if eventValue.Kind() == reflect.Ptr {
+		eventValue = eventValue.Elem()
+	}
+
+	typeField := eventValue.FieldByName("Type")
+	if typeField.IsValid() {
+		if typeStr, ok := typeField.Interface().(string); ok && typeStr == "message_start" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isMessageStopEvent checks if an event is the terminal message_stop event
+func isMessageStopEvent(event interface{}) bool {
+	if event == nil {
+		return false
+	}
+
+	eventValue := reflect.ValueOf(event)
+	if eventValue.Kind() == reflect.Ptr {
+		eventValue = eventValue.Elem()
+	}
+
+	typeField := eventValue.FieldByName("Type")
+	if typeField.IsValid() {
+		if typeStr, ok := typeField.Interface().(string); ok && typeStr == "message_stop" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCitationDeltaEvent checks if an event is a content_block_delta carrying a citation
+func isCitationDeltaEvent(event interface{}) bool {
+	if event == nil {
+		return false
+	}
+
+	eventValue := reflect.ValueOf(event)
+	if eventValue.Kind() == reflect.Ptr {
+		eventValue = eventValue.Elem()
+	}
+
+	deltaField := eventValue.FieldByName("Delta")
+	if !deltaField.IsValid() || deltaField.IsZero() {
+		return false
+	}
+
+	typeField := deltaField.FieldByName("Type")
+	if typeField.IsValid() {
+		if deltaType, ok := typeField.Interface().(string); ok && deltaType == "citations_delta" {
+			return true
+		}
+	}
+
+	return false
+}
+
 // extractUsageFromEvent extracts usage data from a message_delta event
 func extractUsageFromEvent(event interface{}) *anthropic.MessageDeltaUsage {
 	if event == nil {
@@ -906,6 +1752,27 @@ func extractUsageFromEvent(event interface{}) *anthropic.MessageDeltaUsage {
 	return nil
 }
 
+// extractMessageStartUsage extracts the initial usage from a message_start event's message
+func extractMessageStartUsage(event interface{}) *anthropic.Usage {
+	if event == nil {
+		return nil
+	}
+
+	eventValue := reflect.ValueOf(event)
+	if eventValue.Kind() == reflect.Ptr {
+		eventValue = eventValue.Elem()
+	}
+
+	messageField := eventValue.FieldByName("Message")
+	if messageField.IsValid() && !messageField.IsZero() {
+		if message, ok := messageField.Interface().(anthropic.Message); ok {
+			return &message.Usage
+		}
+	}
+
+	return nil
+}
+
 // extractStopReasonFromEvent extracts stop_reason from a message_delta event
 func extractStopReasonFromEvent(event interface{}) string {
 	if event == nil {
@@ -922,11 +1789,32 @@ func extractStopReasonFromEvent(event interface{}) string {
 	deltaField := eventValue.FieldByName("Delta")
 	if deltaField.IsValid() && !deltaField.IsZero() {
 		// Get StopReason from Delta
+		// StopReason is a named string type (anthropic.StopReason), so read it by kind
 		stopReasonField := deltaField.FieldByName("StopReason")
-		if stopReasonField.IsValid() && !stopReasonField.IsZero() {
-			if stopReason, ok := stopReasonField.Interface().(string); ok && stopReason != "" {
-				return stopReason
-			}
+		if stopReasonField.IsValid() && stopReasonField.Kind() == reflect.String {
+			return stopReasonField.String()
+		}
+	}
+
+	return ""
+}
+
+// extractStopSequenceFromEvent extracts the matched stop_sequence from a message_delta event
+func extractStopSequenceFromEvent(event interface{}) string {
+	if event == nil {
+		return ""
+	}
+
+	eventValue := reflect.ValueOf(event)
+	if eventValue.Kind() == reflect.Ptr {
+		eventValue = eventValue.Elem()
+	}
+
+	deltaField := eventValue.FieldByName("Delta")
+	if deltaField.IsValid() && !deltaField.IsZero() {
+		stopSequenceField := deltaField.FieldByName("StopSequence")
+		if stopSequenceField.IsValid() && stopSequenceField.Kind() == reflect.String {
+			return stopSequenceField.String()
 		}
 	}
 
@@ -956,6 +1844,228 @@ func estimateInputTokens(params anthropic.MessageNewParams) int {
 	return estimatedTokens
 }
 
+// imageTokenEstimate is the input token estimate per image: images are resized to at
+// most ~1.15 megapixels, which Anthropic bills at about 1,600 tokens
+const imageTokenEstimate = 1600
+
+// estimateRequestInputTokens estimates a request's input tokens for the
+// WithMaxInputTokens guard. Text (system prompt, text blocks, tool_use inputs and
+// tool_result text) and tool definitions are estimated at ~4 characters per token and
+// each image at imageTokenEstimate; base64 image data is never counted as text
+func estimateRequestInputTokens(params anthropic.MessageNewParams) int {
+	chars := countInputChars(params)
+	images := DetectVisionContent(params).ImageCount
+
+	for _, msg := range params.Messages {
+		for _, block := range msg.Content {
+			switch {
+			case block.OfToolUse != nil:
+				chars += jsonSize(block.OfToolUse.Input)
+			case block.OfToolResult != nil:
+				for _, content := range block.OfToolResult.Content {
+					switch {
+					case content.OfText != nil:
+						chars += utf8.RuneCountInString(content.OfText.Text)
+					case content.OfImage != nil:
+						images++
+					}
+				}
+			}
+		}
+	}
+
+	if len(params.Tools) > 0 {
+		chars += jsonSize(params.Tools)
+	}
+
+	return estimateTextTokens(chars) + images*imageTokenEstimate
+}
+
+// estimateTextTokens approximates the token count of chars characters of text
+// using the same ~4 characters per token heuristic as estimateInputTokens
+func estimateTextTokens(chars int) int {
+	return (chars + 3) / 4
+}
+
+// goMetering runs fn in a background goroutine tracked by the shared WaitGroup,
+// or inline when synchronous metering is enabled. model is the resolved request
+// model, checked against WithMeteringOnlyForModels
+func (m *MessagesInterface) goMetering(model string, fn func()) {
+	if !m.meteredModel(model) {
+		m.counters.recordSkipped()
+		Debug("Model %s is not in the metered model list, skipping meter event", model)
+		return
+	}
+
+	// Honor the runtime kill switch before doing any metering work
+	run := func() {
+		if !IsMeteringEnabled() {
+			m.counters.recordSkipped()
+			Debug("Metering disabled, skipping meter event")
+			return
+		}
+		fn()
+	}
+
+	if m.config != nil && m.config.SynchronousMetering {
+		run()
+		return
+	}
+
+	if m.counters != nil {
+		m.counters.pending.Add(1)
+		tracked := run
+		run = func() {
+			defer m.counters.pending.Add(-1)
+			tracked()
+		}
+	}
+
+	if m.wg != nil {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+			run()
+		}()
+	} else {
+		go run()
+	}
+}
+
+// meteredModel reports whether requests to model are metered. With no
+// WithMeteringOnlyForModels list every model is metered; list entries may be
+// model names or configured aliases
+func (m *MessagesInterface) meteredModel(model string) bool {
+	if m.config == nil || len(m.config.MeteredModels) == 0 {
+		return true
+	}
+	for _, allowed := range m.config.MeteredModels {
+		if allowed == model || string(m.resolveModelAlias(anthropic.Model(allowed))) == model {
+			return true
+		}
+	}
+	return false
+}
+
+// AnthropicOrganizationHeader is the Anthropic response header identifying the
+// organization that served (and bills) the request
+const AnthropicOrganizationHeader = "anthropic-organization-id"
+
+// retryCounter counts the HTTP attempts the Anthropic SDK makes for a single call,
+// and keeps the organization ID reported by the last response
+type retryCounter struct {
+	attempts int32
+	orgID    atomic.Value // string
+}
+
+// option returns a per-request middleware that increments the attempt counter
+func (rc *retryCounter) option() option.RequestOption {
+	return option.WithMiddleware(func(req *http.Request, next option.MiddlewareNext) (*http.Response, error) {
+		atomic.AddInt32(&rc.attempts, 1)
+		resp, err := next(req)
+		if resp != nil {
+			if orgID := resp.Header.Get(AnthropicOrganizationHeader); orgID != "" {
+				rc.orgID.Store(orgID)
+			}
+		}
+		return resp, err
+	})
+}
+
+// organizationID returns the anthropic-organization-id header of the last response
+func (rc *retryCounter) organizationID() string {
+	orgID, _ := rc.orgID.Load().(string)
+	return orgID
+}
+
+// retries returns the number of retries performed (attempts beyond the first)
+func (rc *retryCounter) retries() int {
+	attempts := atomic.LoadInt32(&rc.attempts)
+	if attempts <= 1 {
+		return 0
+	}
+	return int(attempts - 1)
+}
+
+// withRetryNumber records an internal retry count as retryNumber, overriding any
+// user-supplied value since the middleware's count is authoritative. The input map is never modified
+func withRetryNumber(metadata map[string]interface{}, retries int) map[string]interface{} {
+	if retries <= 0 {
+		return metadata
+	}
+	if userValue, ok := metadata["retryNumber"]; ok {
+		Debug("Overriding user-supplied retryNumber %v with internal retry count %d", userValue, retries)
+	}
+	withRetries := MergeMetadata(nil, metadata)
+	withRetries["retryNumber"] = retries
+	return withRetries
+}
+
+// newMeteringContext returns a context for sending metering data that is detached
+// from the caller's request context, so cancelled requests can still be metered.
+// With synchronous metering, the timeout is capped by the request's remaining deadline
+// so metering never blocks the caller past its budget
+func (m *MessagesInterface) newMeteringContext(requestCtx context.Context) (context.Context, context.CancelFunc) {
+	timeout := meteringContextTimeout
+	if m.config != nil && m.config.MeteringTimeout > 0 {
+		timeout = m.config.MeteringTimeout
+	}
+
+	if m.config != nil && m.config.SynchronousMetering {
+		if deadline, ok := requestCtx.Deadline(); ok {
+			// An already expired deadline is not a budget: capping to it would fail the
+			// meter event immediately (e.g. for DeadlineExceeded failures)
+			if remaining := time.Until(deadline); remaining > 0 && remaining < timeout {
+				Debug("Capping metering timeout to remaining request deadline: %v", remaining)
+				timeout = remaining
+			}
+		}
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// meterFailedRequest emits a meter event for a provider call that returned an error
+// Only active when MeterErrors is enabled. Cancelled requests are reported with
+// stopReason CANCELLED, all other failures with stopReason ERROR and an errorReason
+func (m *MessagesInterface) meterFailedRequest(ctx context.Context, reqErr error, metadata map[string]interface{}, isStreamed bool, provider string, startTime time.Time, params *anthropic.MessageNewParams) {
+	if m.config == nil || !m.config.MeterErrors || reqErr == nil {
+		return
+	}
+
+	duration := time.Since(startTime)
+	cancelled := ctx.Err() != nil || errors.Is(reqErr, context.Canceled) || errors.Is(reqErr, context.DeadlineExceeded)
+
+	failedResp := &anthropic.Message{
+		Model: params.Model,
+	}
+
+	errMetadata := MergeMetadata(nil, metadata)
+	if cancelled {
+		failedResp.StopReason = anthropic.StopReason("cancelled")
+		Debug("Request cancelled, metering with stopReason CANCELLED: %v", reqErr)
+	} else if _, ok := errMetadata["errorReason"]; !ok {
+		errMetadata["errorReason"] = reqErr.Error()
+	}
+
+	m.goMetering(string(params.Model), func() {
+		defer func() {
+			if r := recover(); r != nil {
+				Error("Error metering goroutine panic: %v", r)
+			}
+		}()
+
+		payload := buildMeteringPayload(m.config, failedResp, errMetadata, isStreamed, duration, provider, startTime, params)
+		if cancelled {
+			payload["errorReason"] = reqErr.Error()
+		}
+
+		if err := m.sendMeteringWithRetry(ctx, payload); err != nil {
+			Error("Failed to send error metering data: %v", err)
+		}
+	})
+}
+
 // sendMeteringData sends metering data in the background (fire-and-forget)
 // NOTE: This function is already called with 'go' from the caller, so it should NOT launch another goroutine
 func (m *MessagesInterface) sendMeteringData(ctx context.Context, resp *anthropic.Message, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, startTime time.Time, params *anthropic.MessageNewParams) {
@@ -971,22 +2081,117 @@ func (m *MessagesInterface) sendMeteringDataWithPrompts(ctx context.Context, res
 	}()
 
 	// Build metering payload using helper function
-	payload := buildMeteringPayload(resp, metadata, isStreamed, duration, provider, startTime, params)
+	payload := buildMeteringPayload(m.config, resp, metadata, isStreamed, duration, provider, startTime, params)
 
 	// Add prompt data if available
 	if promptData != nil {
 		AddPromptDataToPayload(payload, *promptData)
 	}
 
-	// Send to Revenium API with retry logic
-	if err := m.sendMeteringWithRetry(payload); err != nil {
+	// Send to Revenium API with retry logic, detached from the request context
+	if err := m.sendMeteringWithRetry(ctx, payload); err != nil {
 		Error("Failed to send metering data: %v", err)
 	}
+
+	// Emit one lightweight event per tool call when per-tool metering is enabled
+	if m.config != nil && m.config.PerToolMetering {
+		for _, toolPayload := range buildToolPayloads(payload, resp) {
+			if err := m.sendMeteringWithRetry(ctx, toolPayload); err != nil {
+				Error("Failed to send per-tool metering data: %v", err)
+			}
+		}
+	}
+}
+
+// perToolExcludedFields are parent payload fields that are not copied to per-tool events
+// Token and cost fields are zeroed or dropped so totals are only counted on the parent event
+var perToolExcludedFields = map[string]bool{
+	"systemPrompt":           true,
+	"inputMessages":          true,
+	"outputResponse":         true,
+	"promptsTruncated":       true,
+	"attributes":             true,
+	"inputTokenCost":         true,
+	"outputTokenCost":        true,
+	"cacheCreationTokenCost": true,
+	"cacheReadTokenCost":     true,
+	"totalCost":              true,
+}
+
+// buildToolPayloads builds one zero-token meter event per tool_use block in the response,
+// tagged with the tool name and linked to the parent event via parentTransactionId
+func buildToolPayloads(parent map[string]interface{}, resp *anthropic.Message) []map[string]interface{} {
+	if resp == nil {
+		return nil
+	}
+
+	var toolPayloads []map[string]interface{}
+	for _, block := range resp.Content {
+		if block.Type != "tool_use" {
+			continue
+		}
+
+		toolPayload := make(map[string]interface{}, len(parent))
+		for key, value := range parent {
+			if !perToolExcludedFields[key] {
+				toolPayload[key] = value
+			}
+		}
+
+		toolPayload["inputTokenCount"] = int64(0)
+		toolPayload["outputTokenCount"] = int64(0)
+		toolPayload["reasoningTokenCount"] = int64(0)
+		toolPayload["cacheCreationTokenCount"] = int64(0)
+		toolPayload["cacheReadTokenCount"] = int64(0)
+		toolPayload["totalTokenCount"] = int64(0)
+		toolPayload["parentTransactionId"] = parent["transactionId"]
+		toolPayload["transactionId"] = fmt.Sprintf("%v-tool-%d", parent["transactionId"], len(toolPayloads))
+		toolPayload["attributes"] = map[string]interface{}{
+			"perToolEvent": true,
+			"toolName":     block.Name,
+			"toolUseId":    block.ID,
+		}
+
+		toolPayloads = append(toolPayloads, toolPayload)
+	}
+
+	return toolPayloads
 }
 
-// generateRequestID generates a unique request ID
-func generateRequestID() string {
-	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().UnixNano()%1000)
+// ensureTransactionID returns metadata carrying a transactionId, generating one if the
+// caller did not supply it. The input map is never modified
+func ensureTransactionID(cfg *Config, metadata map[string]interface{}) (map[string]interface{}, string) {
+	if transactionID, ok := metadata["transactionId"]; ok {
+		return metadata, fmt.Sprint(transactionID)
+	}
+
+	transactionID := generateRequestID(cfg)
+	withID := MergeMetadata(nil, metadata)
+	withID["transactionId"] = transactionID
+	return withID, transactionID
+}
+
+// generateRequestID generates a unique request ID using the configured
+// WithTransactionIDGenerator, or a random UUID by default
+func generateRequestID(cfg *Config) string {
+	if cfg != nil && cfg.TransactionIDGenerator != nil {
+		if id := cfg.TransactionIDGenerator(); id != "" {
+			return id
+		}
+	}
+	return newUUID()
+}
+
+// newUUID returns a random (version 4) UUID, falling back to a timestamp-based ID
+// if the system random source fails
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().UnixNano()%1000)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
 }
 
 // mapStopReasonToRevenium converts Anthropic/Bedrock stop reasons to Revenium format
@@ -1033,165 +2238,419 @@ func normalizeProviderName(provider string) string {
 	}
 }
 
-// buildMeteringPayload builds a metering payload, matching Node.js format exactly
-func buildMeteringPayload(resp *anthropic.Message, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, startTime time.Time, params *anthropic.MessageNewParams) map[string]interface{} {
-	// Calculate actual timestamps based on request timing
-	requestTimeISO := startTime.Format(time.RFC3339)
-	responseTime := startTime.Add(duration)
-	responseTimeISO := responseTime.Format(time.RFC3339)
-	completionStartTimeISO := startTime.Format(time.RFC3339) // For non-streaming, completion starts immediately
+// resolveProviderName applies configured provider name overrides on top of the
+// default normalization. Overrides may be keyed by the internal provider name
+// (e.g. "AWS") or by its default display name (e.g. "Amazon Bedrock")
+func resolveProviderName(cfg *Config, provider string) string {
+	normalized := normalizeProviderName(provider)
+	if cfg == nil || len(cfg.ProviderNameOverrides) == 0 {
+		return normalized
+	}
+	if name, ok := cfg.ProviderNameOverrides[provider]; ok && name != "" {
+		return name
+	}
+	if name, ok := cfg.ProviderNameOverrides[normalized]; ok && name != "" {
+		return name
+	}
+	return normalized
+}
 
-	// Normalize provider name to match Revenium spec
-	normalizedProvider := normalizeProviderName(provider)
+// resolveMetadataDefaults layers configured defaults beneath per-request metadata
+// Precedence: per-request metadata > auto-detected > model-specific defaults > global defaults
+func resolveMetadataDefaults(cfg *Config, model string, metadata map[string]interface{}) map[string]interface{} {
+	if cfg == nil {
+		return metadata
+	}
 
-	// Map stop reason with fallback to END
-	stopReason := "END" // Default fallback
-	if resp.StopReason != "" {
-		stopReason = mapStopReasonToRevenium(string(resp.StopReason))
-	} else {
-		// Log when stop reason is empty (helps identify API changes or issues)
-		Debug("Stop reason is empty, defaulting to END")
-	}
-
-	// Start with required fields only (matching Node.js buildReveniumPayload)
-	payload := map[string]interface{}{
-		"stopReason":              stopReason,
-		"costType":                "AI",
-		"isStreamed":              isStreamed,
-		"operationType":           "CHAT",
-		"inputTokenCount":         resp.Usage.InputTokens,
-		"outputTokenCount":        resp.Usage.OutputTokens,
-		"reasoningTokenCount":     int64(0), // Always 0 for Anthropic (no extended thinking)
-		"cacheCreationTokenCount": int64(0), // TODO: Extract from resp.Usage if available
-		"cacheReadTokenCount":     int64(0), // TODO: Extract from resp.Usage if available
-		"totalTokenCount":         resp.Usage.InputTokens + resp.Usage.OutputTokens,
-		"model":                   resp.Model,
-		"transactionId":           generateRequestID(),
-		"responseTime":            responseTimeISO,
-		"requestDuration":         duration.Milliseconds(),
-		"provider":                normalizedProvider,
-		"requestTime":             requestTimeISO,
-		"completionStartTime":     completionStartTimeISO,
-		"timeToFirstToken":        int64(0), // Will be overridden for streaming
-		"middlewareSource":        GetMiddlewareSource(),
-	}
-
-	// Add metadata fields if they exist (based on testing with Revenium API)
-	if metadata != nil {
-		// Business context fields (tested individually with Revenium API)
-		if organizationId, ok := metadata["organizationId"]; ok {
-			payload["organizationId"] = organizationId
-		}
-		if productId, ok := metadata["productId"]; ok {
-			payload["productId"] = productId
-		}
-		if taskType, ok := metadata["taskType"]; ok {
-			payload["taskType"] = taskType
-		}
-		if agent, ok := metadata["agent"]; ok {
-			payload["agent"] = agent
-		}
-		if subscriptionId, ok := metadata["subscriptionId"]; ok {
-			payload["subscriptionId"] = subscriptionId
-		}
-		if traceId, ok := metadata["traceId"]; ok {
-			payload["traceId"] = traceId
-		}
-		if subscriber, ok := metadata["subscriber"]; ok {
-			// subscriber must be an object with nested structure (not a string)
-			payload["subscriber"] = subscriber
-		}
-		if taskId, ok := metadata["taskId"]; ok {
-			payload["taskId"] = taskId
-		}
-		if responseQualityScore, ok := metadata["responseQualityScore"]; ok {
-			payload["responseQualityScore"] = responseQualityScore
-		}
+	// Global defaults (REVENIUM_ORGANIZATION_ID / REVENIUM_PRODUCT_ID)
+	defaults := make(map[string]interface{})
+	if cfg.ReveniumOrgID != "" {
+		defaults["organizationId"] = cfg.ReveniumOrgID
+	}
+	if cfg.ReveniumProductID != "" {
+		defaults["productId"] = cfg.ReveniumProductID
+	}
 
-		// Trace visualization fields (10 fields for distributed tracing)
-		if transactionId, ok := metadata["transactionId"]; ok {
-			payload["transactionId"] = transactionId
-		}
-		if traceType, ok := metadata["traceType"]; ok {
-			payload["traceType"] = traceType
-		}
-		if traceName, ok := metadata["traceName"]; ok {
-			payload["traceName"] = traceName
-		}
-		if environment, ok := metadata["environment"]; ok {
-			payload["environment"] = environment
+	// Model-specific defaults, matched on the model name or its Anthropic equivalent
+	if len(cfg.ModelMetadataDefaults) > 0 && model != "" {
+		modelDefaults, ok := cfg.ModelMetadataDefaults[model]
+		if !ok {
+			if converted, err := ConvertBedrockARNToAnthropicModel(model); err == nil && converted != model {
+				modelDefaults = cfg.ModelMetadataDefaults[converted]
+			}
 		}
-		if region, ok := metadata["region"]; ok {
-			payload["region"] = region
+		defaults = MergeMetadata(defaults, modelDefaults)
+	}
+
+	// Auto-detected runtime metadata (environment/region) describes where the process
+	// actually runs, so it overrides configured defaults but not the request
+	if cfg.AutoDetectEnvironment {
+		defaults = MergeMetadata(defaults, detectRuntimeMetadata())
+	}
+
+	if len(defaults) == 0 {
+		return metadata
+	}
+	return MergeMetadata(defaults, metadata)
+}
+
+// filterBlocklistedMetadata returns metadata without any keys in the configured blocklist
+func filterBlocklistedMetadata(cfg *Config, metadata map[string]interface{}) map[string]interface{} {
+	if cfg == nil || len(cfg.MetadataBlocklist) == 0 || metadata == nil {
+		return metadata
+	}
+
+	filtered := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		filtered[k] = v
+	}
+	for _, key := range cfg.MetadataBlocklist {
+		if _, ok := filtered[key]; ok {
+			Debug("Dropping blocklisted metadata key %s", key)
+			delete(filtered, key)
 		}
-		// NOTE: operationType is fixed to "CHAT" and should NOT be overridden by metadata
-		// (API only accepts: CHAT, GENERATE, EMBED, CLASSIFY, SUMMARIZE, TRANSLATE, OTHER)
-		// operationSubtype is auto-detected, not user-provided
-		if retryNumber, ok := metadata["retryNumber"]; ok {
-			payload["retryNumber"] = retryNumber
+	}
+	return filtered
+}
+
+// stripBlocklistedFields removes blocklisted keys from the payload and its attributes
+func stripBlocklistedFields(cfg *Config, payload map[string]interface{}) {
+	if cfg == nil || len(cfg.MetadataBlocklist) == 0 {
+		return
+	}
+
+	attrs, _ := payload["attributes"].(map[string]interface{})
+	for _, key := range cfg.MetadataBlocklist {
+		delete(payload, key)
+		if attrs != nil {
+			delete(attrs, key)
 		}
-		if credentialAlias, ok := metadata["credentialAlias"]; ok {
-			payload["credentialAlias"] = credentialAlias
+	}
+}
+
+// minimalPayloadFields are the only payload fields sent with WithMinimalPayload:
+// what Revenium needs to compute cost (tokens, model, provider, timestamps)
+var minimalPayloadFields = []string{
+	"stopReason",
+	"costType",
+	"isStreamed",
+	"operationType",
+	"inputTokenCount",
+	"outputTokenCount",
+	"reasoningTokenCount",
+	"cacheCreationTokenCount",
+	"cacheReadTokenCount",
+	"totalTokenCount",
+	"model",
+	"transactionId",
+	"responseTime",
+	"requestDuration",
+	"provider",
+	"requestTime",
+	"completionStartTime",
+	"timeToFirstToken",
+	"middlewareSource",
+}
+
+// minimalPayload returns a copy of payload containing only minimalPayloadFields,
+// dropping metadata, attributes and captured prompts
+func minimalPayload(payload map[string]interface{}) map[string]interface{} {
+	// Heartbeats carry no request data and go to the health endpoint as built
+	if isHeartbeatPayload(payload) {
+		return payload
+	}
+
+	minimal := make(map[string]interface{}, len(minimalPayloadFields))
+	for _, key := range minimalPayloadFields {
+		if value, ok := payload[key]; ok {
+			minimal[key] = value
 		}
-		if parentTransactionId, ok := metadata["parentTransactionId"]; ok {
-			payload["parentTransactionId"] = parentTransactionId
+	}
+	return minimal
+}
+
+// isEmptyResponse reports whether a completed response has no usable content blocks
+func isEmptyResponse(resp *anthropic.Message) bool {
+	if resp == nil || resp.StopReason == "" {
+		return false
+	}
+	for _, block := range resp.Content {
+		if block.Type != "text" || block.Text != "" {
+			return false
 		}
+	}
+	return true
+}
 
-		// Optional fields from Revenium spec (meter_ai_completion.md)
-		if modelSource, ok := metadata["modelSource"]; ok {
-			payload["modelSource"] = modelSource
+// countCitations returns the number of citations attached to the response's text blocks
+func countCitations(resp *anthropic.Message) int {
+	if resp == nil {
+		return 0
+	}
+
+	count := 0
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			count += len(block.Citations)
 		}
-		if mediationLatency, ok := metadata["mediationLatency"]; ok {
-			payload["mediationLatency"] = mediationLatency
+	}
+	return count
+}
+
+// snakeCasePayloadKeys returns a copy of payload with top-level keys in snake_case
+// Nested values such as attributes are left untouched
+func snakeCasePayloadKeys(payload map[string]interface{}) map[string]interface{} {
+	converted := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		converted[toSnakeCase(k)] = v
+	}
+	return converted
+}
+
+// renamePayloadFields returns a copy of payload with top-level keys renamed by names,
+// which is keyed by the camelCase field names. When snakeCase is set the payload keys
+// have already been converted, so the lookup converts the names' keys to match
+func renamePayloadFields(payload map[string]interface{}, names map[string]string, snakeCase bool) map[string]interface{} {
+	lookup := make(map[string]string, len(names))
+	for from, to := range names {
+		if snakeCase {
+			from = toSnakeCase(from)
 		}
-		if temperature, ok := metadata["temperature"]; ok {
-			payload["temperature"] = temperature
+		lookup[from] = to
+	}
+
+	renamed := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if to, ok := lookup[k]; ok && to != "" {
+			k = to
 		}
-		if systemFingerprint, ok := metadata["systemFingerprint"]; ok {
-			payload["systemFingerprint"] = systemFingerprint
+		renamed[k] = v
+	}
+	return renamed
+}
+
+// toSnakeCase converts a camelCase key to snake_case (e.g. inputTokenCount -> input_token_count)
+func toSnakeCase(key string) string {
+	var b strings.Builder
+	b.Grow(len(key) + 4)
+	for i, r := range key {
+		if r >= 'A' && r <= 'Z' {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r += 'a' - 'A'
 		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
 
-		// Cost override fields (typically null to let Revenium calculate)
-		if inputTokenCost, ok := metadata["inputTokenCost"]; ok {
-			payload["inputTokenCost"] = inputTokenCost
+// guardToolInvoked reports whether any guard tool appears as a tool_use block in the
+// request conversation or in the response
+func guardToolInvoked(guardNames []string, params *anthropic.MessageNewParams, resp *anthropic.Message) bool {
+	isGuard := func(name string) bool {
+		for _, guard := range guardNames {
+			if name == guard {
+				return true
+			}
 		}
-		if outputTokenCost, ok := metadata["outputTokenCost"]; ok {
-			payload["outputTokenCost"] = outputTokenCost
+		return false
+	}
+
+	if resp != nil {
+		for _, block := range resp.Content {
+			if block.Type == "tool_use" && isGuard(block.Name) {
+				return true
+			}
 		}
-		if cacheCreationTokenCost, ok := metadata["cacheCreationTokenCost"]; ok {
-			payload["cacheCreationTokenCost"] = cacheCreationTokenCost
+	}
+
+	if params != nil {
+		for _, msg := range params.Messages {
+			for _, block := range msg.Content {
+				if block.OfToolUse != nil && isGuard(block.OfToolUse.Name) {
+					return true
+				}
+			}
 		}
-		if cacheReadTokenCost, ok := metadata["cacheReadTokenCost"]; ok {
-			payload["cacheReadTokenCost"] = cacheReadTokenCost
+	}
+
+	return false
+}
+
+// countInputChars returns the number of characters in the request's system prompt
+// and message text blocks. Images, documents and tool blocks are not counted, so
+// base64 data never inflates the count
+func countInputChars(params anthropic.MessageNewParams) int {
+	count := utf8.RuneCountInString(extractSystemContent(params.System))
+	for _, msg := range params.Messages {
+		count += countTextBlockChars(msg)
+	}
+	return count
+}
+
+// countTextBlockChars returns the number of characters in a message's text blocks
+func countTextBlockChars(msg anthropic.MessageParam) int {
+	count := 0
+	for _, block := range msg.Content {
+		if block.OfText != nil {
+			count += utf8.RuneCountInString(block.OfText.Text)
 		}
-		if totalCost, ok := metadata["totalCost"]; ok {
-			payload["totalCost"] = totalCost
+	}
+	return count
+}
+
+// countOutputChars returns the number of characters in the response's text blocks
+func countOutputChars(resp *anthropic.Message) int {
+	if resp == nil {
+		return 0
+	}
+	count := 0
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			count += utf8.RuneCountInString(block.Text)
 		}
+	}
+	return count
+}
 
-		// Error tracking
-		if errorReason, ok := metadata["errorReason"]; ok {
-			payload["errorReason"] = errorReason
-			payload["stopReason"] = "ERROR" // Override stop reason if error occurred
+// countTurns returns the number of conversational turns, where consecutive messages
+// from the same role count as a single turn (user, assistant, user = 3 turns)
+func countTurns(messages []anthropic.MessageParam) int {
+	turns := 0
+	var lastRole anthropic.MessageParamRole
+	for _, msg := range messages {
+		if turns == 0 || msg.Role != lastRole {
+			turns++
+			lastRole = msg.Role
 		}
 	}
+	return turns
+}
 
-	// Detect vision content in request parameters
-	if params != nil {
-		visionResult := DetectVisionContent(*params)
-		if visionResult.HasVisionContent {
-			payload["hasVisionContent"] = true
-			// Add vision attributes
-			if attrs := BuildVisionAttributes(visionResult); attrs != nil {
-				payload["attributes"] = attrs
+// toolChoiceMode returns the request's tool_choice mode (auto, any, tool, none), or ""
+// when tool_choice is not set
+func toolChoiceMode(params *anthropic.MessageNewParams) string {
+	switch {
+	case params.ToolChoice.OfAuto != nil:
+		return "auto"
+	case params.ToolChoice.OfAny != nil:
+		return "any"
+	case params.ToolChoice.OfTool != nil:
+		return "tool"
+	case params.ToolChoice.OfNone != nil:
+		return "none"
+	default:
+		return ""
+	}
+}
+
+// jsonSize returns the byte size of v marshaled as JSON, or 0 if it cannot be marshaled
+func jsonSize(v interface{}) int {
+	data, err := json.Marshal(v)
+	if err != nil {
+		Debug("Failed to marshal value for size measurement: %v", err)
+		return 0
+	}
+	return len(data)
+}
+
+// meteringEndpointPath returns the endpoint path for a payload based on its operationType
+// Types without a configured path are sent to the default completions endpoint, and
+// heartbeats to the default heartbeat endpoint
+func meteringEndpointPath(cfg *Config, payload map[string]interface{}) string {
+	if cfg != nil && len(cfg.OperationTypeEndpoints) > 0 {
+		if operationType, ok := payload["operationType"].(string); ok {
+			if path, ok := cfg.OperationTypeEndpoints[operationType]; ok && path != "" {
+				return path
 			}
 		}
 	}
+	if isHeartbeatPayload(payload) {
+		return DefaultHeartbeatEndpointPath
+	}
+	return DefaultMeteringEndpointPath
+}
+
+// isPerToolPayload reports whether a payload is a zero-token per-tool event
+func isPerToolPayload(payload map[string]interface{}) bool {
+	attrs, ok := payload["attributes"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	isToolEvent, _ := attrs["perToolEvent"].(bool)
+	return isToolEvent
+}
 
-	return payload
+// setPayloadAttribute sets a key in the payload's attributes map, creating it if needed
+// Non-billing analytics fields belong in attributes rather than at the top level
+func setPayloadAttribute(payload map[string]interface{}, key string, value interface{}) {
+	attrs, ok := payload["attributes"].(map[string]interface{})
+	if !ok {
+		attrs = make(map[string]interface{})
+		payload["attributes"] = attrs
+	}
+	attrs[key] = value
 }
 
 // sendMeteringWithRetry sends metering data with exponential backoff retry
-func (m *MessagesInterface) sendMeteringWithRetry(payload map[string]interface{}) error {
+// and records the outcome in the client's metering counters. A panic while
+// sending (e.g. in a custom serializer, body transform or sender) fails only
+// this event, so the remaining events of the same request are still sent.
+// The metering context is created from requestCtx only once a worker slot is
+// free, so time spent queued does not consume the metering timeout
+func (m *MessagesInterface) sendMeteringWithRetry(requestCtx context.Context, payload map[string]interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = NewMeteringError(fmt.Sprintf("metering payload panicked: %v", r), nil)
+			m.counters.recordSend(err)
+		}
+	}()
+
+	// Wait for a free worker slot, recording how long the event was queued. The
+	// wait is bounded by the sends ahead of it, each capped by the metering timeout
+	if m.workers != nil {
+		enqueued := time.Now()
+		m.workers <- struct{}{}
+		defer func() { <-m.workers }()
+		setPayloadAttribute(payload, "meteringQueueWaitMs", time.Since(enqueued).Milliseconds())
+	}
+
+	ctx, cancel := m.newMeteringContext(requestCtx)
+	defer cancel()
+
+	// Interceptors and the blocklist see the payload exactly as it will be sent
+	finalizePayload(m.config, payload)
+
+	m.history.record(payload)
+	if !isPerToolPayload(payload) {
+		m.subs.record(payload)
+		if m.config != nil && m.config.MetricsRecorder != nil && !isHeartbeatPayload(payload) {
+			recordPayloadMetrics(ctx, m.config.MetricsRecorder, payload)
+		}
+	}
+
+	// Metrics-only mode exports through the recorder instead of Revenium HTTP calls
+	if m.config != nil && m.config.MetricsRecorder != nil && m.config.MetricsOnly {
+		return nil
+	}
+
+	err = m.retryMeteringRequest(ctx, payload)
+	m.counters.recordSend(err)
+	return err
+}
+
+// newMeteringWorkers returns the send slots bounding concurrent metering sends, or
+// nil for unbounded sends when workers is not positive
+func newMeteringWorkers(workers int) chan struct{} {
+	if workers <= 0 {
+		return nil
+	}
+	return make(chan struct{}, workers)
+}
+
+// retryMeteringRequest sends one metering payload, retrying transient failures
+func (m *MessagesInterface) retryMeteringRequest(ctx context.Context, payload map[string]interface{}) error {
 	const maxRetries = 3
 	const initialBackoff = 100 * time.Millisecond
 
@@ -1200,19 +2659,31 @@ func (m *MessagesInterface) sendMeteringWithRetry(payload map[string]interface{}
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
-			time.Sleep(backoff)
+			wait := backoff
+			if m.config == nil || !m.config.DisableBackoffJitter {
+				wait = jitterBackoff(backoff)
+			}
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return NewMeteringError("metering cancelled", ctx.Err())
+			}
 			backoff *= 2 // Exponential backoff
 		}
 
-		err := m.sendMeteringRequest(payload)
+		sendStart := time.Now()
+		err := m.sendMeteringRequest(ctx, payload)
+		if !IsConfigError(err) {
+			m.counters.recordLatency(time.Since(sendStart))
+		}
 		if err == nil {
 			return nil // Success
 		}
 
 		lastErr = err
 
-		// Don't retry on validation errors
-		if isValidationError(err) {
+		// Don't retry on validation or configuration errors
+		if isValidationError(err) || IsConfigError(err) {
 			return err
 		}
 	}
@@ -1221,7 +2692,20 @@ func (m *MessagesInterface) sendMeteringWithRetry(payload map[string]interface{}
 }
 
 // sendMeteringRequest sends a single metering request to Revenium API
-func (m *MessagesInterface) sendMeteringRequest(payload map[string]interface{}) error {
+func (m *MessagesInterface) sendMeteringRequest(ctx context.Context, payload map[string]interface{}) error {
+	// Routing reads the full payload, so resolve it before the payload is reduced
+	environment, _ := payload["environment"].(string)
+
+	// Reduce the payload to the billing fields before it leaves the process
+	if m.config != nil && m.config.MinimalPayload {
+		payload = minimalPayload(payload)
+	}
+
+	// A custom sender replaces the HTTP call entirely (e.g. to capture payloads in tests)
+	if m.config != nil && m.config.MeteringSender != nil {
+		return m.config.MeteringSender(ctx, payload)
+	}
+
 	if m.config == nil || m.config.ReveniumAPIKey == "" {
 		return NewConfigError("metering not configured", nil)
 	}
@@ -1231,29 +2715,91 @@ func (m *MessagesInterface) sendMeteringRequest(payload map[string]interface{})
 	if baseURL == "" {
 		baseURL = "https://api.revenium.ai"
 	}
-	// Append the endpoint path: /meter/v2/ai/completions
-	url := baseURL + "/meter/v2/ai/completions"
 
-	// Marshal payload to JSON
-	jsonData, err := json.Marshal(payload)
-	if err != nil {
-		return NewMeteringError("failed to marshal metering payload", err)
+	// Route the event to its environment's endpoint (see WithEnvironmentEndpoints)
+	if environment != "" {
+		if endpoint, ok := m.config.EnvironmentEndpoints[environment]; ok && endpoint != "" {
+			baseURL = endpoint
+		}
+	}
+
+	// Refuse to send potentially sensitive data over plaintext HTTP
+	if err := ValidateMeteringURL(baseURL, m.config.AllowInsecureMetering); err != nil {
+		return err
+	}
+	// Append the endpoint path for the payload's operation type (default: /meter/v2/ai/completions)
+	url := baseURL + meteringEndpointPath(m.config, payload)
+
+	// Apply the configured top-level field casing (default camelCase)
+	snakeCase := m.config.PayloadFieldCase == PayloadFieldCaseSnake
+	if snakeCase {
+		payload = snakeCasePayloadKeys(payload)
+	}
+
+	// Rename fields for custom Revenium schemas (see WithFieldNameMap)
+	if len(m.config.FieldNameMap) > 0 {
+		payload = renamePayloadFields(payload, m.config.FieldNameMap, snakeCase)
+	}
+
+	// Let deployments reshape the body for downstream collectors
+	var requestBody interface{} = payload
+	if m.config.MeteringBodyTransform != nil {
+		transformed, err := m.config.MeteringBodyTransform(payload)
+		if err != nil {
+			return NewValidationError("metering body transform failed", err)
+		}
+		requestBody = transformed
+	}
+
+	// Marshal payload to JSON; pre-encoded transform output ([]byte or string) is sent as-is
+	var jsonData []byte
+	switch encoded := requestBody.(type) {
+	case []byte:
+		jsonData = encoded
+	case string:
+		jsonData = []byte(encoded)
+	default:
+		marshal := json.Marshal
+		if m.config.MeteringSerializer != nil {
+			marshal = m.config.MeteringSerializer
+		}
+		var err error
+		jsonData, err = marshal(requestBody)
+		if err != nil {
+			return NewMeteringError("failed to marshal metering payload", err)
+		}
 	}
 
 	// Log the exact payload being sent
 	Debug("[METERING] Sending payload to %s: %s", url, string(jsonData))
 
 	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return NewMeteringError("failed to create metering request", err)
 	}
 
+	// Dynamic headers go first so the required headers below cannot be overridden
+	if m.config.MeteringHeaderFunc != nil {
+		for key, value := range m.config.MeteringHeaderFunc() {
+			req.Header.Set(key, value)
+		}
+	}
+
 	// Set headers (matching Node.js implementation)
-	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	contentType := DefaultMeteringContentType
+	if m.config.MeteringContentType != "" {
+		contentType = m.config.MeteringContentType
+	}
+	req.Header.Set("Content-Type", contentType)
 	req.Header.Set("x-api-key", m.config.ReveniumAPIKey)
 	req.Header.Set("User-Agent", "revenium-middleware-anthropic-go/1.0")
 
+	// Allow signing proxies to add signature headers computed over the final body
+	if m.config.MeteringRequestSigner != nil {
+		m.config.MeteringRequestSigner(req, jsonData)
+	}
+
 	// Send request with timeout
 	client := &http.Client{
 		Timeout: 10 * time.Second,
@@ -1292,15 +2838,14 @@ func isValidationError(err error) bool {
 	return IsValidationError(err)
 }
 
-// Reset resets the global middleware state for testing
+// Reset resets the global middleware state for testing. The client is unpublished
+// before it is closed, so concurrent GetClient calls never return a closing client;
+// callers already holding it can still finish their in-flight requests
 func Reset() {
 	globalMu.Lock()
 	defer globalMu.Unlock()
 
-	if globalClient != nil {
-		globalClient.Close()
-		globalClient = nil
+	if client := globalClient.Swap(nil); client != nil {
+		client.Close()
 	}
-
-	initialized = false
 }
@@ -0,0 +1,1931 @@
+package revenium
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/option"
+)
+
+// payloadRecorder captures the payloads received by a test metering endpoint
+type payloadRecorder struct {
+	mu       sync.Mutex
+	payloads []map[string]interface{}
+}
+
+func (p *payloadRecorder) send(_ context.Context, payload map[string]interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.payloads = append(p.payloads, payload)
+	return nil
+}
+
+func (p *payloadRecorder) all() []map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]map[string]interface{}(nil), p.payloads...)
+}
+
+// newTestClient builds a mock-provider client that meters synchronously into the
+// returned recorder
+func newTestClient(t *testing.T, responses []anthropic.Message, opts ...Option) (*ReveniumAnthropic, *payloadRecorder) {
+	t.Helper()
+
+	recorder := &payloadRecorder{}
+	cfg := &Config{ReveniumAPIKey: "hak_test"}
+	for _, opt := range append([]Option{
+		WithMockResponses(responses),
+		WithSynchronousMetering(true),
+		WithMeteringSender(recorder.send),
+	}, opts...) {
+		opt(cfg)
+	}
+
+	client, err := NewReveniumAnthropic(cfg)
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, recorder
+}
+
+// newMeteringServer starts a local Revenium endpoint that records each payload it receives
+func newMeteringServer(t *testing.T) (string, *payloadRecorder) {
+	t.Helper()
+
+	recorder := &payloadRecorder{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("decode metering payload: %v", err)
+		}
+		recorder.send(r.Context(), payload)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, recorder
+}
+
+// newAnthropicServer starts a local Anthropic API and points Anthropic clients built
+// afterwards at it through ANTHROPIC_BASE_URL
+func newAnthropicServer(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	t.Setenv("ANTHROPIC_BASE_URL", server.URL)
+}
+
+// writeSSE writes Anthropic stream events as server-sent events
+func writeSSE(w http.ResponseWriter, events ...string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	for _, event := range events {
+		var typed struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal([]byte(event), &typed)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typed.Type, event)
+	}
+	w.(http.Flusher).Flush()
+}
+
+// Canned non-streaming response with 3 input and 2 output tokens
+const jsonMessage = `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-latest","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":3,"output_tokens":2}}`
+
+// Canned stream events for a short text response
+const (
+	sseMessageStart = `{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-latest","content":[],"stop_reason":null,"usage":{"input_tokens":5,"output_tokens":1}}}`
+	sseBlockStart   = `{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`
+	sseTextDelta    = `{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`
+	sseBlockStop    = `{"type":"content_block_stop","index":0}`
+	sseMessageDelta = `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7}}`
+	sseMessageStop  = `{"type":"message_stop"}`
+	sseError        = `{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`
+)
+
+// textRequest returns request params with a single user text message
+func textRequest(text string) anthropic.MessageNewParams {
+	return anthropic.MessageNewParams{
+		Model:     "claude-3-5-haiku-latest",
+		MaxTokens: 16,
+		Messages:  []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock(text))},
+	}
+}
+
+func TestMaxInputTokensAllowsRequestUnderCap(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{{}}, WithMaxInputTokens(100))
+
+	// 200 characters is an estimated 50 tokens
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest(strings.Repeat("a", 200))); err != nil {
+		t.Fatalf("request under the cap was rejected: %v", err)
+	}
+	if got := len(recorder.all()); got != 1 {
+		t.Fatalf("expected 1 meter event, got %d", got)
+	}
+}
+
+func TestMaxInputTokensRejectsRequestOverCap(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{{}}, WithMaxInputTokens(100))
+
+	// 800 characters is an estimated 200 tokens
+	_, err := client.Messages().CreateMessage(context.Background(), textRequest(strings.Repeat("a", 800)))
+	if !IsValidationError(err) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "estimated 200 input tokens") {
+		t.Errorf("error does not report the estimate: %v", err)
+	}
+	if got := len(recorder.all()); got != 0 {
+		t.Errorf("rejected request was metered %d times", got)
+	}
+}
+
+func TestMaxInputTokensPricesImagesSeparately(t *testing.T) {
+	client, _ := newTestClient(t, []anthropic.Message{{}}, WithMaxInputTokens(2000))
+
+	// A 1 MB image must not be counted as ~350k tokens of base64 text
+	data := base64.StdEncoding.EncodeToString(make([]byte, 1<<20))
+	params := anthropic.MessageNewParams{
+		Model:     "claude-3-5-haiku-latest",
+		MaxTokens: 16,
+		Messages: []anthropic.MessageParam{anthropic.NewUserMessage(
+			anthropic.NewImageBlockBase64("image/png", data),
+		)},
+	}
+	if got := estimateRequestInputTokens(params); got != imageTokenEstimate {
+		t.Errorf("estimateRequestInputTokens = %d, want %d", got, imageTokenEstimate)
+	}
+	if _, err := client.Messages().CreateMessage(context.Background(), params); err != nil {
+		t.Fatalf("image-only request was rejected: %v", err)
+	}
+}
+
+func TestEstimateRequestInputTokensCountsToolResultsAndDefinitions(t *testing.T) {
+	params := textRequest("")
+	base := estimateRequestInputTokens(params)
+
+	params.Messages = append(params.Messages, anthropic.NewUserMessage(
+		anthropic.NewToolResultBlock("toolu_1", strings.Repeat("r", 400), false),
+	))
+	withResult := estimateRequestInputTokens(params)
+	if withResult-base != 100 {
+		t.Errorf("tool_result text added %d tokens, want 100", withResult-base)
+	}
+
+	params.Tools = []anthropic.ToolUnionParam{{OfTool: &anthropic.ToolParam{
+		Name:        "lookup",
+		Description: anthropic.String(strings.Repeat("d", 400)),
+		InputSchema: anthropic.ToolInputSchemaParam{},
+	}}}
+	if withTools := estimateRequestInputTokens(params); withTools <= withResult+100 {
+		t.Errorf("tool definitions were not counted: %d <= %d", withTools, withResult+100)
+	}
+}
+
+// newServerClient builds a client that calls the local Anthropic API and meters to meteringURL
+func newServerClient(t *testing.T, meteringURL string, opts ...Option) *ReveniumAnthropic {
+	t.Helper()
+
+	cfg := &Config{AnthropicAPIKey: "sk-test", ReveniumAPIKey: "hak_test", ReveniumBaseURL: meteringURL, BedrockDisabled: true}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	client, err := NewReveniumAnthropic(cfg)
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// consumeStream reads a stream to the end, closes it and waits for its meter event
+func consumeStream(t *testing.T, client *ReveniumAnthropic, params anthropic.MessageNewParams) *StreamingWrapper {
+	t.Helper()
+
+	stream, err := client.Messages().CreateMessageStream(context.Background(), params)
+	if err != nil {
+		t.Fatalf("CreateMessageStream: %v", err)
+	}
+	sw := stream.(*StreamingWrapper)
+	for sw.Next() {
+		sw.Current()
+	}
+	sw.Close()
+	client.Flush()
+	return sw
+}
+
+func TestModelMetadataDefaultsOverriddenByRequest(t *testing.T) {
+	cfg := &Config{
+		ReveniumOrgID: "global-org",
+		ModelMetadataDefaults: map[string]map[string]interface{}{
+			"claude-3-5-haiku-latest": {"organizationId": "model-org", "taskType": "model-task", "agent": "model-agent"},
+		},
+	}
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn}
+	payload := buildMeteringPayload(cfg, resp, map[string]interface{}{"taskType": "request-task"}, false, time.Second, "Anthropic", time.Now(), nil)
+
+	for field, want := range map[string]interface{}{
+		"organizationId": "model-org",
+		"taskType":       "request-task",
+		"agent":          "model-agent",
+	} {
+		if payload[field] != want {
+			t.Errorf("%s = %v, want %v", field, payload[field], want)
+		}
+	}
+
+	// other models only see the global defaults
+	other := &anthropic.Message{Model: "claude-sonnet-4-5", StopReason: anthropic.StopReasonEndTurn}
+	payload = buildMeteringPayload(cfg, other, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if payload["organizationId"] != "global-org" || payload["taskType"] != nil {
+		t.Errorf("organizationId = %v, taskType = %v; want global-org, <nil>", payload["organizationId"], payload["taskType"])
+	}
+}
+
+func TestInitializeAndNewReveniumAnthropicShareSetup(t *testing.T) {
+	t.Setenv("REVENIUM_METERING_API_KEY", "hak_test")
+	t.Cleanup(Reset)
+
+	opts := []Option{WithMeterErrors(true), WithHeartbeat(time.Hour), WithMeteringWorkers(2), WithConfigFingerprint(true)}
+	if err := Initialize(opts...); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	global, err := GetClient()
+	if err != nil {
+		t.Fatalf("GetClient: %v", err)
+	}
+
+	cfg := &Config{ReveniumAPIKey: "hak_test"}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	explicit, err := NewReveniumAnthropic(cfg)
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	defer explicit.Close()
+
+	for name, client := range map[string]*ReveniumAnthropic{"Initialize": global, "NewReveniumAnthropic": explicit} {
+		if !client.config.MeterErrors {
+			t.Errorf("%s: MeterErrors option not applied", name)
+		}
+		if client.provider != DetectProvider(client.config) {
+			t.Errorf("%s: provider = %v, want the detected provider", name, client.provider)
+		}
+		if client.beat == nil {
+			t.Errorf("%s: heartbeat not started", name)
+		}
+		if cap(client.workers) != 2 {
+			t.Errorf("%s: %d metering workers, want 2", name, cap(client.workers))
+		}
+		if client.config.fingerprint == "" {
+			t.Errorf("%s: config fingerprint not computed", name)
+		}
+	}
+
+	// An incomplete configuration is rejected before anything is built
+	if _, err := NewReveniumAnthropic(&Config{}); !IsConfigError(err) {
+		t.Errorf("NewReveniumAnthropic(empty) = %v, want a config error", err)
+	}
+}
+
+func TestCancelMidCallMetersCancelledRequest(t *testing.T) {
+	received, release := make(chan struct{}), make(chan struct{})
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release // Never answer; the caller cancels mid-call
+	})
+	t.Cleanup(func() { close(release) })
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithMeterErrors(true))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-received
+		cancel()
+	}()
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hello")); err == nil {
+		t.Fatal("CreateMessage succeeded after cancellation")
+	}
+	client.Flush()
+
+	// The cancelled call is still metered, on a context detached from the request
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	if payloads[0]["stopReason"] != "CANCELLED" {
+		t.Errorf("stopReason = %v, want CANCELLED", payloads[0]["stopReason"])
+	}
+	if reason, _ := payloads[0]["errorReason"].(string); !strings.Contains(reason, "context canceled") {
+		t.Errorf("errorReason = %q, want the cancellation error", reason)
+	}
+}
+
+func TestFailedRequestMeteredOnlyWithMeterErrors(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"max_tokens is too large"}}`))
+	})
+
+	for _, meterErrors := range []bool{false, true} {
+		meteringURL, recorder := newMeteringServer(t)
+		client := newServerClient(t, meteringURL, WithMeterErrors(meterErrors))
+		if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err == nil {
+			t.Fatal("CreateMessage succeeded against a failing API")
+		}
+		client.Flush()
+
+		payloads := recorder.all()
+		if !meterErrors {
+			if len(payloads) != 0 {
+				t.Errorf("got %d meter events without WithMeterErrors, want 0", len(payloads))
+			}
+			continue
+		}
+		if len(payloads) != 1 {
+			t.Fatalf("got %d meter events, want 1", len(payloads))
+		}
+		if payloads[0]["stopReason"] != "ERROR" {
+			t.Errorf("stopReason = %v, want ERROR", payloads[0]["stopReason"])
+		}
+		if reason, _ := payloads[0]["errorReason"].(string); !strings.Contains(reason, "max_tokens is too large") {
+			t.Errorf("errorReason = %q, want the API error", reason)
+		}
+		if payloads[0]["outputTokenCount"] != 0.0 {
+			t.Errorf("outputTokenCount = %v, want 0", payloads[0]["outputTokenCount"])
+		}
+	}
+}
+
+func TestInjectedAnthropicClientUsedVerbatim(t *testing.T) {
+	headers := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Get("X-Test-Client")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	}))
+	defer server.Close()
+
+	meteringURL, recorder := newMeteringServer(t)
+	injected := anthropic.NewClient(option.WithBaseURL(server.URL), option.WithAPIKey("sk-test"), option.WithHeader("X-Test-Client", "injected"))
+	client := newServerClient(t, meteringURL, WithAnthropicClient(injected))
+
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	client.Flush()
+
+	if header := <-headers; header != "injected" {
+		t.Errorf("X-Test-Client = %q, want the injected client's header", header)
+	}
+	if payloads := recorder.all(); len(payloads) != 1 || payloads[0]["inputTokenCount"] != 3.0 {
+		t.Errorf("meter events = %v, want one with 3 input tokens", payloads)
+	}
+}
+
+func TestAnthropicVersionAppliesToInjectedClient(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header.Clone()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	}))
+	defer server.Close()
+
+	meteringURL, _ := newMeteringServer(t)
+	injected := anthropic.NewClient(
+		option.WithBaseURL(server.URL),
+		option.WithAPIKey("sk-test"),
+		option.WithHeader("X-Injected", "kept"),
+		option.WithMaxRetries(0),
+	)
+	client := newServerClient(t, meteringURL, WithAnthropicClient(injected), WithAnthropicVersion("2023-01-01"))
+
+	if got := client.GetAnthropicClient(); len(got.Options) != len(injected.Options) {
+		t.Errorf("injected client was rebuilt: %d options, want %d", len(got.Options), len(injected.Options))
+	}
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	if got := headers.Get("anthropic-version"); got != "2023-01-01" {
+		t.Errorf("anthropic-version = %q, want 2023-01-01", got)
+	}
+	if got := headers.Get("X-Injected"); got != "kept" {
+		t.Errorf("injected client option was lost: X-Injected = %q", got)
+	}
+}
+
+func TestCreateMessageDetailedReportsResult(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-latest","content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":10,"output_tokens":4,"cache_creation_input_tokens":6,"cache_read_input_tokens":2}}`))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	result, err := client.Messages().CreateMessageDetailed(context.Background(), textRequest("hello"))
+	if err != nil {
+		t.Fatalf("CreateMessageDetailed: %v", err)
+	}
+	client.Flush()
+
+	want := TokenCounts{Input: 10, Output: 4, Total: 14, CacheCreation: 6, CacheRead: 2}
+	if result.Tokens != want {
+		t.Errorf("Tokens = %+v, want %+v", result.Tokens, want)
+	}
+	if result.Provider != "Anthropic" || result.FallbackOccurred || result.Model != "claude-3-5-haiku-latest" {
+		t.Errorf("Provider = %q, FallbackOccurred = %v, Model = %q", result.Provider, result.FallbackOccurred, result.Model)
+	}
+	if result.Duration <= 0 {
+		t.Errorf("Duration = %v, want > 0", result.Duration)
+	}
+
+	// The returned transaction ID is the one reported to Revenium
+	payloads := recorder.all()
+	if len(payloads) != 1 || result.TransactionID == "" || payloads[0]["transactionId"] != result.TransactionID {
+		t.Errorf("TransactionID = %q, meter events = %v", result.TransactionID, payloads)
+	}
+
+	// A caller-supplied transactionId is kept
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"transactionId": "txn-caller"})
+	if result, err = client.Messages().CreateMessageDetailed(ctx, textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessageDetailed: %v", err)
+	}
+	if result.TransactionID != "txn-caller" {
+		t.Errorf("TransactionID = %q, want txn-caller", result.TransactionID)
+	}
+}
+
+func TestStreamInputTokenEstimate(t *testing.T) {
+	// message_delta reporting the real input usage
+	deltaWithInput := `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":5,"output_tokens":7}}`
+	tests := []struct {
+		name          string
+		delta         string
+		disabled      bool
+		wantEstimated bool
+		wantInput     float64 // -1 for any non-zero estimate
+	}{
+		{"real usage replaces the estimate", deltaWithInput, false, false, 5},
+		{"estimate flagged when usage is missing", sseMessageDelta, false, true, -1},
+		{"estimate disabled", sseMessageDelta, true, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No message_start, whose usage would be authoritative: only the delta reports usage
+			newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+				writeSSE(w, sseBlockStart, sseTextDelta, sseBlockStop, tt.delta, sseMessageStop)
+			})
+			meteringURL, recorder := newMeteringServer(t)
+			client := newServerClient(t, meteringURL, WithInputTokenEstimateDisabled(tt.disabled))
+
+			consumeStream(t, client, textRequest("estimate my input tokens"))
+
+			payloads := recorder.all()
+			if len(payloads) != 1 {
+				t.Fatalf("got %d meter events, want 1", len(payloads))
+			}
+			attrs, _ := payloads[0]["attributes"].(map[string]interface{})
+			if estimated := attrs["inputTokensEstimated"] == true; estimated != tt.wantEstimated {
+				t.Errorf("inputTokensEstimated = %v, want %v", estimated, tt.wantEstimated)
+			}
+			input := payloads[0]["inputTokenCount"]
+			if (tt.wantInput >= 0 && input != tt.wantInput) || (tt.wantInput < 0 && input == 0.0) {
+				t.Errorf("inputTokenCount = %v, want %v", input, tt.wantInput)
+			}
+		})
+	}
+}
+
+func TestCitationsCounted(t *testing.T) {
+	var resp anthropic.Message
+	body := `{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-latest","stop_reason":"end_turn",
+		"content":[{"type":"text","text":"cited","citations":[
+			{"type":"char_location","cited_text":"a","document_index":0,"document_title":"doc","start_char_index":0,"end_char_index":1},
+			{"type":"char_location","cited_text":"b","document_index":0,"document_title":"doc","start_char_index":1,"end_char_index":2}]},
+			{"type":"text","text":"plain"}]}`
+	if err := json.Unmarshal([]byte(body), &resp); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	payload := buildMeteringPayload(&Config{}, &resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	attrs, _ := payload["attributes"].(map[string]interface{})
+	if attrs["hasCitations"] != true || attrs["citationCount"] != 2 {
+		t.Errorf("attributes = %v, want hasCitations and citationCount 2", attrs)
+	}
+
+	// Responses without citations carry neither attribute
+	resp.Content = resp.Content[1:]
+	payload = buildMeteringPayload(&Config{}, &resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if attrs, _ := payload["attributes"].(map[string]interface{}); attrs["hasCitations"] != nil {
+		t.Errorf("attributes = %v, want no citation attributes", attrs)
+	}
+}
+
+func TestStreamCitationsCounted(t *testing.T) {
+	citation := `{"type":"content_block_delta","index":0,"delta":{"type":"citations_delta","citation":{"type":"char_location","cited_text":"a","document_index":0,"document_title":"doc","start_char_index":0,"end_char_index":1}}}`
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, sseMessageStart, sseBlockStart, sseTextDelta, citation, citation, citation, sseBlockStop, sseMessageDelta, sseMessageStop)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	consumeStream(t, client, textRequest("cite your sources"))
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	attrs, _ := payloads[0]["attributes"].(map[string]interface{})
+	if attrs["hasCitations"] != true || attrs["citationCount"] != 3.0 {
+		t.Errorf("attributes = %v, want hasCitations and citationCount 3", attrs)
+	}
+}
+
+func TestSDKRetriesReportedAsRetryNumber(t *testing.T) {
+	var calls atomic.Int32
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After-Ms", "1")
+			w.WriteHeader(529)
+			w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+			return
+		}
+		w.Write([]byte(jsonMessage))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	// The caller's own retryNumber is replaced by the middleware's count
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"retryNumber": 7})
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	client.Flush()
+
+	payloads := recorder.all()
+	if len(payloads) != 1 || payloads[0]["retryNumber"] != 1.0 {
+		t.Errorf("meter events = %v, want one with retryNumber 1", payloads)
+	}
+}
+
+func TestPerToolMeteringEmitsZeroTokenEvents(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-latest","stop_reason":"tool_use",
+			"content":[{"type":"text","text":"calling tools"},
+				{"type":"tool_use","id":"toolu_1","name":"search","input":{}},
+				{"type":"tool_use","id":"toolu_2","name":"fetch","input":{}}],
+			"usage":{"input_tokens":10,"output_tokens":4}}`))
+	})
+
+	for _, enabled := range []bool{false, true} {
+		meteringURL, recorder := newMeteringServer(t)
+		client := newServerClient(t, meteringURL, WithPerToolMetering(enabled))
+		ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"transactionId": "txn-1"})
+		if _, err := client.Messages().CreateMessage(ctx, textRequest("use your tools")); err != nil {
+			t.Fatalf("CreateMessage: %v", err)
+		}
+		client.Flush()
+
+		payloads := recorder.all()
+		if !enabled {
+			if len(payloads) != 1 {
+				t.Errorf("got %d meter events without per-tool metering, want 1", len(payloads))
+			}
+			continue
+		}
+		if len(payloads) != 3 {
+			t.Fatalf("got %d meter events, want the request plus one per tool", len(payloads))
+		}
+		if payloads[0]["inputTokenCount"] != 10.0 {
+			t.Errorf("parent inputTokenCount = %v, want 10", payloads[0]["inputTokenCount"])
+		}
+		for i, tool := range []string{"search", "fetch"} {
+			event := payloads[i+1]
+			attrs, _ := event["attributes"].(map[string]interface{})
+			if attrs["toolName"] != tool || attrs["perToolEvent"] != true {
+				t.Errorf("tool event %d attributes = %v, want toolName %s", i, attrs, tool)
+			}
+			if event["inputTokenCount"] != 0.0 || event["outputTokenCount"] != 0.0 {
+				t.Errorf("tool event %d tokens = %v/%v, want 0/0", i, event["inputTokenCount"], event["outputTokenCount"])
+			}
+			if event["parentTransactionId"] != "txn-1" || event["transactionId"] != fmt.Sprintf("txn-1-tool-%d", i) {
+				t.Errorf("tool event %d transactionId = %v, parentTransactionId = %v", i, event["transactionId"], event["parentTransactionId"])
+			}
+		}
+	}
+}
+
+func TestCorrelationIDExtractorFillsTraceID(t *testing.T) {
+	type requestIDKey struct{}
+	client, err := NewReveniumAnthropic(&Config{
+		ReveniumAPIKey: "hak_test",
+		CorrelationIDExtractor: func(ctx context.Context) string {
+			id, _ := ctx.Value(requestIDKey{}).(string)
+			return id
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	defer client.Close()
+
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "req-123")
+	if got := client.Messages().requestMetadata(ctx)["traceId"]; got != "req-123" {
+		t.Errorf("traceId = %v, want req-123", got)
+	}
+
+	// An explicit traceId wins over the extractor
+	ctx = WithUsageMetadata(ctx, map[string]interface{}{"traceId": "trace-explicit"})
+	if got := client.Messages().requestMetadata(ctx)["traceId"]; got != "trace-explicit" {
+		t.Errorf("traceId = %v, want trace-explicit", got)
+	}
+
+	// No correlation ID, no traceId
+	if got, ok := client.Messages().requestMetadata(context.Background())["traceId"]; ok {
+		t.Errorf("traceId = %v, want none", got)
+	}
+}
+
+func TestPromptCaptureRecordsResponseIdentity(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	})
+
+	for _, capture := range []bool{false, true} {
+		meteringURL, recorder := newMeteringServer(t)
+		client := newServerClient(t, meteringURL, WithCapturePrompts(capture))
+		if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+			t.Fatalf("CreateMessage: %v", err)
+		}
+		client.Flush()
+
+		payloads := recorder.all()
+		if len(payloads) != 1 {
+			t.Fatalf("got %d meter events, want 1", len(payloads))
+		}
+		attrs, _ := payloads[0]["attributes"].(map[string]interface{})
+		if !capture {
+			if attrs["responseId"] != nil {
+				t.Errorf("responseId = %v without prompt capture, want none", attrs["responseId"])
+			}
+			continue
+		}
+		if attrs["responseId"] != "msg_1" || attrs["responseModel"] != "claude-3-5-haiku-latest" || attrs["responseRole"] != "assistant" {
+			t.Errorf("attributes = %v, want the response id, model and role", attrs)
+		}
+	}
+}
+
+func TestMeteringRequestSignerSignsFinalBody(t *testing.T) {
+	type signedRequest struct {
+		signature string
+		body      []byte
+	}
+	requests := make(chan signedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- signedRequest{r.Header.Get("X-Signature"), body}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	sign := func(body []byte) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	client := newServerClient(t, server.URL, WithMeteringRequestSigner(func(req *http.Request, body []byte) {
+		req.Header.Set("X-Signature", sign(body))
+	}))
+
+	if err := client.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"model": "test"}); err != nil {
+		t.Fatalf("sendMeteringRequest: %v", err)
+	}
+	got := <-requests
+	if got.signature == "" || got.signature != sign(got.body) {
+		t.Errorf("X-Signature = %q, want the HMAC of the sent body", got.signature)
+	}
+}
+
+func TestCacheTokensAndHitMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		usage    anthropic.Usage
+		wantHit  interface{}
+		fraction interface{}
+	}{
+		{"cache read", anthropic.Usage{InputTokens: 10, CacheCreationInputTokens: 0, CacheReadInputTokens: 30}, true, 0.75},
+		{"cache write only", anthropic.Usage{InputTokens: 10, CacheCreationInputTokens: 30}, false, 0.0},
+		{"no prompt tokens", anthropic.Usage{}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn, Usage: tt.usage}
+			payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+			if payload["cacheCreationTokenCount"] != tt.usage.CacheCreationInputTokens || payload["cacheReadTokenCount"] != tt.usage.CacheReadInputTokens {
+				t.Errorf("cache tokens = %v/%v, want %d/%d", payload["cacheCreationTokenCount"], payload["cacheReadTokenCount"], tt.usage.CacheCreationInputTokens, tt.usage.CacheReadInputTokens)
+			}
+			attrs, _ := payload["attributes"].(map[string]interface{})
+			if attrs["cacheHit"] != tt.wantHit || attrs["cachedFraction"] != tt.fraction {
+				t.Errorf("cacheHit = %v, cachedFraction = %v; want %v, %v", attrs["cacheHit"], attrs["cachedFraction"], tt.wantHit, tt.fraction)
+			}
+		})
+	}
+}
+
+func TestOperationTypeEndpointsRouteMeteringRequests(t *testing.T) {
+	paths := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := newServerClient(t, server.URL, WithOperationTypeEndpoints(map[string]string{"EMBED": "/meter/v2/ai/embeddings"}))
+	for operationType, want := range map[string]string{
+		"EMBED": "/meter/v2/ai/embeddings",
+		"CHAT":  DefaultMeteringEndpointPath,
+	} {
+		if err := client.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"operationType": operationType}); err != nil {
+			t.Fatalf("sendMeteringRequest: %v", err)
+		}
+		if got := <-paths; got != want {
+			t.Errorf("%s sent to %s, want %s", operationType, got, want)
+		}
+	}
+}
+
+func TestStreamErrorMetersErrorWithPartialTokens(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// The stream fails after the first usage update
+		writeSSE(w, sseMessageStart, sseBlockStart, sseTextDelta, sseMessageDelta, sseError)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	if sw := consumeStream(t, client, textRequest("hi")); sw.Err() == nil {
+		t.Fatal("stream did not fail")
+	}
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	payload := payloads[0]
+	if payload["stopReason"] != "ERROR" {
+		t.Errorf("stopReason = %v, want ERROR", payload["stopReason"])
+	}
+	if reason, _ := payload["errorReason"].(string); !strings.Contains(reason, "Overloaded") {
+		t.Errorf("errorReason = %q, want the stream error", reason)
+	}
+	// Tokens counted before the failure are kept (JSON numbers decode as float64)
+	if payload["inputTokenCount"] == 0.0 || payload["outputTokenCount"] != 7.0 {
+		t.Errorf("tokens = %v in, %v out; want the counts seen before the failure", payload["inputTokenCount"], payload["outputTokenCount"])
+	}
+}
+
+func TestMeteringContextIgnoresExpiredRequestDeadline(t *testing.T) {
+	m := &MessagesInterface{config: &Config{SynchronousMetering: true, MeteringTimeout: time.Minute}}
+
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	ctx, cancelMetering := m.newMeteringContext(expired)
+	defer cancelMetering()
+	if ctx.Err() != nil {
+		t.Fatalf("metering context expired with the request: %v", ctx.Err())
+	}
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) < 50*time.Second {
+		t.Errorf("metering timeout was capped by an expired deadline: %v", time.Until(deadline))
+	}
+
+	budget, cancelBudget := context.WithTimeout(context.Background(), time.Second)
+	defer cancelBudget()
+	ctx, cancelCapped := m.newMeteringContext(budget)
+	defer cancelCapped()
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) > time.Second {
+		t.Errorf("metering timeout was not capped by the remaining deadline: %v", time.Until(deadline))
+	}
+}
+
+func TestStreamingWrapperKeepsRequestContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if got := (&StreamingWrapper{ctx: ctx}).requestContext(); got != ctx {
+		t.Error("stream metering does not use the request context")
+	}
+	if got := (&StreamingWrapper{}).requestContext(); got == nil {
+		t.Error("stream without a request context returned nil")
+	}
+}
+
+func TestSynchronousMeteringSendsBeforeReturning(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithSynchronousMetering(true), WithMeteringTimeout(5*time.Second))
+
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	// No Flush: the event was sent before CreateMessage returned
+	if got := len(recorder.all()); got != 1 {
+		t.Fatalf("got %d meter events when CreateMessage returned, want 1", got)
+	}
+}
+
+func TestMeteringKillSwitchSkipsSends(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+	t.Cleanup(func() { SetMeteringEnabled(true) })
+
+	SetMeteringEnabled(false)
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	client.Flush()
+	if got := len(recorder.all()); got != 0 {
+		t.Fatalf("got %d meter events with metering disabled, want 0", got)
+	}
+	if stats := client.MeteringStats(); stats.Skipped != 1 || stats.Sent != 0 {
+		t.Errorf("stats = %+v, want 1 skipped and 0 sent", stats)
+	}
+
+	SetMeteringEnabled(true)
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	client.Flush()
+	if got := len(recorder.all()); got != 1 {
+		t.Fatalf("got %d meter events after re-enabling, want 1", got)
+	}
+	if stats := client.MeteringStats(); stats.Sent != 1 {
+		t.Errorf("Sent = %d, want 1", stats.Sent)
+	}
+}
+func TestMeteringEnabledAppliedOnlyByInitialize(t *testing.T) {
+	t.Setenv("REVENIUM_METERING_API_KEY", "hak_test")
+	t.Setenv("REVENIUM_METERING_ENABLED", "false")
+	t.Cleanup(func() {
+		Reset()
+		SetMeteringEnabled(true)
+	})
+
+	// Building a client does not touch the process-wide switch
+	cfg := &Config{ReveniumAPIKey: "hak_test"}
+	if err := cfg.loadFromEnv(); err != nil {
+		t.Fatalf("loadFromEnv: %v", err)
+	}
+	if cfg.MeteringEnabled == nil || *cfg.MeteringEnabled {
+		t.Fatalf("MeteringEnabled = %v, want false", cfg.MeteringEnabled)
+	}
+	if !IsMeteringEnabled() {
+		t.Fatal("loading the config disabled metering")
+	}
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if IsMeteringEnabled() {
+		t.Fatal("REVENIUM_METERING_ENABLED=false did not disable metering")
+	}
+
+	// true re-enables metering on the next initialization
+	Reset()
+	t.Setenv("REVENIUM_METERING_ENABLED", "true")
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if !IsMeteringEnabled() {
+		t.Error("REVENIUM_METERING_ENABLED=true did not re-enable metering")
+	}
+}
+
+func TestInitializeOptionsOverrideEnvironment(t *testing.T) {
+	t.Setenv("REVENIUM_METERING_API_KEY", "hak_from_env")
+	t.Setenv("REVENIUM_METERING_ENABLED", "false")
+	t.Cleanup(func() {
+		Reset()
+		SetMeteringEnabled(true)
+	})
+
+	if err := Initialize(WithMeteringEnabled(true), WithReveniumAPIKey("hak_from_option")); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if !IsMeteringEnabled() {
+		t.Error("REVENIUM_METERING_ENABLED=false overrode WithMeteringEnabled(true)")
+	}
+	client, err := GetClient()
+	if err != nil {
+		t.Fatalf("GetClient: %v", err)
+	}
+	if got := client.GetConfig().ReveniumAPIKey; got != "hak_from_option" {
+		t.Errorf("ReveniumAPIKey = %q, want hak_from_option", got)
+	}
+}
+
+func TestStreamStopSequenceCaptured(t *testing.T) {
+	stopDelta := `{"type":"message_delta","delta":{"stop_reason":"stop_sequence","stop_sequence":"END"},"usage":{"output_tokens":7}}`
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, sseMessageStart, sseBlockStart, sseTextDelta, sseBlockStop, stopDelta, sseMessageStop)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	consumeStream(t, client, textRequest("count until END"))
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	if payloads[0]["stopSequence"] != "END" {
+		t.Errorf("stopSequence = %v, want END", payloads[0]["stopSequence"])
+	}
+}
+
+func TestModelAliasResolvedBeforeCall(t *testing.T) {
+	models := make(chan string, 1)
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Model string `json:"model"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		models <- body.Model
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithModelAliases(map[string]string{"fast": "claude-3-5-haiku-latest"}))
+
+	params := textRequest("hello")
+	params.Model = "fast"
+	if _, err := client.Messages().CreateMessage(context.Background(), params); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	client.Flush()
+
+	if model := <-models; model != "claude-3-5-haiku-latest" {
+		t.Errorf("Anthropic was called with model %q, want the resolved alias", model)
+	}
+	if payloads := recorder.all(); len(payloads) != 1 || payloads[0]["model"] != "claude-3-5-haiku-latest" {
+		t.Errorf("meter events = %v, want one for the resolved model", payloads)
+	}
+}
+
+func TestFlushWithTimeoutReportsPendingMetering(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	})
+	release := make(chan struct{})
+	metering := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(metering.Close)
+	client := newServerClient(t, metering.URL)
+
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	err := client.FlushWithTimeout(10 * time.Millisecond)
+	if !IsMeteringError(err) {
+		t.Errorf("FlushWithTimeout with a pending send = %v, want a MeteringError", err)
+	}
+
+	close(release)
+	if err := client.FlushWithTimeout(5 * time.Second); err != nil {
+		t.Errorf("FlushWithTimeout after the send completed = %v", err)
+	}
+}
+
+func TestStreamCacheTokensReported(t *testing.T) {
+	cacheDelta := `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":7,"cache_creation_input_tokens":20,"cache_read_input_tokens":40}}`
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// Without message_start the delta's cache counts are used
+		writeSSE(w, sseBlockStart, sseTextDelta, sseBlockStop, cacheDelta, sseMessageStop)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	sw := consumeStream(t, client, textRequest("hello"))
+
+	if counts := sw.GetDetailedTokenCounts(); counts.CacheCreation != 20 || counts.CacheRead != 40 {
+		t.Errorf("token counts = %+v, want 20 cache creation and 40 cache read", counts)
+	}
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	if payloads[0]["cacheCreationTokenCount"] != 20.0 || payloads[0]["cacheReadTokenCount"] != 40.0 {
+		t.Errorf("cache tokens = %v/%v, want 20/40", payloads[0]["cacheCreationTokenCount"], payloads[0]["cacheReadTokenCount"])
+	}
+}
+
+func TestStreamStartUsageIsAuthoritative(t *testing.T) {
+	start := `{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-3-5-haiku-latest","content":[],"stop_reason":null,"usage":{"input_tokens":5,"output_tokens":1,"cache_creation_input_tokens":20,"cache_read_input_tokens":40}}}`
+	// A delta repeating different input or cache counts must not replace message_start's
+	delta := `{"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"input_tokens":99,"output_tokens":7,"cache_read_input_tokens":1}}`
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, start, sseBlockStart, sseTextDelta, sseBlockStop, delta, sseMessageStop)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	sw := consumeStream(t, client, textRequest("hello"))
+
+	want := TokenCounts{Input: 5, Output: 7, CacheCreation: 20, CacheRead: 40}
+	if counts := sw.GetDetailedTokenCounts(); counts.Input != want.Input || counts.Output != want.Output ||
+		counts.CacheCreation != want.CacheCreation || counts.CacheRead != want.CacheRead {
+		t.Errorf("token counts = %+v, want %+v", counts, want)
+	}
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	if payloads[0]["inputTokenCount"] != 5.0 || payloads[0]["cacheReadTokenCount"] != 40.0 {
+		t.Errorf("input/cache read tokens = %v/%v, want 5/40", payloads[0]["inputTokenCount"], payloads[0]["cacheReadTokenCount"])
+	}
+}
+
+func TestMeteringBodyTransformReshapesSentBody(t *testing.T) {
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithMeteringBodyTransform(func(payload map[string]interface{}) (interface{}, error) {
+		return map[string]interface{}{"event": "completion", "llmModel": payload["model"]}, nil
+	}))
+
+	if err := client.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"model": "claude-3-5-haiku-latest"}); err != nil {
+		t.Fatalf("sendMeteringRequest: %v", err)
+	}
+	payloads := recorder.all()
+	if len(payloads) != 1 || payloads[0]["llmModel"] != "claude-3-5-haiku-latest" || payloads[0]["model"] != nil {
+		t.Errorf("sent bodies = %v, want the transformed body", payloads)
+	}
+
+	failing := newServerClient(t, meteringURL, WithMeteringBodyTransform(func(map[string]interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("unsupported payload")
+	}))
+	if err := failing.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"model": "test"}); !IsValidationError(err) {
+		t.Errorf("sendMeteringRequest with a failing transform = %v, want a validation error", err)
+	}
+	if got := len(recorder.all()); got != 1 {
+		t.Errorf("got %d sends, want the failed transform not to be sent", got)
+	}
+}
+
+func TestMeteringOnlyForModelsSkipsOtherModels(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{{}, {}},
+		WithModelAliases(map[string]string{"fast": "claude-3-5-haiku-latest"}),
+		WithMeteringOnlyForModels([]string{"fast"}))
+
+	// The list entry is an alias, matched against the resolved request model
+	metered := textRequest("hello")
+	metered.Model = "fast"
+	skipped := textRequest("hello")
+	skipped.Model = "claude-sonnet-4-0"
+	for _, params := range []anthropic.MessageNewParams{metered, skipped} {
+		if _, err := client.Messages().CreateMessage(context.Background(), params); err != nil {
+			t.Fatalf("CreateMessage(%s): %v", params.Model, err)
+		}
+	}
+
+	payloads := recorder.all()
+	if len(payloads) != 1 || fmt.Sprint(payloads[0]["model"]) != "claude-3-5-haiku-latest" {
+		t.Errorf("meter events = %v, want only the claude-3-5-haiku-latest request", payloads)
+	}
+	if stats := client.MeteringStats(); stats.Skipped != 1 {
+		t.Errorf("Skipped = %d, want 1", stats.Skipped)
+	}
+}
+
+func TestRequestedModelRecordedAlongsideServedModel(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{{}},
+		WithModelAliases(map[string]string{"fast": "claude-3-5-haiku-latest"}))
+
+	params := textRequest("hello")
+	params.Model = "fast"
+	if _, err := client.Messages().CreateMessage(context.Background(), params); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	payload := recorder.all()[0]
+	if got := fmt.Sprint(payload["model"]); got != "claude-3-5-haiku-latest" {
+		t.Errorf("model = %v, want the served claude-3-5-haiku-latest", got)
+	}
+	if got := payloadAttributes(t, payload)["requestedModel"]; got != "fast" {
+		t.Errorf("requestedModel = %v, want fast", got)
+	}
+}
+
+func TestPanickingPayloadDoesNotDiscardSiblingEvents(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&payload)
+		attrs, _ := payload["attributes"].(map[string]interface{})
+		name, _ := attrs["toolName"].(string)
+		mu.Lock()
+		received = append(received, name)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var resp anthropic.Message
+	if err := json.Unmarshal([]byte(`{"content":[
+		{"type":"tool_use","id":"tu_1","name":"search","input":{}},
+		{"type":"tool_use","id":"tu_2","name":"explode","input":{}},
+		{"type":"tool_use","id":"tu_3","name":"fetch","input":{}}
+	],"stop_reason":"tool_use"}`), &resp); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	// The serializer panics on one per-tool event of the request's batch
+	serialize := func(v interface{}) ([]byte, error) {
+		if payload, ok := v.(map[string]interface{}); ok {
+			if attrs, _ := payload["attributes"].(map[string]interface{}); attrs["toolName"] == "explode" {
+				panic("unserializable payload")
+			}
+		}
+		return json.Marshal(v)
+	}
+	client, _ := newTestClient(t, []anthropic.Message{resp},
+		WithMeteringSender(nil),
+		WithReveniumBaseURL(server.URL),
+		WithPerToolMetering(true),
+		WithMeteringSerializer(serialize),
+	)
+
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hi")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"", "search", "fetch"}; strings.Join(received, ",") != strings.Join(want, ",") {
+		t.Errorf("sent events for tools %q, want %q", received, want)
+	}
+	if stats := client.MeteringStats(); stats.Sent != 3 || stats.Failed != 1 {
+		t.Errorf("stats = %d sent, %d failed; want 3 sent, 1 failed", stats.Sent, stats.Failed)
+	}
+}
+
+func TestFieldNameMapRenamesSentFields(t *testing.T) {
+	names := map[string]string{"inputTokenCount": "input_tokens", "model": "llm"}
+	tests := []struct {
+		name      string
+		opts      []Option
+		unchanged string
+	}{
+		{"camel case", []Option{WithFieldNameMap(names)}, "outputTokenCount"},
+		{"snake case", []Option{WithFieldNameMap(names), WithPayloadFieldCase(PayloadFieldCaseSnake)}, "output_token_count"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meteringURL, recorder := newMeteringServer(t)
+			client := newServerClient(t, meteringURL, tt.opts...)
+
+			payload := map[string]interface{}{"model": "claude-3-5-haiku-latest", "inputTokenCount": 3, "outputTokenCount": 2}
+			if err := client.Messages().sendMeteringRequest(context.Background(), payload); err != nil {
+				t.Fatalf("sendMeteringRequest: %v", err)
+			}
+			sent := recorder.all()[0]
+			if sent["llm"] != "claude-3-5-haiku-latest" || sent["input_tokens"] != 3.0 || sent[tt.unchanged] != 2.0 {
+				t.Errorf("sent body = %v, want llm, input_tokens and %s", sent, tt.unchanged)
+			}
+		})
+	}
+}
+
+func TestStreamClosedEarlyMetersCancelledPartialTokens(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, sseMessageStart, sseBlockStart, sseTextDelta, sseMessageDelta, sseBlockStop, sseMessageStop)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	stream, err := client.Messages().CreateMessageStream(context.Background(), textRequest("hi"))
+	if err != nil {
+		t.Fatalf("CreateMessageStream: %v", err)
+	}
+	sw := stream.(*StreamingWrapper)
+
+	// The consumer stops after the usage update, before message_stop
+	for i := 0; i < 4 && sw.Next(); i++ {
+		sw.Current()
+	}
+	sw.Close()
+	client.Flush()
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	if payloads[0]["stopReason"] != "CANCELLED" {
+		t.Errorf("stopReason = %v, want CANCELLED", payloads[0]["stopReason"])
+	}
+	if payloads[0]["outputTokenCount"] != 7.0 {
+		t.Errorf("outputTokenCount = %v, want the 7 partial tokens", payloads[0]["outputTokenCount"])
+	}
+}
+
+func TestStreamReadToCompletionIsNotCancelled(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, sseMessageStart, sseBlockStart, sseTextDelta, sseBlockStop, sseMessageDelta, sseMessageStop)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	consumeStream(t, client, textRequest("hi"))
+
+	if payloads := recorder.all(); len(payloads) != 1 || payloads[0]["stopReason"] != "END" {
+		t.Errorf("meter events = %v, want one with stopReason END", payloads)
+	}
+}
+
+func TestSnakeCasePayloadFields(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithPayloadFieldCase(PayloadFieldCaseSnake))
+
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	client.Flush()
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	if payloads[0]["input_token_count"] != 3.0 {
+		t.Errorf("input_token_count = %v, want 3", payloads[0]["input_token_count"])
+	}
+	if _, ok := payloads[0]["inputTokenCount"]; ok {
+		t.Error("camelCase key sent with snake_case casing")
+	}
+
+	cfg := &Config{}
+	WithPayloadFieldCase("kebab")(cfg)
+	if cfg.PayloadFieldCase != PayloadFieldCaseCamel {
+		t.Errorf("unknown casing resolved to %q, want camel", cfg.PayloadFieldCase)
+	}
+}
+
+func TestContextMetadataKeyLayeredBeneathUsageMetadata(t *testing.T) {
+	type appMetadataKey struct{}
+	client := newServerClient(t, "http://localhost", WithContextMetadataKey(appMetadataKey{}))
+
+	ctx := context.WithValue(context.Background(), appMetadataKey{}, map[string]string{"task_type": "summarize", "subscriber": "app"})
+	metadata := client.Messages().requestMetadata(ctx)
+	if metadata["taskType"] != "summarize" || metadata["subscriber"] != "app" {
+		t.Errorf("metadata = %v, want the application's context values normalized", metadata)
+	}
+
+	// WithUsageMetadata takes precedence over the application's key
+	ctx = WithUsageMetadata(ctx, map[string]interface{}{"taskType": "chat"})
+	if got := client.Messages().requestMetadata(ctx)["taskType"]; got != "chat" {
+		t.Errorf("taskType = %v, want chat", got)
+	}
+
+	// Unsupported value types are ignored
+	ctx = context.WithValue(context.Background(), appMetadataKey{}, "not a map")
+	if got := client.Messages().requestMetadata(ctx); len(got) != 0 {
+		t.Errorf("metadata = %v, want none", got)
+	}
+}
+
+func TestRequestIDPropagatedToAnthropicAndRevenium(t *testing.T) {
+	requestIDs := make(chan string, 1)
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		requestIDs <- r.Header.Get(RequestIDHeader)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(jsonMessage))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL)
+
+	ctx := WithRequestID(context.Background(), "req-42")
+	ctx = WithUsageMetadata(ctx, map[string]interface{}{"transactionId": "txn-metadata"})
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	client.Flush()
+
+	if id := <-requestIDs; id != "req-42" {
+		t.Errorf("%s = %q, want req-42", RequestIDHeader, id)
+	}
+	if payloads := recorder.all(); len(payloads) != 1 || payloads[0]["transactionId"] != "req-42" {
+		t.Errorf("meter events = %v, want one with transactionId req-42", payloads)
+	}
+}
+
+func TestMeteringContentTypeWithPreEncodedBody(t *testing.T) {
+	type request struct {
+		contentType string
+		body        string
+	}
+	requests := make(chan request, 1)
+	metering := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{r.Header.Get("Content-Type"), string(body)}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer metering.Close()
+
+	client := newServerClient(t, metering.URL,
+		WithMeteringContentType("application/x-ndjson"),
+		WithMeteringBodyTransform(func(payload map[string]interface{}) (interface{}, error) {
+			return fmt.Sprintf("{\"model\":%q}\n", payload["model"]), nil
+		}),
+	)
+	if err := client.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"model": "test"}); err != nil {
+		t.Fatalf("sendMeteringRequest: %v", err)
+	}
+
+	got := <-requests
+	if got.contentType != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", got.contentType)
+	}
+	if got.body != "{\"model\":\"test\"}\n" {
+		t.Errorf("body = %q, want the pre-encoded transform output", got.body)
+	}
+}
+
+// fakeStream replays canned stream events, then fails with err
+type fakeStream struct {
+	events []anthropic.MessageStreamEventUnion
+	err    error
+	index  int
+}
+
+func (f *fakeStream) Next() bool {
+	if f.index >= len(f.events) {
+		return false
+	}
+	f.index++
+	return true
+}
+
+func (f *fakeStream) Current() anthropic.MessageStreamEventUnion { return f.events[f.index-1] }
+func (f *fakeStream) Err() error                                 { return f.err }
+func (f *fakeStream) Close() error                               { return nil }
+
+func textDelta(text string) anthropic.MessageStreamEventUnion {
+	return anthropic.MessageStreamEventUnion{
+		Type:  "content_block_delta",
+		Delta: anthropic.MessageStreamEventUnionDelta{Type: "text_delta", Text: text},
+	}
+}
+
+func outputUsage(outputTokens int64) anthropic.MessageStreamEventUnion {
+	return anthropic.MessageStreamEventUnion{
+		Type:  "message_delta",
+		Usage: anthropic.MessageDeltaUsage{OutputTokens: outputTokens},
+	}
+}
+
+func TestStreamReconnectRestartsCapturedOutput(t *testing.T) {
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithCapturePrompts(true))
+	m := client.Messages()
+
+	dropped := &fakeStream{
+		events: []anthropic.MessageStreamEventUnion{textDelta("Hel"), outputUsage(2)},
+		err:    io.ErrUnexpectedEOF,
+	}
+	resumed := &fakeStream{
+		events: []anthropic.MessageStreamEventUnion{
+			textDelta("Hello"), textDelta(" world"), outputUsage(3),
+			{Type: "message_stop"},
+		},
+	}
+	params := textRequest("hi")
+	sw := &StreamingWrapper{
+		stream:        dropped,
+		ctx:           context.Background(),
+		config:        m.config,
+		metadata:      map[string]interface{}{},
+		startTime:     time.Now(),
+		messagesAPI:   m,
+		model:         string(params.Model),
+		provider:      "Anthropic",
+		params:        &params,
+		promptData:    &PromptData{},
+		reopen:        func() interface{} { return resumed },
+		maxReconnects: 1,
+	}
+
+	for sw.Next() {
+		sw.Current()
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	client.Flush()
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	payload := payloads[0]
+	if got := payload["outputResponse"]; got != "Hello world" {
+		t.Errorf("outputResponse = %q, want %q", got, "Hello world")
+	}
+	if got := payload["outputTokenCount"]; got != 5.0 {
+		t.Errorf("outputTokenCount = %v, want 5 (summed across attempts)", got)
+	}
+	attrs, _ := payload["attributes"].(map[string]interface{})
+	if got := attrs["outputCharCount"]; got != float64(len("Hello world")) {
+		t.Errorf("outputCharCount = %v, want %d", got, len("Hello world"))
+	}
+	if attrs["reconnected"] != true || attrs["reconnectCount"] != 1.0 {
+		t.Errorf("attributes = %v, want reconnected with reconnectCount 1", attrs)
+	}
+}
+
+func TestTransactionIDGeneratorCalledOncePerRequest(t *testing.T) {
+	calls := 0
+	generator := func() string {
+		calls++
+		return fmt.Sprintf("txn-%d", calls)
+	}
+	client, recorder := newTestClient(t, []anthropic.Message{{}, {}}, WithTransactionIDGenerator(generator))
+
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hi")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("generator called %d times, want 1", calls)
+	}
+	if got := recorder.all()[0]["transactionId"]; got != "txn-1" {
+		t.Errorf("transactionId = %v, want txn-1", got)
+	}
+
+	// A caller-supplied transactionId is used without calling the generator
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"transactionId": "caller-id"})
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hi")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("generator called for a caller-supplied transactionId")
+	}
+	if got := recorder.all()[1]["transactionId"]; got != "caller-id" {
+		t.Errorf("transactionId = %v, want caller-id", got)
+	}
+}
+
+func TestDefaultTransactionIDIsUUID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := generateRequestID(nil), generateRequestID(&Config{})
+	if !uuid.MatchString(first) || !uuid.MatchString(second) || first == second {
+		t.Errorf("generateRequestID = %q, %q; want distinct version 4 UUIDs", first, second)
+	}
+
+	// An empty generator result falls back to a UUID
+	empty := &Config{TransactionIDGenerator: func() string { return "" }}
+	if got := generateRequestID(empty); !uuid.MatchString(got) {
+		t.Errorf("generateRequestID with an empty generator result = %q, want a UUID", got)
+	}
+}
+
+func TestIsRetryableStreamError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{&anthropic.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{&anthropic.Error{StatusCode: http.StatusBadGateway}, true},
+		{&anthropic.Error{StatusCode: http.StatusBadRequest}, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+	}
+	for _, tt := range tests {
+		if got := isRetryableStreamError(tt.err); got != tt.want {
+			t.Errorf("isRetryableStreamError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMockProviderServesResponsesInOrder(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{
+		{Model: "claude-3-5-haiku-latest", Content: []anthropic.ContentBlockUnion{{Type: "text", Text: "first"}}, Usage: anthropic.Usage{InputTokens: 3, OutputTokens: 1}},
+		{Model: "claude-3-5-haiku-latest", Content: []anthropic.ContentBlockUnion{{Type: "text", Text: "second"}}, Usage: anthropic.Usage{InputTokens: 4, OutputTokens: 2}},
+	})
+
+	var texts []string
+	for i := 0; i < 2; i++ {
+		resp, err := client.Messages().CreateMessage(context.Background(), textRequest("hello"))
+		if err != nil {
+			t.Fatalf("CreateMessage %d: %v", i, err)
+		}
+		texts = append(texts, resp.Content[0].Text)
+	}
+	if strings.Join(texts, ",") != "first,second" {
+		t.Errorf("responses = %v, want first then second", texts)
+	}
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); !IsProviderError(err) {
+		t.Errorf("CreateMessage after the responses ran out = %v, want a provider error", err)
+	}
+
+	payloads := recorder.all()
+	if len(payloads) != 2 || payloads[0]["inputTokenCount"] != int64(3) || payloads[1]["outputTokenCount"] != int64(2) {
+		t.Errorf("meter events = %v, want one per served response with the mock usage", payloads)
+	}
+}
+
+func TestBaggageKeysForwardedAsAttributes(t *testing.T) {
+	type baggageKey struct{}
+	client, recorder := newTestClient(t, []anthropic.Message{{Model: "claude-3-5-haiku-latest"}},
+		WithBaggageKeys([]string{"tenant", "flag"}),
+		WithBaggageReader(func(ctx context.Context) map[string]string {
+			members, _ := ctx.Value(baggageKey{}).(map[string]string)
+			return members
+		}),
+	)
+
+	ctx := context.WithValue(context.Background(), baggageKey{}, map[string]string{"tenant": "acme", "session": "s-1"})
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("got %d meter events, want 1", len(payloads))
+	}
+	attrs := payloadAttributes(t, payloads[0])
+	if attrs["tenant"] != "acme" {
+		t.Errorf("tenant = %v, want acme", attrs["tenant"])
+	}
+	if _, ok := attrs["session"]; ok {
+		t.Error("unlisted baggage member was forwarded")
+	}
+}
+
+func TestStreamSummaryCallback(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, sseMessageStart, sseBlockStart, sseTextDelta, sseBlockStop, sseMessageDelta, sseMessageStop)
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	var summaries []StreamSummary
+	client := newServerClient(t, meteringURL,
+		WithStreamSummaryCallback(func(s StreamSummary) { summaries = append(summaries, s) }),
+		WithModelPricing(map[string]ModelPricing{"claude-3-5-haiku-latest": {InputPerMillion: 1_000_000, OutputPerMillion: 1_000_000}}),
+	)
+
+	sw := consumeStream(t, client, textRequest("hello"))
+	sw.Close() // A second Close does not repeat the callback
+
+	if len(summaries) != 1 {
+		t.Fatalf("callback ran %d times, want 1", len(summaries))
+	}
+	summary := summaries[0]
+	if summary.StopReason != "END" || summary.OutputTokens != 7 || summary.Err != nil {
+		t.Errorf("summary = %+v, want END with 7 output tokens", summary)
+	}
+	if want := float64(summary.InputTokens + summary.OutputTokens); summary.EstimatedCost != want {
+		t.Errorf("EstimatedCost = %v, want %v", summary.EstimatedCost, want)
+	}
+	payloads := recorder.all()
+	if len(payloads) != 1 || summary.TransactionID == "" || payloads[0]["transactionId"] != summary.TransactionID {
+		t.Errorf("summary transactionId %q does not match the meter event %v", summary.TransactionID, payloads)
+	}
+}
+
+func TestMaxImagesPerRequestRejectsBeforeCalling(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{{Model: "claude-3-5-haiku-latest"}}, WithMaxImagesPerRequest(1))
+
+	data := base64.StdEncoding.EncodeToString([]byte("png"))
+	params := textRequest("compare these")
+	params.Messages = append(params.Messages, anthropic.NewUserMessage(
+		anthropic.NewImageBlockBase64("image/png", data),
+		anthropic.NewImageBlockBase64("image/png", data),
+	))
+	if _, err := client.Messages().CreateMessage(context.Background(), params); !IsValidationError(err) {
+		t.Fatalf("CreateMessage with 2 images = %v, want a validation error", err)
+	}
+	if _, err := client.Messages().CreateMessageStream(context.Background(), params); !IsValidationError(err) {
+		t.Fatalf("CreateMessageStream with 2 images = %v, want a validation error", err)
+	}
+	if got := len(recorder.all()); got != 0 {
+		t.Errorf("got %d meter events for rejected requests, want 0", got)
+	}
+
+	// Within the limit the request goes through
+	params.Messages = params.Messages[:1]
+	if _, err := client.Messages().CreateMessage(context.Background(), params); err != nil {
+		t.Errorf("CreateMessage within the limit: %v", err)
+	}
+}
+
+func TestLatencyStatsCountsEachRequestOnce(t *testing.T) {
+	client, _ := newTestClient(t, []anthropic.Message{{Model: "claude-3-5-haiku-latest"}, {Model: "claude-3-5-haiku-latest"}})
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+			t.Fatalf("CreateMessage: %v", err)
+		}
+	}
+	if got := client.LatencyStats().Count; got != 2 {
+		t.Errorf("LatencyStats().Count = %d, want 2", got)
+	}
+}
+func TestMinimalPayloadSendsOnlyAllowlistedFields(t *testing.T) {
+	client, recorder := newTestClient(t,
+		[]anthropic.Message{{Content: []anthropic.ContentBlockUnion{{Type: "text", Text: "hi"}}, StopReason: anthropic.StopReasonEndTurn}},
+		WithMinimalPayload(true),
+		WithCapturePrompts(true),
+	)
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"organizationId": "org-1", "environment": "prod"})
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 meter event, got %d", len(payloads))
+	}
+	allowed := make(map[string]bool, len(minimalPayloadFields))
+	for _, key := range minimalPayloadFields {
+		allowed[key] = true
+	}
+	for key := range payloads[0] {
+		if !allowed[key] {
+			t.Errorf("minimal payload contains non-allowlisted field %q", key)
+		}
+	}
+	for _, key := range []string{"model", "inputTokenCount", "outputTokenCount", "transactionId"} {
+		if _, ok := payloads[0][key]; !ok {
+			t.Errorf("minimal payload is missing %q", key)
+		}
+	}
+}
+
+func TestMeteringHeaderFuncCannotOverrideRequiredHeaders(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	calls := 0
+	client := newServerClient(t, server.URL, WithMeteringHeaderFunc(func() map[string]string {
+		calls++
+		return map[string]string{"X-Proxy-Token": fmt.Sprintf("token-%d", calls), "x-api-key": "overridden"}
+	}))
+
+	if err := client.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"model": "test"}); err != nil {
+		t.Fatalf("sendMeteringRequest: %v", err)
+	}
+	got := <-headers
+	if got.Get("X-Proxy-Token") != "token-1" {
+		t.Errorf("X-Proxy-Token = %q, want token-1", got.Get("X-Proxy-Token"))
+	}
+	if got.Get("x-api-key") == "overridden" {
+		t.Error("dynamic headers overrode the Revenium API key")
+	}
+}
+
+func TestMeteringSerializerEncodesBody(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	calls := 0
+	client := newServerClient(t, server.URL, WithMeteringSerializer(func(v interface{}) ([]byte, error) {
+		calls++
+		return json.MarshalIndent(v, "", "  ")
+	}))
+
+	if err := client.Messages().sendMeteringRequest(context.Background(), map[string]interface{}{"model": "test"}); err != nil {
+		t.Fatalf("sendMeteringRequest: %v", err)
+	}
+	if body := <-bodies; calls != 1 || !strings.Contains(string(body), "\n  \"model\": \"test\"") {
+		t.Errorf("serializer called %d times, body = %s", calls, body)
+	}
+}
+
+func TestMeteringWorkersQueueWaitDoesNotConsumeTimeout(t *testing.T) {
+	slowSend := func(ctx context.Context, _ map[string]interface{}) error {
+		select {
+		case <-time.After(40 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	client, _ := newTestClient(t, []anthropic.Message{{}, {}, {}},
+		WithMeteringSender(slowSend),
+		WithMeteringWorkers(1),
+		WithMeteringTimeout(60*time.Millisecond),
+	)
+
+	// Three queued sends take ~120ms in total, longer than one metering timeout
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.Messages().CreateMessage(context.Background(), textRequest("hi"))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("CreateMessage: %v", err)
+		}
+	}
+	if stats := client.MeteringStats(); stats.Failed != 0 {
+		t.Errorf("%d queued sends timed out", stats.Failed)
+	}
+}
+
+func TestAnthropicOrganizationHeaderMetered(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(AnthropicOrganizationHeader, "org-anthropic-1")
+		w.Write([]byte(jsonMessage))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithSynchronousMetering(true))
+
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hello")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 meter event, got %d", len(payloads))
+	}
+	if got := payloadAttributes(t, payloads[0])["anthropicOrganizationId"]; got != "org-anthropic-1" {
+		t.Errorf("anthropicOrganizationId = %v, want org-anthropic-1", got)
+	}
+}
+
+func TestBedrockAndFallbackFailuresBothReported(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"bad request"}}`))
+	})
+	meteringURL, recorder := newMeteringServer(t)
+	client := newServerClient(t, meteringURL, WithMeterErrors(true), WithSynchronousMetering(true))
+
+	bedrockErr := errors.New("bedrock throttled")
+	_, err := client.Messages().fallbackToAnthropic(context.Background(), textRequest("hello"), nil, bedrockErr)
+	if err == nil {
+		t.Fatal("fallbackToAnthropic succeeded against a failing API")
+	}
+	if !errors.Is(err, bedrockErr) || !strings.Contains(err.Error(), "anthropic fallback failed") {
+		t.Errorf("error = %v, want both the Bedrock and the fallback failure", err)
+	}
+
+	payloads := recorder.all()
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 error meter event, got %d", len(payloads))
+	}
+	attrs := payloadAttributes(t, payloads[0])
+	if attrs["bedrockError"] != "bedrock throttled" || attrs["allProvidersFailed"] != true {
+		t.Errorf("attributes = %v, want bedrockError and allProvidersFailed", attrs)
+	}
+}
+
+func TestStreamCheckpointsTakenAndClosedOnce(t *testing.T) {
+	newAnthropicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeSSE(w, sseMessageStart, sseBlockStart, sseTextDelta, sseBlockStop, sseMessageDelta, sseMessageStop)
+	})
+	meteringURL, _ := newMeteringServer(t)
+	var checkpoints []StreamCheckpoint
+	client := newServerClient(t, meteringURL,
+		WithStreamCheckpoint(0, func(c StreamCheckpoint) { checkpoints = append(checkpoints, c) }),
+	)
+
+	sw := consumeStream(t, client, textRequest("hello"))
+	sw.Close() // A second Close does not repeat the final checkpoint
+
+	if len(checkpoints) < 2 {
+		t.Fatalf("got %d checkpoints, want interim ones plus the final one", len(checkpoints))
+	}
+	for _, c := range checkpoints[:len(checkpoints)-1] {
+		if c.Closed {
+			t.Error("interim checkpoint marked Closed")
+		}
+	}
+	final := checkpoints[len(checkpoints)-1]
+	if !final.Closed || final.Tokens.Output != 7 || final.OutputChars == 0 {
+		t.Errorf("final checkpoint = %+v, want Closed with 7 output tokens", final)
+	}
+	if final.TransactionID == "" || final.TransactionID != checkpoints[0].TransactionID {
+		t.Errorf("checkpoint transactionIds %q and %q differ", checkpoints[0].TransactionID, final.TransactionID)
+	}
+}
+
+func TestGlobalClientConcurrentResetInitialize(t *testing.T) {
+	t.Setenv("REVENIUM_METERING_API_KEY", "hak_test")
+	t.Cleanup(Reset)
+
+	const iterations = 50
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				if err := Initialize(); err != nil {
+					t.Errorf("Initialize: %v", err)
+					return
+				}
+				Reset()
+			}
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				// A published client is never one that is already closing
+				if client, err := GetClient(); err == nil {
+					if client.GetConfig() == nil || client.Messages() == nil {
+						t.Error("GetClient returned a partially built client")
+					}
+					client.MeteringStats()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestMinimalPayloadKeepsEnvironmentRouting(t *testing.T) {
+	var body map[string]interface{}
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		raw, _ := io.ReadAll(r.Body)
+		json.Unmarshal(raw, &body)
+	}))
+	defer server.Close()
+
+	m := &MessagesInterface{config: &Config{
+		ReveniumAPIKey:       "hak_test",
+		ReveniumBaseURL:      "https://api.revenium.invalid",
+		MinimalPayload:       true,
+		EnvironmentEndpoints: map[string]string{"staging": server.URL + "/staging"},
+	}}
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn}
+	payload := buildMeteringPayload(m.config, resp, map[string]interface{}{"environment": "staging"}, false, time.Second, "Anthropic", time.Now(), nil)
+
+	if err := m.sendMeteringRequest(context.Background(), payload); err != nil {
+		t.Fatalf("sendMeteringRequest: %v", err)
+	}
+	if !strings.HasPrefix(path, "/staging") {
+		t.Errorf("event was not routed to the staging endpoint: %q", path)
+	}
+	if _, ok := body["environment"]; ok {
+		t.Error("minimal payload still contains environment")
+	}
+}
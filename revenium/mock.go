@@ -0,0 +1,84 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// mockResponder hands out canned responses in order for ProviderMock
+type mockResponder struct {
+	mu        sync.Mutex
+	responses []anthropic.Message
+	next      int
+}
+
+// newMockResponder returns a responder for the configured responses, or nil if none
+func newMockResponder(responses []anthropic.Message) *mockResponder {
+	if len(responses) == 0 {
+		return nil
+	}
+	return &mockResponder{responses: responses}
+}
+
+// nextResponse returns a copy of the next canned response
+func (r *mockResponder) nextResponse() (*anthropic.Message, error) {
+	if r == nil {
+		return nil, NewProviderError("mock provider has no responses configured", nil)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next >= len(r.responses) {
+		return nil, NewProviderError("mock provider responses exhausted", fmt.Errorf("%d response(s) already returned", len(r.responses)))
+	}
+	resp := r.responses[r.next]
+	r.next++
+	return &resp, nil
+}
+
+// createMessageMock returns the next canned response without any network access and
+// runs the regular metering pipeline for it
+func (m *MessagesInterface) createMessageMock(ctx context.Context, params anthropic.MessageNewParams, metadata map[string]interface{}) (*MessageResult, error) {
+	startTime := time.Now()
+	metadata, transactionID := ensureTransactionID(m.config, metadata)
+
+	var promptData *PromptData
+	if m.config.CapturePrompts {
+		data := extractPromptsFromParams(params, truncationStrategy(m.config))
+		promptData = &data
+	}
+
+	resp, err := m.mock.nextResponse()
+	if err != nil {
+		m.meterFailedRequest(ctx, err, metadata, false, "Mock", startTime, &params)
+		return nil, err
+	}
+	if resp.Model == "" {
+		resp.Model = params.Model
+	}
+
+	duration := time.Since(startTime)
+
+	if promptData != nil {
+		responseData := m.extractResponseContent(resp, promptData.PromptsTruncated)
+		promptData.OutputResponse = responseData.OutputResponse
+		promptData.PromptsTruncated = responseData.PromptsTruncated
+		promptData.OutputResponseTruncated = responseData.OutputResponseTruncated
+		promptData.ResponseID = responseData.ResponseID
+		promptData.ResponseModel = responseData.ResponseModel
+		promptData.ResponseRole = responseData.ResponseRole
+		promptData.ToolCalls = responseData.ToolCalls
+	}
+
+	m.goMetering(string(params.Model), func() {
+		m.sendMeteringDataWithPrompts(ctx, resp, metadata, false, duration, "Mock", startTime, &params, promptData)
+	})
+
+	m.counters.recordRequest(duration)
+
+	return newMessageResult(m.config, resp, "Mock", duration, transactionID), nil
+}
@@ -0,0 +1,70 @@
+package revenium_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/revenium/revenium-middleware-anthropic-go/revenium"
+)
+
+func ExampleWithMockResponses() {
+	var mu sync.Mutex
+	var events []map[string]interface{}
+	sender := func(ctx context.Context, payload map[string]interface{}) error {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, payload)
+		return nil
+	}
+
+	cfg := &revenium.Config{}
+	for _, opt := range []revenium.Option{
+		revenium.WithReveniumAPIKey("hak_test_key"),
+		revenium.WithMockResponses([]anthropic.Message{{
+			ID:         "msg_mock_1",
+			Role:       "assistant",
+			Model:      "claude-sonnet-4-20250514",
+			StopReason: anthropic.StopReasonEndTurn,
+			Content:    []anthropic.ContentBlockUnion{{Type: "text", Text: "Hola!"}},
+			Usage:      anthropic.Usage{InputTokens: 12, OutputTokens: 3},
+		}}),
+		revenium.WithMeteringSender(sender),
+		revenium.WithSynchronousMetering(true),
+	} {
+		opt(cfg)
+	}
+
+	client, err := revenium.NewReveniumAnthropic(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer client.Close()
+
+	ctx := revenium.WithUsageMetadata(context.Background(), map[string]interface{}{
+		"organizationId": "org-mock-example",
+	})
+	resp, err := client.Messages().CreateMessage(ctx, anthropic.MessageNewParams{
+		Model:     "claude-sonnet-4-20250514",
+		MaxTokens: 100,
+		Messages: []anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewTextBlock("Say hello in Spanish")),
+		},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(resp.Content[0].Text)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, event := range events {
+		fmt.Println(event["model"], event["inputTokenCount"], event["outputTokenCount"], event["organizationId"])
+	}
+	// Output:
+	// Hola!
+	// claude-sonnet-4-20250514 12 3 org-mock-example
+}
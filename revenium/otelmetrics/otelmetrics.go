@@ -0,0 +1,145 @@
+// Package otelmetrics records Revenium meter events as OpenTelemetry metrics.
+//
+// It lives in its own package so the core middleware takes no OpenTelemetry
+// dependency; only applications that import it pull in the OTel API:
+//
+//	recorder, err := otelmetrics.NewRecorder(otel.GetMeterProvider())
+//	if err != nil { ... }
+//	revenium.Initialize(revenium.WithMetricsRecorder(recorder, false))
+package otelmetrics
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/revenium/revenium-middleware-anthropic-go/revenium"
+)
+
+// meterName identifies the instrumentation scope of the recorded instruments
+const meterName = "github.com/revenium/revenium-middleware-anthropic-go"
+
+// instrumentUnits are the units of the known instruments; other names have none
+var instrumentUnits = map[string]string{
+	revenium.MetricInputTokens:         "{token}",
+	revenium.MetricOutputTokens:        "{token}",
+	revenium.MetricCacheCreationTokens: "{token}",
+	revenium.MetricCacheReadTokens:     "{token}",
+	revenium.MetricRequests:            "{request}",
+	revenium.MetricRequestDuration:     "ms",
+	revenium.MetricTimeToFirstToken:    "ms",
+}
+
+// Recorder is a revenium.MetricsRecorder backed by an OpenTelemetry Meter
+type Recorder struct {
+	meter metric.Meter
+
+	mu         sync.RWMutex
+	counters   map[string]metric.Int64Counter
+	histograms map[string]metric.Float64Histogram
+}
+
+var _ revenium.MetricsRecorder = (*Recorder)(nil)
+
+// NewRecorder creates the revenium.* instruments (revenium.tokens.input,
+// revenium.tokens.output, revenium.request.duration, ...) on a Meter from provider
+func NewRecorder(provider metric.MeterProvider) (*Recorder, error) {
+	r := &Recorder{
+		meter:      provider.Meter(meterName),
+		counters:   make(map[string]metric.Int64Counter),
+		histograms: make(map[string]metric.Float64Histogram),
+	}
+
+	for _, name := range []string{
+		revenium.MetricInputTokens,
+		revenium.MetricOutputTokens,
+		revenium.MetricCacheCreationTokens,
+		revenium.MetricCacheReadTokens,
+		revenium.MetricRequests,
+	} {
+		if _, err := r.counter(name); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range []string{revenium.MetricRequestDuration, revenium.MetricTimeToFirstToken} {
+		if _, err := r.histogram(name); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// AddCounter adds value to the named Int64Counter
+func (r *Recorder) AddCounter(ctx context.Context, name string, value int64, attrs map[string]string) {
+	counter, err := r.counter(name)
+	if err != nil {
+		revenium.Debug("Failed to create OTel counter %s: %v", name, err)
+		return
+	}
+	counter.Add(ctx, value, metric.WithAttributes(keyValues(attrs)...))
+}
+
+// RecordHistogram records value in the named Float64Histogram
+func (r *Recorder) RecordHistogram(ctx context.Context, name string, value float64, attrs map[string]string) {
+	histogram, err := r.histogram(name)
+	if err != nil {
+		revenium.Debug("Failed to create OTel histogram %s: %v", name, err)
+		return
+	}
+	histogram.Record(ctx, value, metric.WithAttributes(keyValues(attrs)...))
+}
+
+// counter returns the named counter, creating it on first use
+func (r *Recorder) counter(name string) (metric.Int64Counter, error) {
+	r.mu.RLock()
+	counter, ok := r.counters[name]
+	r.mu.RUnlock()
+	if ok {
+		return counter, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if counter, ok := r.counters[name]; ok {
+		return counter, nil
+	}
+	counter, err := r.meter.Int64Counter(name, metric.WithUnit(instrumentUnits[name]))
+	if err != nil {
+		return nil, err
+	}
+	r.counters[name] = counter
+	return counter, nil
+}
+
+// histogram returns the named histogram, creating it on first use
+func (r *Recorder) histogram(name string) (metric.Float64Histogram, error) {
+	r.mu.RLock()
+	histogram, ok := r.histograms[name]
+	r.mu.RUnlock()
+	if ok {
+		return histogram, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if histogram, ok := r.histograms[name]; ok {
+		return histogram, nil
+	}
+	histogram, err := r.meter.Float64Histogram(name, metric.WithUnit(instrumentUnits[name]))
+	if err != nil {
+		return nil, err
+	}
+	r.histograms[name] = histogram
+	return histogram, nil
+}
+
+// keyValues converts measurement attributes to OTel key-values
+func keyValues(attrs map[string]string) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for key, value := range attrs {
+		kvs = append(kvs, attribute.String(key, value))
+	}
+	return kvs
+}
@@ -0,0 +1,91 @@
+package otelmetrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+
+	"github.com/revenium/revenium-middleware-anthropic-go/revenium"
+)
+
+func TestRecorderCapturesMeasurements(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	provider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	recorder, err := NewRecorder(provider)
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+
+	sent := 0
+	cfg := &revenium.Config{ReveniumAPIKey: "hak_test"}
+	for _, opt := range []revenium.Option{
+		revenium.WithMockResponses([]anthropic.Message{{Usage: anthropic.Usage{InputTokens: 12, OutputTokens: 5}}}),
+		revenium.WithSynchronousMetering(true),
+		revenium.WithMeteringSender(func(context.Context, map[string]interface{}) error {
+			sent++
+			return nil
+		}),
+		revenium.WithMetricsRecorder(recorder, true),
+	} {
+		opt(cfg)
+	}
+	client, err := revenium.NewReveniumAnthropic(cfg)
+	if err != nil {
+		t.Fatalf("NewReveniumAnthropic: %v", err)
+	}
+	defer client.Close()
+
+	_, err = client.Messages().CreateMessage(context.Background(), anthropic.MessageNewParams{
+		Model:     "claude-3-5-haiku-latest",
+		MaxTokens: 16,
+		Messages:  []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock("hi"))},
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	if sent != 0 {
+		t.Errorf("metrics-only mode sent %d events over HTTP", sent)
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("Collect: %v", err)
+	}
+	sums := map[string]int64{}
+	durations := 0
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Sum[int64]:
+				for _, point := range data.DataPoints {
+					sums[m.Name] += point.Value
+					if model, _ := point.Attributes.Value("model"); model.AsString() != "claude-3-5-haiku-latest" {
+						t.Errorf("%s model attribute = %q", m.Name, model.AsString())
+					}
+				}
+			case metricdata.Histogram[float64]:
+				if m.Name == revenium.MetricRequestDuration {
+					for _, point := range data.DataPoints {
+						durations += int(point.Count)
+					}
+				}
+			}
+		}
+	}
+
+	for name, want := range map[string]int64{
+		revenium.MetricRequests:     1,
+		revenium.MetricInputTokens:  12,
+		revenium.MetricOutputTokens: 5,
+	} {
+		if sums[name] != want {
+			t.Errorf("%s = %d, want %d", name, sums[name], want)
+		}
+	}
+	if durations != 1 {
+		t.Errorf("%s recorded %d times, want 1", revenium.MetricRequestDuration, durations)
+	}
+}
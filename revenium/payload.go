@@ -0,0 +1,578 @@
+package revenium
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// Metering payloads are built by an ordered pipeline of enrichers. Each stage may
+// override what earlier stages wrote, so the precedence, lowest to highest, is:
+//
+//  1. required   - billing fields computed from the response and timing
+//  2. metadata   - metadata layers resolved beneath the request's own metadata
+//     (global defaults < model defaults < auto-detected environment < request),
+//     then copied onto the payload, where errorReason forces stopReason to ERROR
+//  3. computed   - analytics attributes derived from the request and response
+//  4. overrides  - after buildMeteringPayload returns, streaming and failure paths
+//     override fields (timeToFirstToken, stopReason, token counts) and prompt
+//     capture fields and send-time attributes (meteringQueueWaitMs) are added
+//  5. intercept  - WithPayloadInterceptor hooks, in registration order
+//  6. blocklist  - WithMetadataBlocklist keys are stripped, whichever stage set them
+//
+// Stages 1-3 run in buildMeteringPayload; stages 5 and 6 run in finalizePayload,
+// immediately before the payload is sent, so they see every field that is sent.
+
+// payloadBuild carries the inputs and the payload under construction through the pipeline
+type payloadBuild struct {
+	cfg        *Config
+	resp       *anthropic.Message
+	params     *anthropic.MessageNewParams
+	metadata   map[string]interface{}
+	isStreamed bool
+	duration   time.Duration
+	provider   string // Internal provider name ("Anthropic", "AWS", "Mock")
+	startTime  time.Time
+	model      string // Response model, or the requested model when the response has none
+
+	payload map[string]interface{}
+}
+
+// payloadEnricher is one stage of the payload pipeline
+type payloadEnricher func(b *payloadBuild)
+
+// meteringPayloadPipeline lists the enrichers in precedence order (see above)
+var meteringPayloadPipeline = []payloadEnricher{
+	enrichRequiredFields,
+	enrichMetadata,
+	enrichResponseAnalytics,
+	enrichModelAttributes,
+	enrichProviderAttributes,
+	enrichForwardedAttributes,
+	enrichRequestShape,
+	enrichVision,
+	enrichConfigFingerprint,
+}
+
+// buildMeteringPayload builds a metering payload, matching Node.js format exactly
+func buildMeteringPayload(cfg *Config, resp *anthropic.Message, metadata map[string]interface{}, isStreamed bool, duration time.Duration, provider string, startTime time.Time, params *anthropic.MessageNewParams) map[string]interface{} {
+	model := string(resp.Model)
+	if model == "" && params != nil {
+		model = string(params.Model)
+	}
+
+	b := &payloadBuild{
+		cfg:        cfg,
+		resp:       resp,
+		params:     params,
+		metadata:   metadata,
+		isStreamed: isStreamed,
+		duration:   duration,
+		provider:   provider,
+		startTime:  startTime,
+		model:      model,
+	}
+	for _, enrich := range meteringPayloadPipeline {
+		enrich(b)
+	}
+	return b.payload
+}
+
+// enrichRequiredFields starts the payload with the required billing fields
+func enrichRequiredFields(b *payloadBuild) {
+	resp := b.resp
+
+	// Calculate actual timestamps based on request timing
+	requestTimeISO := b.startTime.Format(meteringTimeFormat)
+	responseTime := b.startTime.Add(b.duration)
+	responseTimeISO := responseTime.Format(meteringTimeFormat)
+	completionStartTimeISO := b.startTime.Format(meteringTimeFormat) // For non-streaming, completion starts immediately
+
+	// Normalize provider name to match Revenium spec
+	normalizedProvider := resolveProviderName(b.cfg, b.provider)
+
+	// Map stop reason with fallback to END
+	stopReason := "END" // Default fallback
+	if resp.StopReason != "" {
+		stopReason = mapStopReasonToRevenium(string(resp.StopReason))
+	} else {
+		// Log when stop reason is empty (helps identify API changes or issues)
+		Debug("Stop reason is empty, defaulting to END")
+	}
+
+	// Start with required fields only (matching Node.js buildReveniumPayload);
+	// transactionId is taken from metadata or generated by enrichMetadata
+	b.payload = map[string]interface{}{
+		"stopReason":              stopReason,
+		"costType":                "AI",
+		"isStreamed":              b.isStreamed,
+		"operationType":           "CHAT",
+		"inputTokenCount":         resp.Usage.InputTokens,
+		"outputTokenCount":        resp.Usage.OutputTokens,
+		"reasoningTokenCount":     int64(0), // Always 0 for Anthropic (no extended thinking)
+		"cacheCreationTokenCount": resp.Usage.CacheCreationInputTokens,
+		"cacheReadTokenCount":     resp.Usage.CacheReadInputTokens,
+		"totalTokenCount":         resp.Usage.InputTokens + resp.Usage.OutputTokens,
+		"model":                   resp.Model,
+		"responseTime":            responseTimeISO,
+		"requestDuration":         b.duration.Milliseconds(),
+		"provider":                normalizedProvider,
+		"requestTime":             requestTimeISO,
+		"completionStartTime":     completionStartTimeISO,
+		"timeToFirstToken":        int64(0), // Will be overridden for streaming
+		"middlewareSource":        GetMiddlewareSource(),
+	}
+
+	// Record which custom stop sequence ended the response
+	if resp.StopSequence != "" {
+		b.payload["stopSequence"] = resp.StopSequence
+	}
+
+	// Label the call path; isStreamed is kept for back-compat
+	mode := CompletionModeBlocking
+	if b.isStreamed {
+		mode = CompletionModeStreaming
+	}
+	setPayloadAttribute(b.payload, "completionMode", mode)
+}
+
+// Values of the completionMode attribute
+const (
+	CompletionModeStreaming = "streaming" // Streamed responses (Anthropic or Bedrock)
+	CompletionModeBlocking  = "blocking"  // Non-streaming requests, including Bedrock fallbacks
+	CompletionModeBatch     = "batch"     // Reserved for batch submissions
+)
+
+// payloadMetadataFields are the metadata keys copied onto the top level of the payload
+// (based on testing with Revenium API). operationType is fixed to "CHAT" and is never
+// taken from metadata (the API only accepts CHAT, GENERATE, EMBED, CLASSIFY,
+// SUMMARIZE, TRANSLATE, OTHER); operationSubtype is auto-detected, not user-provided
+var payloadMetadataFields = []string{
+	// Business context fields (tested individually with Revenium API)
+	"organizationId",
+	"productId",
+	"taskType",
+	"agent",
+	"subscriptionId",
+	"traceId",
+	"subscriber", // must be an object with nested structure (not a string)
+	"taskId",
+	"responseQualityScore",
+
+	// Trace visualization fields (10 fields for distributed tracing)
+	"transactionId",
+	"traceType",
+	"traceName",
+	"environment",
+	"region",
+	"retryNumber",
+	"credentialAlias",
+	"parentTransactionId",
+
+	// Optional fields from Revenium spec (meter_ai_completion.md)
+	"modelSource",
+	"mediationLatency",
+	"temperature",
+	"systemFingerprint",
+
+	// Cost override fields (typically null to let Revenium calculate)
+	"inputTokenCost",
+	"outputTokenCost",
+	"cacheCreationTokenCost",
+	"cacheReadTokenCost",
+	"totalCost",
+}
+
+// enrichMetadata resolves metadata defaults beneath the request metadata, drops
+// blocklisted keys, and copies the recognized fields onto the payload
+func enrichMetadata(b *payloadBuild) {
+	b.metadata = resolveMetadataDefaults(b.cfg, b.model, NormalizeMetadataKeys(b.metadata))
+	b.metadata = filterBlocklistedMetadata(b.cfg, b.metadata)
+
+	// Generate a transactionId only when metadata does not supply one, so custom
+	// generators (e.g. sequence-based Snowflake IDs) are not called needlessly
+	if _, ok := b.metadata["transactionId"]; !ok {
+		b.payload["transactionId"] = generateRequestID(b.cfg)
+	}
+	if b.metadata == nil {
+		return
+	}
+
+	for _, key := range payloadMetadataFields {
+		if value, ok := b.metadata[key]; ok {
+			b.payload[key] = value
+		}
+	}
+
+	// Keep the quality score within the 0.0-1.0 range Revenium accepts
+	if value, ok := b.payload["responseQualityScore"]; ok {
+		if score, ok := normalizeQualityScore(value); ok {
+			b.payload["responseQualityScore"] = score
+		} else {
+			delete(b.payload, "responseQualityScore")
+		}
+	}
+
+	// Error tracking
+	if errorReason, ok := b.metadata["errorReason"]; ok {
+		b.payload["errorReason"] = errorReason
+		b.payload["stopReason"] = "ERROR" // Override stop reason if error occurred
+
+		// The Anthropic fallback failed after Bedrock did: record both failures
+		if bedrockErr, ok := b.metadata["bedrockError"]; ok {
+			setPayloadAttribute(b.payload, "bedrockError", bedrockErr)
+			setPayloadAttribute(b.payload, "allProvidersFailed", true)
+		}
+	}
+}
+
+// normalizeQualityScore converts a responseQualityScore to a float64 clamped to
+// 0.0-1.0, warning when it was out of range. Non-numeric values are rejected
+func normalizeQualityScore(value interface{}) (float64, bool) {
+	var score float64
+	if v, ok := value.(json.Number); ok {
+		parsed, err := v.Float64()
+		if err != nil {
+			Warn("Ignoring non-numeric responseQualityScore %q", v)
+			return 0, false
+		}
+		score = parsed
+	} else {
+		// Kind checks cover every sized and named numeric type
+		rv := reflect.ValueOf(value)
+		switch rv.Kind() {
+		case reflect.Float32, reflect.Float64:
+			score = rv.Float()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			score = float64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			score = float64(rv.Uint())
+		default:
+			Warn("Ignoring non-numeric responseQualityScore %v (%T)", value, value)
+			return 0, false
+		}
+	}
+
+	if math.IsNaN(score) {
+		Warn("Ignoring NaN responseQualityScore")
+		return 0, false
+	}
+	if score < 0 || score > 1 {
+		clamped := math.Max(0, math.Min(1, score))
+		Warn("responseQualityScore %v is outside 0.0-1.0, clamping to %v", score, clamped)
+		score = clamped
+	}
+	return score, true
+}
+
+// outputTokensPerSecond computes generation throughput, reporting false when there
+// are no output tokens or no measurable generation time
+func outputTokensPerSecond(outputTokens int64, generation time.Duration) (float64, bool) {
+	if outputTokens <= 0 || generation <= 0 {
+		return 0, false
+	}
+	return float64(outputTokens) / generation.Seconds(), true
+}
+
+// enrichResponseAnalytics adds attributes describing the response: empty responses,
+// prompt cache effectiveness and citations
+func enrichResponseAnalytics(b *payloadBuild) {
+	resp, payload := b.resp, b.payload
+
+	// Flag empty responses (e.g., a refusal or bare stop) so quality dashboards surface them.
+	// Failed and cancelled requests are excluded by their raw stop reason and errorReason,
+	// not the mapped stopReason, because refusals also map to ERROR.
+	// Streaming payloads are built without response content, so they are not checked here
+	_, failed := payload["errorReason"]
+	aborted := resp.StopReason == "error" || resp.StopReason == "cancelled" || resp.StopReason == "canceled"
+	if !b.isStreamed && !failed && !aborted && isEmptyResponse(resp) {
+		setPayloadAttribute(payload, "emptyResponse", true)
+		if _, ok := payload["responseQualityScore"]; !ok {
+			payload["responseQualityScore"] = 0.0
+		}
+	}
+
+	// Throughput over the whole request; streaming payloads exclude time-to-first-token
+	// and are computed when the stream closes
+	if !b.isStreamed {
+		if tps, ok := outputTokensPerSecond(resp.Usage.OutputTokens, b.duration); ok {
+			setPayloadAttribute(payload, "outputTokensPerSecond", tps)
+		}
+	}
+
+	// Both max_tokens and context window overflows map to TOKEN_LIMIT; flag the more
+	// serious overflow so it can be alerted on separately
+	if resp.StopReason == "model_context_window_exceeded" {
+		setPayloadAttribute(payload, "contextWindowExceeded", true)
+	}
+
+	// Safety refusals map to ERROR for back-compat; flag them so refusal rates can be
+	// tracked separately from real failures
+	if resp.StopReason == anthropic.StopReasonRefusal {
+		setPayloadAttribute(payload, "refusal", true)
+	}
+
+	// Prompt cache effectiveness: a hit is any request that read from the cache.
+	// Anthropic reports cached tokens separately from input_tokens, so the cached
+	// fraction is taken over all prompt tokens to keep it within 0.0-1.0
+	promptTokens := resp.Usage.InputTokens + resp.Usage.CacheCreationInputTokens + resp.Usage.CacheReadInputTokens
+	if promptTokens > 0 {
+		setPayloadAttribute(payload, "cacheHit", resp.Usage.CacheReadInputTokens > 0)
+		setPayloadAttribute(payload, "cachedFraction", float64(resp.Usage.CacheReadInputTokens)/float64(promptTokens))
+	}
+
+	// A cache write with no read on the same request only pays off if later requests
+	// read it; flag it so cache thrash can be investigated across requests
+	if resp.Usage.CacheCreationInputTokens > 0 && resp.Usage.CacheReadInputTokens == 0 {
+		setPayloadAttribute(payload, "cacheCreatedNoRead", true)
+	}
+
+	// Estimate the dollars saved by cache reads using the configured price table
+	if resp.Usage.CacheReadInputTokens > 0 {
+		if pricing, ok := lookupModelPricing(b.cfg, b.provider, b.model); ok {
+			if savings := estimateCacheSavings(pricing, resp.Usage.CacheReadInputTokens); savings > 0 {
+				setPayloadAttribute(payload, "estimatedCacheSavings", savings)
+			}
+		}
+	}
+
+	// Detect citations in the response (text blocks carrying citations)
+	if citationCount := countCitations(resp); citationCount > 0 {
+		setPayloadAttribute(payload, "hasCitations", true)
+		setPayloadAttribute(payload, "citationCount", citationCount)
+	}
+}
+
+// enrichModelAttributes adds the normalized model family for grouping across versions
+func enrichModelAttributes(b *payloadBuild) {
+	if family := detectModelFamily(b.model); family != "" {
+		setPayloadAttribute(b.payload, "modelFamily", family)
+	}
+}
+
+// enrichProviderAttributes adds provider-specific attribution
+func enrichProviderAttributes(b *payloadBuild) {
+	// Attribute Bedrock usage to the AWS account and inference profile in the model ARN
+	if b.provider != "AWS" {
+		return
+	}
+	bedrockModel := b.model
+	if b.params != nil {
+		bedrockModel = string(b.params.Model)
+	}
+	accountID, inferenceProfile := ParseBedrockARN(GetBedrockModelID(bedrockModel, b.cfg))
+	if accountID != "" {
+		setPayloadAttribute(b.payload, "awsAccountId", accountID)
+	}
+	if inferenceProfile != "" {
+		setPayloadAttribute(b.payload, "bedrockInferenceProfile", inferenceProfile)
+	}
+}
+
+// enrichForwardedAttributes adds attributes carried in metadata from the request
+// context and the provider response
+func enrichForwardedAttributes(b *payloadBuild) {
+	// Attach forwarded baggage members (see WithBaggageKeys) as attributes
+	if baggage, ok := b.metadata["baggage"].(map[string]string); ok {
+		for key, value := range baggage {
+			setPayloadAttribute(b.payload, key, value)
+		}
+	}
+
+	// Attribute the request to its origin (see WithRequestSource)
+	if source, ok := b.metadata["source"].(string); ok {
+		if source = sanitizeSource(source); source != "" {
+			setPayloadAttribute(b.payload, "source", source)
+			if ip := normalizeClientIP(source); ip != "" {
+				setPayloadAttribute(b.payload, "clientIp", ip)
+			}
+		}
+	}
+	if clientIP, ok := b.metadata["clientIp"].(string); ok {
+		if ip := normalizeClientIP(clientIP); ip != "" {
+			setPayloadAttribute(b.payload, "clientIp", ip)
+		} else {
+			Debug("Ignoring invalid clientIp metadata %q", clientIP)
+		}
+	}
+
+	// Correlate with the Anthropic organization reported in the response headers
+	if orgID, ok := b.metadata["anthropicOrganizationId"].(string); ok && orgID != "" {
+		setPayloadAttribute(b.payload, "anthropicOrganizationId", orgID)
+	}
+
+	// Record the model as requested, before alias resolution and Bedrock conversion;
+	// the top-level model is the served one
+	if requested, ok := b.metadata["requestedModel"].(string); ok && requested != "" {
+		setPayloadAttribute(b.payload, "requestedModel", requested)
+	}
+
+	// Surface requests replayed within the dedup window (see WithRequestDedup)
+	if duplicate, _ := b.metadata["duplicateRequest"].(bool); duplicate {
+		setPayloadAttribute(b.payload, "duplicateRequest", true)
+	}
+}
+
+// maxSourceLength bounds the metered source identifier
+const maxSourceLength = 256
+
+// sanitizeSource trims a source identifier, drops control characters and caps its length
+func sanitizeSource(source string) string {
+	source = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(source))
+	if len(source) > maxSourceLength {
+		source = truncateUTF8Safe(source, maxSourceLength)
+	}
+	return source
+}
+
+// normalizeClientIP returns the canonical form of an IP address, optionally with a
+// port ("203.0.113.7:443", "[2001:db8::1]:443"), or "" when value is not an IP
+func normalizeClientIP(value string) string {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// enrichRequestShape adds attributes describing the request's size and structure.
+// No prompt text is sent, so these apply regardless of CapturePrompts
+func enrichRequestShape(b *payloadBuild) {
+	resp, params, payload := b.resp, b.params, b.payload
+
+	// Response-derived attributes first; the remaining ones need the request params
+	if b.cfg != nil && len(b.cfg.GuardToolNames) > 0 && guardToolInvoked(b.cfg.GuardToolNames, params, resp) {
+		setPayloadAttribute(payload, "guardToolInvoked", true)
+	}
+	if outputChars := countOutputChars(resp); outputChars > 0 {
+		setPayloadAttribute(payload, "outputCharCount", outputChars)
+	}
+	if len(resp.Content) > 0 {
+		if size := jsonSize(resp.Content); size > 0 {
+			setPayloadAttribute(payload, "responseSizeBytes", size)
+		}
+	}
+
+	if params == nil {
+		return
+	}
+
+	// Record the extended thinking budget for reasoning cost forecasting
+	if params.Thinking.OfEnabled != nil {
+		setPayloadAttribute(payload, "extendedThinking", true)
+		setPayloadAttribute(payload, "thinkingBudgetTokens", params.Thinking.OfEnabled.BudgetTokens)
+	}
+
+	// Record the max_tokens ceiling and whether the response ran into it
+	if params.MaxTokens > 0 {
+		setPayloadAttribute(payload, "maxTokensRequested", params.MaxTokens)
+		setPayloadAttribute(payload, "maxTokensReached", resp.StopReason == anthropic.StopReasonMaxTokens || resp.Usage.OutputTokens >= params.MaxTokens)
+	}
+
+	// Record character counts as a tokenizer-independent size signal
+	if inputChars := countInputChars(*params); inputChars > 0 {
+		setPayloadAttribute(payload, "inputCharCount", inputChars)
+	}
+
+	// Record system prompt overhead
+	if systemChars := utf8.RuneCountInString(extractSystemContent(params.System)); systemChars > 0 {
+		setPayloadAttribute(payload, "systemPromptLength", systemChars)
+		setPayloadAttribute(payload, "systemPromptTokenEstimate", estimateTextTokens(systemChars))
+	}
+
+	// Record conversation length for cost-vs-length analytics
+	if len(params.Messages) > 0 {
+		setPayloadAttribute(payload, "messageCount", len(params.Messages))
+		setPayloadAttribute(payload, "turnCount", countTurns(params.Messages))
+
+		// An agent loop follow-up carries tool results to get the final answer; the
+		// caller links it to the prior call through parentTransactionId metadata
+		last := params.Messages[len(params.Messages)-1:]
+		if len(extractToolResultIDs(last)) > 0 {
+			setPayloadAttribute(payload, "isToolContinuation", true)
+		}
+
+		// A trailing assistant message prefills the start of the response to steer it
+		if last[0].Role == anthropic.MessageParamRoleAssistant {
+			setPayloadAttribute(payload, "usedPrefill", true)
+		}
+	}
+
+	// Record tool definition overhead for agent-style requests
+	if mode := toolChoiceMode(params); len(params.Tools) > 0 || mode != "" {
+		setPayloadAttribute(payload, "toolDefinitionCount", len(params.Tools))
+		if mode == "" {
+			mode = "auto" // API default when tools are provided without tool_choice
+		}
+		setPayloadAttribute(payload, "toolChoiceMode", mode)
+	}
+
+	// Fingerprint the request over a canonical serialization for deduplication, and
+	// record its serialized size for payload analytics. Both are computed once per
+	// request by fingerprintRequest; payloads built without them compute them here
+	fingerprint, _ := b.metadata["inputFingerprint"].(string)
+	size, _ := b.metadata["requestSizeBytes"].(int)
+	if fingerprint == "" {
+		var err error
+		if fingerprint, size, err = requestFingerprint(*params); err != nil {
+			Debug("Failed to compute input fingerprint: %v", err)
+		}
+	}
+	if fingerprint != "" {
+		setPayloadAttribute(payload, "inputFingerprint", fingerprint)
+	}
+	if size > 0 {
+		setPayloadAttribute(payload, "requestSizeBytes", size)
+	}
+}
+
+// enrichVision adds vision attributes when the request contains images
+func enrichVision(b *payloadBuild) {
+	if b.params == nil {
+		return
+	}
+	visionResult := DetectVisionContent(*b.params)
+	if !visionResult.HasVisionContent {
+		return
+	}
+	b.payload["hasVisionContent"] = true
+	for key, value := range BuildVisionAttributes(visionResult) {
+		setPayloadAttribute(b.payload, key, value)
+	}
+}
+
+// enrichConfigFingerprint tags the event with the configuration version (see WithConfigFingerprint)
+func enrichConfigFingerprint(b *payloadBuild) {
+	if b.cfg == nil || !b.cfg.ConfigFingerprint || b.cfg.fingerprint == "" {
+		return
+	}
+	setPayloadAttribute(b.payload, "configFingerprint", b.cfg.fingerprint)
+}
+
+// finalizePayload runs the last pipeline stages on a fully assembled payload right
+// before it is sent: WithPayloadInterceptor hooks, then the blocklist safety net, so
+// blocklisted keys never leave the process wherever they were set
+func finalizePayload(cfg *Config, payload map[string]interface{}) {
+	if cfg == nil {
+		return
+	}
+	for _, intercept := range cfg.PayloadInterceptors {
+		intercept(payload)
+	}
+	stripBlocklistedFields(cfg, payload)
+}
@@ -0,0 +1,684 @@
+package revenium
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// payloadAttributes returns the attributes map of a built payload
+func payloadAttributes(t *testing.T, payload map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	attrs, _ := payload["attributes"].(map[string]interface{})
+	if attrs == nil {
+		return map[string]interface{}{}
+	}
+	return attrs
+}
+
+func TestEmptyRefusalIsFlagged(t *testing.T) {
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonRefusal}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+
+	if payload["stopReason"] != "ERROR" {
+		t.Errorf("stopReason = %v, want ERROR", payload["stopReason"])
+	}
+	if attrs := payloadAttributes(t, payload); attrs["emptyResponse"] != true {
+		t.Errorf("empty refusal not flagged: %v", attrs)
+	}
+	if payload["responseQualityScore"] != 0.0 {
+		t.Errorf("responseQualityScore = %v, want 0", payload["responseQualityScore"])
+	}
+}
+
+func TestFailedRequestIsNotFlaggedEmpty(t *testing.T) {
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn}
+	metadata := map[string]interface{}{"errorReason": "upstream failure"}
+	payload := buildMeteringPayload(&Config{}, resp, metadata, false, time.Second, "Anthropic", time.Now(), nil)
+
+	if _, ok := payloadAttributes(t, payload)["emptyResponse"]; ok {
+		t.Error("failed request was flagged as an empty response")
+	}
+}
+
+func TestCancelledRequestIsNotFlaggedEmpty(t *testing.T) {
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: "cancelled"}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+
+	if _, ok := payloadAttributes(t, payload)["emptyResponse"]; ok {
+		t.Error("cancelled request was flagged as an empty response")
+	}
+}
+
+func TestProviderNameOverrides(t *testing.T) {
+	cfg := &Config{ProviderNameOverrides: map[string]string{"AWS": "Bedrock (us-east-1)", "Anthropic": ""}}
+
+	cases := []struct {
+		provider string
+		want     string
+	}{
+		{"AWS", "Bedrock (us-east-1)"},
+		{"Anthropic", normalizeProviderName("Anthropic")}, // empty overrides are ignored
+	}
+	for _, c := range cases {
+		if got := resolveProviderName(cfg, c.provider); got != c.want {
+			t.Errorf("resolveProviderName(%q) = %q, want %q", c.provider, got, c.want)
+		}
+	}
+
+	// Overrides may also be keyed by the default display name
+	cfg = &Config{ProviderNameOverrides: map[string]string{normalizeProviderName("AWS"): "Bedrock"}}
+	payload := buildMeteringPayload(cfg, &anthropic.Message{Model: "claude-3-5-haiku-latest"}, nil, false, time.Second, "AWS", time.Now(), nil)
+	if payload["provider"] != "Bedrock" {
+		t.Errorf("payload provider = %v, want Bedrock", payload["provider"])
+	}
+}
+
+func TestRequestAndResponseSizesRecorded(t *testing.T) {
+	params := textRequest("hello")
+	resp := &anthropic.Message{
+		Model:   "claude-3-5-haiku-latest",
+		Content: []anthropic.ContentBlockUnion{{Type: "text", Text: "hi"}},
+	}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &params)
+
+	attrs := payloadAttributes(t, payload)
+	wantRequest, _ := json.Marshal(params)
+	if attrs["requestSizeBytes"] != len(wantRequest) {
+		t.Errorf("requestSizeBytes = %v, want %d", attrs["requestSizeBytes"], len(wantRequest))
+	}
+	wantResponse, _ := json.Marshal(resp.Content)
+	if attrs["responseSizeBytes"] != len(wantResponse) {
+		t.Errorf("responseSizeBytes = %v, want %d", attrs["responseSizeBytes"], len(wantResponse))
+	}
+
+	// Without params or content there is nothing to measure
+	payload = buildMeteringPayload(&Config{}, &anthropic.Message{}, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if _, ok := payloadAttributes(t, payload)["requestSizeBytes"]; ok {
+		t.Error("requestSizeBytes recorded without request params")
+	}
+}
+
+func TestMetadataBlocklistStripsPayloadAndAttributes(t *testing.T) {
+	cfg := &Config{MetadataBlocklist: []string{"traceId", "requestSizeBytes"}}
+	params := textRequest("hello")
+	metadata := map[string]interface{}{"traceId": "trace-1", "taskType": "chat"}
+	payload := buildMeteringPayload(cfg, &anthropic.Message{Model: "claude-3-5-haiku-latest"}, metadata, false, time.Second, "Anthropic", time.Now(), &params)
+	finalizePayload(cfg, payload)
+
+	if _, ok := payload["traceId"]; ok {
+		t.Error("blocklisted traceId was sent")
+	}
+	if _, ok := payloadAttributes(t, payload)["requestSizeBytes"]; ok {
+		t.Error("blocklisted attribute requestSizeBytes was sent")
+	}
+	if payload["taskType"] != "chat" {
+		t.Errorf("taskType = %v, want chat", payload["taskType"])
+	}
+	if metadata["traceId"] != "trace-1" {
+		t.Error("caller metadata was modified")
+	}
+}
+
+func TestToolDefinitionCountAndChoiceMode(t *testing.T) {
+	tool := anthropic.ToolUnionParam{OfTool: &anthropic.ToolParam{Name: "get_weather", InputSchema: anthropic.ToolInputSchemaParam{}}}
+	tests := []struct {
+		name       string
+		tools      []anthropic.ToolUnionParam
+		choice     anthropic.ToolChoiceUnionParam
+		wantCount  interface{}
+		wantChoice interface{}
+	}{
+		{"tools without tool_choice", []anthropic.ToolUnionParam{tool, tool}, anthropic.ToolChoiceUnionParam{}, 2, "auto"},
+		{"forced tool use", []anthropic.ToolUnionParam{tool}, anthropic.ToolChoiceUnionParam{OfAny: &anthropic.ToolChoiceAnyParam{}}, 1, "any"},
+		{"no tools", nil, anthropic.ToolChoiceUnionParam{}, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := textRequest("hello")
+			params.Tools = tt.tools
+			params.ToolChoice = tt.choice
+			payload := buildMeteringPayload(&Config{}, &anthropic.Message{Model: "claude-3-5-haiku-latest"}, nil, false, time.Second, "Anthropic", time.Now(), &params)
+
+			attrs := payloadAttributes(t, payload)
+			if attrs["toolDefinitionCount"] != tt.wantCount || attrs["toolChoiceMode"] != tt.wantChoice {
+				t.Errorf("toolDefinitionCount = %v, toolChoiceMode = %v; want %v, %v", attrs["toolDefinitionCount"], attrs["toolChoiceMode"], tt.wantCount, tt.wantChoice)
+			}
+		})
+	}
+}
+
+func TestPayloadTimestampsUseMillisecondPrecision(t *testing.T) {
+	start := time.Date(2025, 3, 1, 12, 0, 0, 7_000_000, time.UTC)
+	payload := buildMeteringPayload(&Config{}, &anthropic.Message{Model: "claude-3-5-haiku-latest"}, nil, false, 1500*time.Millisecond, "Anthropic", start, nil)
+
+	if payload["requestTime"] != "2025-03-01T12:00:00.007Z" {
+		t.Errorf("requestTime = %v, want 2025-03-01T12:00:00.007Z", payload["requestTime"])
+	}
+	if payload["responseTime"] != "2025-03-01T12:00:01.507Z" {
+		t.Errorf("responseTime = %v, want 2025-03-01T12:00:01.507Z", payload["responseTime"])
+	}
+}
+
+func TestMessageAndTurnCounts(t *testing.T) {
+	user := anthropic.NewUserMessage(anthropic.NewTextBlock("question"))
+	assistant := anthropic.NewAssistantMessage(anthropic.NewTextBlock("answer"))
+	params := textRequest("hello")
+	// Consecutive user messages form a single turn
+	params.Messages = []anthropic.MessageParam{user, user, assistant, user}
+
+	payload := buildMeteringPayload(&Config{}, &anthropic.Message{Model: "claude-3-5-haiku-latest"}, nil, false, time.Second, "Anthropic", time.Now(), &params)
+	attrs := payloadAttributes(t, payload)
+	if attrs["messageCount"] != 4 || attrs["turnCount"] != 3 {
+		t.Errorf("messageCount = %v, turnCount = %v; want 4, 3", attrs["messageCount"], attrs["turnCount"])
+	}
+}
+
+func TestGuardToolInvocationLabeled(t *testing.T) {
+	cfg := &Config{GuardToolNames: []string{"injection_check"}}
+	model := &anthropic.Message{Model: "claude-3-5-haiku-latest"}
+
+	// In the response
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", Content: []anthropic.ContentBlockUnion{{Type: "tool_use", Name: "injection_check"}}}
+	payload := buildMeteringPayload(cfg, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if payloadAttributes(t, payload)["guardToolInvoked"] != true {
+		t.Error("guard tool_use in the response was not labeled")
+	}
+
+	// Earlier in the request conversation
+	params := textRequest("hello")
+	params.Messages = append(params.Messages, anthropic.NewAssistantMessage(anthropic.NewToolUseBlock("toolu_1", map[string]string{}, "injection_check")))
+	payload = buildMeteringPayload(cfg, model, nil, false, time.Second, "Anthropic", time.Now(), &params)
+	if payloadAttributes(t, payload)["guardToolInvoked"] != true {
+		t.Error("guard tool_use in the request was not labeled")
+	}
+
+	// Other tools are not guards
+	resp.Content[0].Name = "get_weather"
+	payload = buildMeteringPayload(cfg, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if _, ok := payloadAttributes(t, payload)["guardToolInvoked"]; ok {
+		t.Error("non-guard tool labeled as a guard")
+	}
+}
+
+// withRuntimeMetadata pins the cached auto-detected metadata for the duration of a test
+func withRuntimeMetadata(t *testing.T, metadata map[string]interface{}) {
+	t.Helper()
+	runtimeMetadataOnce.Do(func() {})
+	previous := runtimeMetadata
+	runtimeMetadata = metadata
+	t.Cleanup(func() { runtimeMetadata = previous })
+}
+
+func TestAutoDetectedEnvironmentFillsMissingMetadata(t *testing.T) {
+	withRuntimeMetadata(t, map[string]interface{}{"environment": "detected-env", "region": "detected-region"})
+	cfg := &Config{AutoDetectEnvironment: true}
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest"}
+
+	payload := buildMeteringPayload(cfg, resp, map[string]interface{}{"environment": "request-env"}, false, time.Second, "Anthropic", time.Now(), nil)
+	if payload["environment"] != "request-env" || payload["region"] != "detected-region" {
+		t.Errorf("environment = %v, region = %v; want request-env, detected-region", payload["environment"], payload["region"])
+	}
+
+	// Detection is opt-in
+	payload = buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if _, ok := payload["region"]; ok {
+		t.Error("region detected without WithAutoDetectEnvironment")
+	}
+}
+
+func TestMaxTokensRequestedAndReached(t *testing.T) {
+	params := textRequest("hello") // MaxTokens 16
+	tests := []struct {
+		name    string
+		resp    *anthropic.Message
+		reached bool
+	}{
+		{"stopped at max_tokens", &anthropic.Message{StopReason: anthropic.StopReasonMaxTokens, Usage: anthropic.Usage{OutputTokens: 16}}, true},
+		{"finished early", &anthropic.Message{StopReason: anthropic.StopReasonEndTurn, Usage: anthropic.Usage{OutputTokens: 4}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := buildMeteringPayload(&Config{}, tt.resp, nil, false, time.Second, "Anthropic", time.Now(), &params)
+			attrs := payloadAttributes(t, payload)
+			if attrs["maxTokensRequested"] != int64(16) || attrs["maxTokensReached"] != tt.reached {
+				t.Errorf("maxTokensRequested = %v, maxTokensReached = %v; want 16, %v", attrs["maxTokensRequested"], attrs["maxTokensReached"], tt.reached)
+			}
+		})
+	}
+}
+
+func TestCountInputCharsIgnoresImageData(t *testing.T) {
+	data := base64.StdEncoding.EncodeToString(make([]byte, 1024))
+	params := anthropic.MessageNewParams{
+		System: []anthropic.TextBlockParam{{Text: "be brief"}},
+		Messages: []anthropic.MessageParam{
+			anthropic.NewUserMessage(anthropic.NewImageBlockBase64("image/png", data)),
+			anthropic.NewUserMessage(anthropic.NewImageBlockBase64("image/png", data), anthropic.NewTextBlock("what is this?")),
+		},
+	}
+	if got, want := countInputChars(params), len("be brief")+len("what is this?"); got != want {
+		t.Errorf("countInputChars = %d, want %d", got, want)
+	}
+}
+
+func TestCharacterCountsRecorded(t *testing.T) {
+	params := textRequest("héllo")
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", Content: []anthropic.ContentBlockUnion{{Type: "text", Text: "ça va"}}}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &params)
+
+	// Counted in characters, not bytes
+	attrs := payloadAttributes(t, payload)
+	if attrs["inputCharCount"] != 5 || attrs["outputCharCount"] != 5 {
+		t.Errorf("inputCharCount = %v, outputCharCount = %v; want 5, 5", attrs["inputCharCount"], attrs["outputCharCount"])
+	}
+}
+
+func TestSystemPromptLengthRecordedWithoutCapture(t *testing.T) {
+	params := textRequest("hi")
+	params.System = []anthropic.TextBlockParam{{Text: "You are a helpful assistant"}}
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", Content: []anthropic.ContentBlockUnion{{Type: "text", Text: "hello"}}}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &params)
+
+	attrs := payloadAttributes(t, payload)
+	if attrs["systemPromptLength"] != 27 || attrs["systemPromptTokenEstimate"] != 7 {
+		t.Errorf("systemPromptLength = %v, systemPromptTokenEstimate = %v; want 27, 7", attrs["systemPromptLength"], attrs["systemPromptTokenEstimate"])
+	}
+	if _, ok := payload["systemPrompt"]; ok {
+		t.Error("system prompt text sent without CapturePrompts")
+	}
+}
+func TestConfigFingerprintComputedOnce(t *testing.T) {
+	// A nil config must not panic in any enricher
+	buildMeteringPayload(nil, &anthropic.Message{}, nil, false, 0, "Anthropic", time.Now(), nil)
+
+	client, recorder := newTestClient(t, []anthropic.Message{{}}, WithConfigFingerprint(true))
+	want := configFingerprint(client.GetConfig())
+	if len(want) != configFingerprintLength {
+		t.Fatalf("fingerprint %q has length %d, want %d", want, len(want), configFingerprintLength)
+	}
+
+	// Later config changes do not re-hash: the fingerprint identifies the built client
+	client.GetConfig().CapturePrompts = true
+	if _, err := client.Messages().CreateMessage(context.Background(), textRequest("hi")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	if got := payloadAttributes(t, recorder.all()[0])["configFingerprint"]; got != want {
+		t.Errorf("configFingerprint = %v, want %v", got, want)
+	}
+}
+
+func TestInputFingerprintCarriedFromRequest(t *testing.T) {
+	params := textRequest("hi")
+	metadata := map[string]interface{}{"inputFingerprint": "precomputed", "requestSizeBytes": 42}
+	payload := buildMeteringPayload(&Config{}, &anthropic.Message{}, metadata, false, time.Second, "Anthropic", time.Now(), &params)
+
+	// The payload reuses the per-request values instead of serializing params again
+	attrs := payloadAttributes(t, payload)
+	if attrs["inputFingerprint"] != "precomputed" || attrs["requestSizeBytes"] != 42 {
+		t.Errorf("fingerprint attributes = %v, %v; want the carried values", attrs["inputFingerprint"], attrs["requestSizeBytes"])
+	}
+
+	client, recorder := newTestClient(t, []anthropic.Message{{}})
+	if _, err := client.Messages().CreateMessage(context.Background(), params); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	want, size, err := requestFingerprint(params)
+	if err != nil {
+		t.Fatalf("requestFingerprint: %v", err)
+	}
+	attrs = payloadAttributes(t, recorder.all()[0])
+	if attrs["inputFingerprint"] != want || attrs["requestSizeBytes"] != size {
+		t.Errorf("fingerprint attributes = %v, %v; want %v, %v", attrs["inputFingerprint"], attrs["requestSizeBytes"], want, size)
+	}
+}
+
+func TestRequestDedupFlagsReplays(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{{}, {}, {}}, WithRequestDedup(time.Minute))
+	for _, prompt := range []string{"hi", "hi", "bye"} {
+		if _, err := client.Messages().CreateMessage(context.Background(), textRequest(prompt)); err != nil {
+			t.Fatalf("CreateMessage: %v", err)
+		}
+	}
+
+	// Only the replayed request is flagged, and it is still sent
+	payloads := recorder.all()
+	if len(payloads) != 3 {
+		t.Fatalf("expected 3 meter events, got %d", len(payloads))
+	}
+	for i, want := range []bool{false, true, false} {
+		duplicate, _ := payloadAttributes(t, payloads[i])["duplicateRequest"].(bool)
+		if duplicate != want {
+			t.Errorf("event %d duplicateRequest = %v, want %v", i, duplicate, want)
+		}
+	}
+}
+
+func TestThinkingBudgetRecorded(t *testing.T) {
+	params := textRequest("think hard")
+	params.Thinking = anthropic.ThinkingConfigParamOfEnabled(2048)
+	resp := &anthropic.Message{Model: "claude-3-7-sonnet-latest", StopReason: anthropic.StopReasonEndTurn}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &params)
+
+	attrs := payloadAttributes(t, payload)
+	if attrs["extendedThinking"] != true || attrs["thinkingBudgetTokens"] != int64(2048) {
+		t.Errorf("extendedThinking = %v, thinkingBudgetTokens = %v; want true, 2048", attrs["extendedThinking"], attrs["thinkingBudgetTokens"])
+	}
+
+	plain := textRequest("hi")
+	payload = buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &plain)
+	if _, ok := payloadAttributes(t, payload)["extendedThinking"]; ok {
+		t.Error("extendedThinking set for a request without thinking")
+	}
+}
+
+func TestPayloadPrecedenceBuildStages(t *testing.T) {
+	cfg := &Config{
+		ReveniumOrgID:     "global-org",
+		ReveniumProductID: "global-product",
+		ModelMetadataDefaults: map[string]map[string]interface{}{
+			"claude-3-5-haiku-latest": {"productId": "model-product", "taskType": "model-task"},
+		},
+	}
+	metadata := map[string]interface{}{
+		"organizationId":       "request-org",
+		"taskType":             "request-task",
+		"transactionId":        "request-txn",
+		"errorReason":          "upstream failure",
+		"responseQualityScore": 0.8,
+	}
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn}
+	payload := buildMeteringPayload(cfg, resp, metadata, false, time.Second, "Anthropic", time.Now(), nil)
+
+	// metadata layers: request > model defaults > global defaults
+	for field, want := range map[string]interface{}{
+		"organizationId": "request-org",
+		"productId":      "model-product",
+		"taskType":       "request-task",
+	} {
+		if payload[field] != want {
+			t.Errorf("%s = %v, want %v", field, payload[field], want)
+		}
+	}
+
+	// metadata over required fields: the supplied transactionId and errorReason win
+	if payload["transactionId"] != "request-txn" {
+		t.Errorf("transactionId = %v, want request-txn", payload["transactionId"])
+	}
+	if payload["stopReason"] != "ERROR" {
+		t.Errorf("stopReason = %v, want ERROR", payload["stopReason"])
+	}
+
+	// auto-detected runtime metadata sits above configured defaults, below the request
+	withRuntimeMetadata(t, map[string]interface{}{"environment": "detected-env", "region": "detected-region"})
+	detectCfg := &Config{
+		AutoDetectEnvironment: true,
+		ModelMetadataDefaults: map[string]map[string]interface{}{
+			"claude-3-5-haiku-latest": {"environment": "model-env", "region": "model-region"},
+		},
+	}
+	payload = buildMeteringPayload(detectCfg, resp, map[string]interface{}{"region": "request-region"}, false, time.Second, "Anthropic", time.Now(), nil)
+	if payload["environment"] != "detected-env" || payload["region"] != "request-region" {
+		t.Errorf("environment = %v, region = %v; want detected-env, request-region", payload["environment"], payload["region"])
+	}
+
+	// computed attributes never replace a supplied quality score
+	empty := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn}
+	payload = buildMeteringPayload(cfg, empty, map[string]interface{}{"responseQualityScore": 0.8}, false, time.Second, "Anthropic", time.Now(), nil)
+	if payloadAttributes(t, payload)["emptyResponse"] != true || payload["responseQualityScore"] != 0.8 {
+		t.Errorf("emptyResponse = %v, responseQualityScore = %v; want true, 0.8", payloadAttributes(t, payload)["emptyResponse"], payload["responseQualityScore"])
+	}
+}
+
+func TestPayloadPrecedenceSendStages(t *testing.T) {
+	var seen map[string]interface{}
+	client, recorder := newTestClient(t, []anthropic.Message{{}},
+		WithCapturePrompts(true),
+		WithMeteringWorkers(1),
+		WithPayloadInterceptor(func(payload map[string]interface{}) {
+			seen = MergeMetadata(nil, payload)
+			payload["traceId"] = "intercepted"
+			payload["apiSecret"] = "leaked"
+			setPayloadAttribute(payload, "apiSecret", "leaked")
+		}),
+		WithMetadataBlocklist([]string{"apiSecret", "organizationId"}),
+	)
+
+	ctx := WithUsageMetadata(context.Background(), map[string]interface{}{"traceId": "request", "organizationId": "org"})
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hi")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	// Interceptors run after prompt capture and send-time attributes are added
+	if seen["inputMessages"] == nil {
+		t.Error("interceptor ran before prompt capture")
+	}
+	if _, ok := payloadAttributes(t, seen)["meteringQueueWaitMs"]; !ok {
+		t.Error("interceptor ran before send-time attributes were added")
+	}
+
+	// Interceptors override metadata; the blocklist strips whatever stage set a key
+	sent := recorder.all()[0]
+	if sent["traceId"] != "intercepted" {
+		t.Errorf("traceId = %v, want intercepted", sent["traceId"])
+	}
+	if _, ok := sent["organizationId"]; ok {
+		t.Error("blocklisted metadata field was sent")
+	}
+	if _, ok := sent["apiSecret"]; ok {
+		t.Error("blocklisted interceptor field was sent")
+	}
+	if _, ok := payloadAttributes(t, sent)["apiSecret"]; ok {
+		t.Error("blocklisted interceptor attribute was sent")
+	}
+}
+
+func TestNormalizeClientIP(t *testing.T) {
+	tests := map[string]string{
+		"203.0.113.7":           "203.0.113.7",
+		" 203.0.113.7:443 ":     "203.0.113.7",
+		"[2001:db8::1]:443":     "2001:db8::1",
+		"2001:0db8:0:0:0:0:0:1": "2001:db8::1",
+		"gateway-eu":            "",
+		"":                      "",
+	}
+	for value, want := range tests {
+		if got := normalizeClientIP(value); got != want {
+			t.Errorf("normalizeClientIP(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestRequestSourceAttributed(t *testing.T) {
+	client, recorder := newTestClient(t, []anthropic.Message{{}, {}})
+
+	ctx := WithRequestSource(context.Background(), "203.0.113.7:5123\n")
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hi")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+	// Usage metadata takes precedence over the context source
+	ctx = WithUsageMetadata(ctx, map[string]interface{}{"source": "tenant-a"})
+	if _, err := client.Messages().CreateMessage(ctx, textRequest("hi")); err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	payloads := recorder.all()
+	if len(payloads) != 2 {
+		t.Fatalf("expected 2 meter events, got %d", len(payloads))
+	}
+	attrs := payloadAttributes(t, payloads[0])
+	if attrs["source"] != "203.0.113.7:5123" || attrs["clientIp"] != "203.0.113.7" {
+		t.Errorf("source = %q, clientIp = %v; want the sanitized source and its IP", attrs["source"], attrs["clientIp"])
+	}
+	attrs = payloadAttributes(t, payloads[1])
+	if _, ok := attrs["clientIp"]; attrs["source"] != "tenant-a" || ok {
+		t.Errorf("source = %v, clientIp = %v; want tenant-a without an IP", attrs["source"], attrs["clientIp"])
+	}
+}
+
+func TestCompletionModeLabelsCallPath(t *testing.T) {
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn}
+	for isStreamed, want := range map[bool]string{false: CompletionModeBlocking, true: CompletionModeStreaming} {
+		payload := buildMeteringPayload(&Config{}, resp, nil, isStreamed, time.Second, "Anthropic", time.Now(), nil)
+		if got := payloadAttributes(t, payload)["completionMode"]; got != want {
+			t.Errorf("isStreamed %v: completionMode = %v, want %s", isStreamed, got, want)
+		}
+		if payload["isStreamed"] != isStreamed {
+			t.Errorf("isStreamed = %v, want %v", payload["isStreamed"], isStreamed)
+		}
+	}
+}
+
+func TestNormalizeQualityScore(t *testing.T) {
+	type score float32
+	tests := []struct {
+		name  string
+		value interface{}
+		want  float64
+		ok    bool
+	}{
+		{"float64 in range", 0.75, 0.75, true},
+		{"float32 in range", float32(0.5), 0.5, true},
+		{"named float", score(0.25), 0.25, true},
+		{"int8 one", int8(1), 1, true},
+		{"int32 zero", int32(0), 0, true},
+		{"uint one", uint(1), 1, true},
+		{"json number", json.Number("0.9"), 0.9, true},
+		{"above range clamped", 1.5, 1, true},
+		{"below range clamped", int16(-3), 0, true},
+		{"uint64 above range clamped", uint64(7), 1, true},
+		{"string rejected", "0.5", 0, false},
+		{"bool rejected", true, 0, false},
+		{"nil rejected", nil, 0, false},
+		{"bad json number rejected", json.Number("high"), 0, false},
+		{"NaN rejected", math.NaN(), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := normalizeQualityScore(tt.value)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("normalizeQualityScore(%v) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestToolContinuationTagged(t *testing.T) {
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonEndTurn}
+
+	first := textRequest("what's the weather?")
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &first)
+	if _, ok := payloadAttributes(t, payload)["isToolContinuation"]; ok {
+		t.Error("isToolContinuation set on a request without tool results")
+	}
+
+	followUp := textRequest("what's the weather?")
+	followUp.Messages = append(followUp.Messages,
+		anthropic.NewAssistantMessage(anthropic.NewToolUseBlock("toolu_1", map[string]string{"city": "Paris"}, "get_weather")),
+		anthropic.NewUserMessage(anthropic.NewToolResultBlock("toolu_1", "sunny", false)),
+	)
+	payload = buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &followUp)
+	if got := payloadAttributes(t, payload)["isToolContinuation"]; got != true {
+		t.Errorf("isToolContinuation = %v, want true", got)
+	}
+}
+
+func TestContextWindowOverflowFlagged(t *testing.T) {
+	for stop, want := range map[anthropic.StopReason]bool{
+		anthropic.StopReasonMaxTokens:   false,
+		"model_context_window_exceeded": true,
+	} {
+		resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: stop}
+		payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+		if payload["stopReason"] != "TOKEN_LIMIT" {
+			t.Errorf("%s: stopReason = %v, want TOKEN_LIMIT", stop, payload["stopReason"])
+		}
+		_, flagged := payloadAttributes(t, payload)["contextWindowExceeded"]
+		if flagged != want {
+			t.Errorf("%s: contextWindowExceeded flagged = %v, want %v", stop, flagged, want)
+		}
+	}
+}
+
+func TestOutputTokensPerSecond(t *testing.T) {
+	if tps, ok := outputTokensPerSecond(50, 2*time.Second); !ok || tps != 25 {
+		t.Errorf("outputTokensPerSecond(50, 2s) = %v, %v; want 25, true", tps, ok)
+	}
+	if _, ok := outputTokensPerSecond(0, time.Second); ok {
+		t.Error("outputTokensPerSecond reported a rate without output tokens")
+	}
+	if _, ok := outputTokensPerSecond(10, 0); ok {
+		t.Error("outputTokensPerSecond reported a rate without generation time")
+	}
+
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", Usage: anthropic.Usage{OutputTokens: 30}}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, 3*time.Second, "Anthropic", time.Now(), nil)
+	if got := payloadAttributes(t, payload)["outputTokensPerSecond"]; got != 10.0 {
+		t.Errorf("outputTokensPerSecond = %v, want 10", got)
+	}
+	// Streaming payloads get the rate when the stream closes
+	payload = buildMeteringPayload(&Config{}, resp, nil, true, 3*time.Second, "Anthropic", time.Now(), nil)
+	if _, ok := payloadAttributes(t, payload)["outputTokensPerSecond"]; ok {
+		t.Error("outputTokensPerSecond set by the shared builder for a streamed payload")
+	}
+}
+
+func TestAssistantPrefillTagged(t *testing.T) {
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest"}
+
+	plain := textRequest("list three colors as JSON")
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &plain)
+	if _, ok := payloadAttributes(t, payload)["usedPrefill"]; ok {
+		t.Error("usedPrefill set on a request ending with a user message")
+	}
+
+	prefilled := textRequest("list three colors as JSON")
+	prefilled.Messages = append(prefilled.Messages, anthropic.NewAssistantMessage(anthropic.NewTextBlock("[")))
+	payload = buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), &prefilled)
+	if got := payloadAttributes(t, payload)["usedPrefill"]; got != true {
+		t.Errorf("usedPrefill = %v, want true", got)
+	}
+}
+
+func TestRefusalFlagged(t *testing.T) {
+	resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", StopReason: anthropic.StopReasonRefusal}
+	payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if payload["stopReason"] != "ERROR" {
+		t.Errorf("stopReason = %v, want ERROR", payload["stopReason"])
+	}
+	if got := payloadAttributes(t, payload)["refusal"]; got != true {
+		t.Errorf("refusal = %v, want true", got)
+	}
+
+	// Bedrock responses keep the refusal stop reason instead of reporting end_turn
+	if got := convertBedrockStopReason("refusal"); got != "refusal" {
+		t.Errorf("convertBedrockStopReason(refusal) = %q, want refusal", got)
+	}
+}
+
+func TestCacheWriteWithoutReadFlagged(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage anthropic.Usage
+		want  bool
+	}{
+		{"write without read", anthropic.Usage{CacheCreationInputTokens: 100}, true},
+		{"write with read", anthropic.Usage{CacheCreationInputTokens: 100, CacheReadInputTokens: 50}, false},
+		{"read only", anthropic.Usage{CacheReadInputTokens: 50}, false},
+		{"no cache", anthropic.Usage{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &anthropic.Message{Model: "claude-3-5-haiku-latest", Usage: tt.usage}
+			payload := buildMeteringPayload(&Config{}, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+			if _, flagged := payloadAttributes(t, payload)["cacheCreatedNoRead"]; flagged != tt.want {
+				t.Errorf("cacheCreatedNoRead flagged = %v, want %v", flagged, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package revenium
+
+import "strings"
+
+// ModelPricing holds per-model token prices in USD per million tokens
+type ModelPricing struct {
+	InputPerMillion      float64
+	OutputPerMillion     float64
+	CacheWritePerMillion float64
+	CacheReadPerMillion  float64
+}
+
+// EstimateCost returns the USD cost of the given token counts for a model served by
+// provider. Rates set with WithProviderModelPricing take precedence over the
+// provider-agnostic WithModelPricing table; ok is false when the model is not priced
+func (r *ReveniumAnthropic) EstimateCost(provider Provider, model string, tokens TokenCounts) (float64, bool) {
+	if r == nil {
+		return 0, false
+	}
+	pricing, ok := lookupModelPricing(r.config, string(provider), model)
+	if !ok {
+		return 0, false
+	}
+	return estimateCost(pricing, tokens), true
+}
+
+// lookupModelPricing returns the configured pricing for a model, preferring the
+// provider-specific table and falling back to the provider-agnostic one. Each table
+// matches the model name directly or its Anthropic equivalent for Bedrock model IDs
+func lookupModelPricing(cfg *Config, provider, model string) (ModelPricing, bool) {
+	if cfg == nil || model == "" {
+		return ModelPricing{}, false
+	}
+	// Payload provider names ("Anthropic", "AWS") map onto the Provider constants
+	if table, ok := cfg.ProviderModelPricing[Provider(strings.ToUpper(provider))]; ok {
+		if pricing, ok := lookupPricingTable(table, model); ok {
+			return pricing, true
+		}
+	}
+	return lookupPricingTable(cfg.ModelPricing, model)
+}
+
+// lookupPricingTable matches a model against one price table
+func lookupPricingTable(table map[string]ModelPricing, model string) (ModelPricing, bool) {
+	if len(table) == 0 {
+		return ModelPricing{}, false
+	}
+	if pricing, ok := table[model]; ok {
+		return pricing, true
+	}
+	if converted, err := ConvertBedrockARNToAnthropicModel(model); err == nil && converted != model {
+		pricing, ok := table[converted]
+		return pricing, ok
+	}
+	return ModelPricing{}, false
+}
+
+// estimateCacheSavings returns the USD saved by reading cacheReadTokens from the
+// prompt cache instead of paying the uncached input price for them
+func estimateCacheSavings(pricing ModelPricing, cacheReadTokens int64) float64 {
+	if cacheReadTokens <= 0 || pricing.InputPerMillion <= pricing.CacheReadPerMillion {
+		return 0
+	}
+	return float64(cacheReadTokens) * (pricing.InputPerMillion - pricing.CacheReadPerMillion) / 1_000_000
+}
+
+// estimateCost returns the USD cost of the given token counts
+func estimateCost(pricing ModelPricing, tokens TokenCounts) float64 {
+	return (float64(tokens.Input)*pricing.InputPerMillion +
+		float64(tokens.Output)*pricing.OutputPerMillion +
+		float64(tokens.CacheCreation)*pricing.CacheWritePerMillion +
+		float64(tokens.CacheRead)*pricing.CacheReadPerMillion) / 1_000_000
+}
@@ -0,0 +1,64 @@
+package revenium
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestEstimatedCacheSavings(t *testing.T) {
+	cfg := &Config{ModelPricing: map[string]ModelPricing{
+		"claude-3-5-haiku-latest": {InputPerMillion: 0.80, CacheReadPerMillion: 0.08},
+	}}
+	resp := &anthropic.Message{
+		Model: "claude-3-5-haiku-latest",
+		Usage: anthropic.Usage{InputTokens: 10, CacheReadInputTokens: 1_000_000},
+	}
+	payload := buildMeteringPayload(cfg, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+
+	savings, _ := payloadAttributes(t, payload)["estimatedCacheSavings"].(float64)
+	if math.Abs(savings-0.72) > 1e-9 {
+		t.Errorf("estimatedCacheSavings = %v, want 0.72", savings)
+	}
+
+	// Unpriced models report no estimate
+	resp.Model = "claude-opus-4-20250514"
+	payload = buildMeteringPayload(cfg, resp, nil, false, time.Second, "Anthropic", time.Now(), nil)
+	if _, ok := payloadAttributes(t, payload)["estimatedCacheSavings"]; ok {
+		t.Error("savings estimated for a model without pricing")
+	}
+}
+
+func TestEstimateCacheSavingsRequiresCheaperCacheReads(t *testing.T) {
+	if got := estimateCacheSavings(ModelPricing{InputPerMillion: 1, CacheReadPerMillion: 1}, 1000); got != 0 {
+		t.Errorf("savings = %v, want 0 when cache reads cost the same", got)
+	}
+	if got := estimateCacheSavings(ModelPricing{InputPerMillion: 3, CacheReadPerMillion: 0.3}, 0); got != 0 {
+		t.Errorf("savings = %v, want 0 without cache reads", got)
+	}
+}
+
+func TestProviderModelPricingTakesPrecedence(t *testing.T) {
+	cfg := &Config{}
+	WithModelPricing(map[string]ModelPricing{"claude-3-5-haiku-latest": {InputPerMillion: 1, OutputPerMillion: 5}})(cfg)
+	WithProviderModelPricing(ProviderBedrock, map[string]ModelPricing{"claude-3-5-haiku-latest": {InputPerMillion: 2, OutputPerMillion: 10}})(cfg)
+	client := &ReveniumAnthropic{config: cfg}
+	tokens := TokenCounts{Input: 1_000_000, Output: 1_000_000}
+
+	if cost, ok := client.EstimateCost(ProviderBedrock, "claude-3-5-haiku-latest", tokens); !ok || cost != 12 {
+		t.Errorf("Bedrock cost = %v, %v; want 12 from the provider table", cost, ok)
+	}
+	if cost, ok := client.EstimateCost(ProviderAnthropic, "claude-3-5-haiku-latest", tokens); !ok || cost != 6 {
+		t.Errorf("Anthropic cost = %v, %v; want 6 from the shared table", cost, ok)
+	}
+	if _, ok := client.EstimateCost(ProviderAnthropic, "claude-opus-4-20250514", tokens); ok {
+		t.Error("unpriced model reported a cost")
+	}
+
+	// Payload provider names resolve to the same tables
+	if pricing, ok := lookupModelPricing(cfg, "AWS", "claude-3-5-haiku-latest"); !ok || pricing.InputPerMillion != 2 {
+		t.Errorf("lookupModelPricing(AWS) = %+v, %v; want the Bedrock rates", pricing, ok)
+	}
+}
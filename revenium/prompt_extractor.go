@@ -5,6 +5,7 @@ import (
 	"unicode/utf8"
 
 	"github.com/anthropics/anthropic-sdk-go"
+	"github.com/anthropics/anthropic-sdk-go/packages/param"
 )
 
 // truncateUTF8Safe truncates a string to maxBytes while preserving UTF-8 validity.
@@ -41,15 +42,54 @@ func truncateUTF8Safe(s string, maxBytes int) string {
 	return result
 }
 
+// truncateUTF8SafeTail keeps the last maxBytes of a string while preserving UTF-8
+// validity, advancing past any continuation bytes at the cut
+func truncateUTF8SafeTail(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	if maxBytes <= 0 {
+		return ""
+	}
+
+	start := len(s) - maxBytes
+	for start < len(s) && (s[start]&0xC0) == 0x80 {
+		start++
+	}
+	return s[start:]
+}
+
+// truncateWithMarker shortens s to at most limit bytes (marker included), keeping the
+// portion selected by strategy and placing TruncationMarker in the removed region
+func truncateWithMarker(s string, limit int, strategy string) string {
+	keep := limit - len(TruncationMarker)
+	switch strategy {
+	case TruncationStrategyTail:
+		return TruncationMarker + truncateUTF8SafeTail(s, keep)
+	case TruncationStrategyMiddle:
+		head := keep / 2
+		return truncateUTF8Safe(s, head) + TruncationMarker + truncateUTF8SafeTail(s, keep-head)
+	default:
+		return truncateUTF8Safe(s, keep) + TruncationMarker
+	}
+}
+
 const (
 	// MaxPromptLength is the maximum length for captured prompts/responses
 	// Fields exceeding this limit will be truncated
 	MaxPromptLength = 50000
 
-	// TruncationMarker is appended to truncated content
+	// TruncationMarker marks where truncated content was removed
 	TruncationMarker = "...[TRUNCATED]"
 )
 
+// Truncation strategies for WithTruncationStrategy
+const (
+	TruncationStrategyHead   = "head"   // Keep the beginning (default)
+	TruncationStrategyTail   = "tail"   // Keep the end, e.g. the latest turn
+	TruncationStrategyMiddle = "middle" // Keep both ends and drop the middle
+)
+
 // PromptData holds extracted prompt information for metering
 type PromptData struct {
 	// SystemPrompt contains the system message content (if any)
@@ -60,33 +100,90 @@ type PromptData struct {
 	OutputResponse string
 	// PromptsTruncated indicates if any field was truncated
 	PromptsTruncated bool
+	// SystemPromptTruncated indicates the system prompt was truncated
+	SystemPromptTruncated bool
+	// InputMessagesTruncated indicates at least one input message was truncated
+	InputMessagesTruncated bool
+	// OutputResponseTruncated indicates the output response was truncated
+	OutputResponseTruncated bool
+	// SystemPromptCached indicates at least one system block has a cache_control marker
+	SystemPromptCached bool
+	// ResponseID is the provider's response message ID
+	ResponseID string
+	// ResponseModel is the model reported in the response (separate from the billing model)
+	ResponseModel string
+	// ResponseRole is the role of the response message
+	ResponseRole string
+	// ToolCalls lists the response's tool_use blocks in order
+	ToolCalls []ToolCallRef
+	// ToolResultIDs lists the tool_use IDs referenced by tool_result blocks in the input
+	ToolResultIDs []string
+}
+
+// ToolCallRef identifies one tool_use block; its ID is what a later tool_result
+// references, linking calls and results into a tool-call graph
+type ToolCallRef struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// extractToolCalls returns the tool_use blocks of a response
+func extractToolCalls(resp *anthropic.Message) []ToolCallRef {
+	var calls []ToolCallRef
+	for _, block := range resp.Content {
+		if block.Type == "tool_use" {
+			calls = append(calls, ToolCallRef{ID: block.ID, Name: block.Name})
+		}
+	}
+	return calls
+}
+
+// extractToolResultIDs returns the tool_use IDs answered by tool_result blocks
+func extractToolResultIDs(messages []anthropic.MessageParam) []string {
+	var ids []string
+	for _, msg := range messages {
+		for _, block := range msg.Content {
+			if block.OfToolResult != nil && block.OfToolResult.ToolUseID != "" {
+				ids = append(ids, block.OfToolResult.ToolUseID)
+			}
+		}
+	}
+	return ids
 }
 
 // ExtractPromptsFromParams extracts system prompt and input messages from Anthropic message params
 func ExtractPromptsFromParams(params anthropic.MessageNewParams) PromptData {
+	return extractPromptsFromParams(params, TruncationStrategyHead)
+}
+
+// extractPromptsFromParams is ExtractPromptsFromParams with a truncation strategy
+func extractPromptsFromParams(params anthropic.MessageNewParams, strategy string) PromptData {
 	data := PromptData{}
 
 	// Extract system prompt if present
+	// The SDK models system as text blocks; a plain string system prompt is sent as a single block
 	if len(params.System) > 0 {
+		data.SystemPromptCached = hasCachedSystemBlock(params.System)
 		systemContent := extractSystemContent(params.System)
 		if systemContent != "" {
 			// Apply truncation if needed
 			if len(systemContent) > MaxPromptLength {
-				markerLen := len(TruncationMarker)
-				truncateAt := MaxPromptLength - markerLen
-				systemContent = truncateUTF8Safe(systemContent, truncateAt) + TruncationMarker
+				systemContent = truncateWithMarker(systemContent, MaxPromptLength, strategy)
 				data.PromptsTruncated = true
+				data.SystemPromptTruncated = true
 				Debug("System prompt truncated to %d characters", MaxPromptLength)
 			}
 			data.SystemPrompt = systemContent
 		}
 	}
 
+	// Record which earlier tool calls this request answers
+	data.ToolResultIDs = extractToolResultIDs(params.Messages)
+
 	// Extract user messages
 	if len(params.Messages) > 0 {
 		var userMessages []map[string]interface{}
 		halfLimit := MaxPromptLength / 2
-		markerLen := len(TruncationMarker)
 
 		for _, msg := range params.Messages {
 			role, content := extractMessageContent(msg)
@@ -98,9 +195,9 @@ func ExtractPromptsFromParams(params anthropic.MessageNewParams) PromptData {
 
 				// Truncate individual message content if too long
 				if len(content) > halfLimit {
-					truncateAt := halfLimit - markerLen
-					messageMap["content"] = truncateUTF8Safe(content, truncateAt) + TruncationMarker
+					messageMap["content"] = truncateWithMarker(content, halfLimit, strategy)
 					data.PromptsTruncated = true
+					data.InputMessagesTruncated = true
 				}
 
 				userMessages = append(userMessages, messageMap)
@@ -141,6 +238,16 @@ func extractSystemContent(system []anthropic.TextBlockParam) string {
 	return content
 }
 
+// hasCachedSystemBlock reports whether any system block sets a cache_control breakpoint
+func hasCachedSystemBlock(system []anthropic.TextBlockParam) bool {
+	for _, block := range system {
+		if !param.IsOmitted(block.CacheControl) {
+			return true
+		}
+	}
+	return false
+}
+
 // extractMessageContent extracts role and content from an Anthropic message
 func extractMessageContent(msg anthropic.MessageParam) (role string, content string) {
 	role = string(msg.Role)
@@ -200,13 +307,28 @@ func concatenateTextParts(parts []string) string {
 
 // ExtractResponseContent extracts output response from Anthropic message response
 func ExtractResponseContent(resp *anthropic.Message, promptsTruncated bool) PromptData {
+	return extractResponseContent(resp, promptsTruncated, TruncationStrategyHead)
+}
+
+// extractResponseContent is ExtractResponseContent with a truncation strategy
+func extractResponseContent(resp *anthropic.Message, promptsTruncated bool, strategy string) PromptData {
 	data := PromptData{
 		PromptsTruncated: promptsTruncated,
 	}
 
-	if resp == nil || len(resp.Content) == 0 {
+	if resp == nil {
+		return data
+	}
+
+	// Capture response identity so captured conversations are fully identified
+	data.ResponseID = resp.ID
+	data.ResponseModel = string(resp.Model)
+	data.ResponseRole = string(resp.Role)
+
+	if len(resp.Content) == 0 {
 		return data
 	}
+	data.ToolCalls = extractToolCalls(resp)
 
 	// Extract text from content blocks
 	var textParts []string
@@ -225,10 +347,9 @@ func ExtractResponseContent(resp *anthropic.Message, promptsTruncated bool) Prom
 
 	// Apply truncation if needed
 	if len(content) > MaxPromptLength {
-		markerLen := len(TruncationMarker)
-		truncateAt := MaxPromptLength - markerLen
-		content = truncateUTF8Safe(content, truncateAt) + TruncationMarker
+		content = truncateWithMarker(content, MaxPromptLength, strategy)
 		data.PromptsTruncated = true
+		data.OutputResponseTruncated = true
 		Debug("Output response truncated to %d characters", MaxPromptLength)
 	}
 
@@ -236,8 +357,75 @@ func ExtractResponseContent(resp *anthropic.Message, promptsTruncated bool) Prom
 	return data
 }
 
+// ExtractStructuredResponseContent extracts the response content blocks as JSON,
+// preserving the order and interleaving of text and tool_use blocks. Text longer than
+// half of MaxPromptLength is truncated per block so the result stays valid JSON
+func ExtractStructuredResponseContent(resp *anthropic.Message, promptsTruncated bool) PromptData {
+	return extractStructuredResponseContent(resp, promptsTruncated, TruncationStrategyHead)
+}
+
+// extractStructuredResponseContent is ExtractStructuredResponseContent with a truncation strategy
+func extractStructuredResponseContent(resp *anthropic.Message, promptsTruncated bool, strategy string) PromptData {
+	data := PromptData{
+		PromptsTruncated: promptsTruncated,
+	}
+
+	if resp == nil {
+		return data
+	}
+
+	data.ResponseID = resp.ID
+	data.ResponseModel = string(resp.Model)
+	data.ResponseRole = string(resp.Role)
+
+	if len(resp.Content) == 0 {
+		return data
+	}
+	data.ToolCalls = extractToolCalls(resp)
+
+	halfLimit := MaxPromptLength / 2
+
+	blocks := make([]map[string]interface{}, 0, len(resp.Content))
+	for _, block := range resp.Content {
+		blockMap := map[string]interface{}{
+			"type": block.Type,
+		}
+		switch block.Type {
+		case "text":
+			text := block.Text
+			if len(text) > halfLimit {
+				text = truncateWithMarker(text, halfLimit, strategy)
+				data.PromptsTruncated = true
+				data.OutputResponseTruncated = true
+			}
+			blockMap["text"] = text
+		case "tool_use":
+			blockMap["id"] = block.ID
+			blockMap["name"] = block.Name
+			if len(block.Input) > 0 {
+				blockMap["input"] = block.Input
+			}
+		}
+		blocks = append(blocks, blockMap)
+	}
+
+	jsonBytes, err := json.Marshal(blocks)
+	if err != nil {
+		Warn("Failed to serialize response content blocks to JSON: %v", err)
+		return data
+	}
+
+	data.OutputResponse = string(jsonBytes)
+	return data
+}
+
 // ExtractStreamingResponseContent extracts output from accumulated streaming content
 func ExtractStreamingResponseContent(accumulatedContent string, promptsTruncated bool) PromptData {
+	return extractStreamingResponseContent(accumulatedContent, promptsTruncated, TruncationStrategyHead)
+}
+
+// extractStreamingResponseContent is ExtractStreamingResponseContent with a truncation strategy
+func extractStreamingResponseContent(accumulatedContent string, promptsTruncated bool, strategy string) PromptData {
 	data := PromptData{
 		PromptsTruncated: promptsTruncated,
 	}
@@ -250,10 +438,9 @@ func ExtractStreamingResponseContent(accumulatedContent string, promptsTruncated
 
 	// Apply truncation if needed
 	if len(content) > MaxPromptLength {
-		markerLen := len(TruncationMarker)
-		truncateAt := MaxPromptLength - markerLen
-		content = truncateUTF8Safe(content, truncateAt) + TruncationMarker
+		content = truncateWithMarker(content, MaxPromptLength, strategy)
 		data.PromptsTruncated = true
+		data.OutputResponseTruncated = true
 		Debug("Streaming output response truncated to %d characters", MaxPromptLength)
 	}
 
@@ -275,4 +462,32 @@ func AddPromptDataToPayload(payload map[string]interface{}, data PromptData) {
 	if data.PromptsTruncated {
 		payload["promptsTruncated"] = true
 	}
+	// Per-field flags show exactly which captured field was cut
+	if data.SystemPromptTruncated {
+		setPayloadAttribute(payload, "systemPromptTruncated", true)
+	}
+	if data.InputMessagesTruncated {
+		setPayloadAttribute(payload, "inputMessagesTruncated", true)
+	}
+	if data.OutputResponseTruncated {
+		setPayloadAttribute(payload, "outputResponseTruncated", true)
+	}
+	if data.SystemPromptCached {
+		setPayloadAttribute(payload, "systemPromptCached", true)
+	}
+	if data.ResponseID != "" {
+		setPayloadAttribute(payload, "responseId", data.ResponseID)
+	}
+	if data.ResponseModel != "" {
+		setPayloadAttribute(payload, "responseModel", data.ResponseModel)
+	}
+	if data.ResponseRole != "" {
+		setPayloadAttribute(payload, "responseRole", data.ResponseRole)
+	}
+	if len(data.ToolCalls) > 0 {
+		setPayloadAttribute(payload, "toolCalls", data.ToolCalls)
+	}
+	if len(data.ToolResultIDs) > 0 {
+		setPayloadAttribute(payload, "toolResultIds", data.ToolResultIDs)
+	}
 }
@@ -0,0 +1,157 @@
+package revenium
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestSystemPromptCacheControlDetected(t *testing.T) {
+	params := textRequest("hello")
+	params.System = []anthropic.TextBlockParam{
+		{Text: "You are terse."},
+		{Text: "Long shared context", CacheControl: anthropic.NewCacheControlEphemeralParam()},
+	}
+
+	data := ExtractPromptsFromParams(params)
+	if !data.SystemPromptCached {
+		t.Fatal("cache_control marker on a system block was not detected")
+	}
+	payload := map[string]interface{}{}
+	AddPromptDataToPayload(payload, data)
+	if attrs := payloadAttributes(t, payload); attrs["systemPromptCached"] != true {
+		t.Errorf("systemPromptCached attribute not set: %v", attrs)
+	}
+
+	params.System = []anthropic.TextBlockParam{{Text: "You are terse."}}
+	if ExtractPromptsFromParams(params).SystemPromptCached {
+		t.Error("system prompt without cache_control reported as cached")
+	}
+}
+
+func TestStructuredResponseCapturePreservesBlockOrder(t *testing.T) {
+	resp := &anthropic.Message{
+		ID:    "msg_1",
+		Model: "claude-3-5-haiku-latest",
+		Content: []anthropic.ContentBlockUnion{
+			{Type: "text", Text: "Checking the weather."},
+			{Type: "tool_use", ID: "toolu_1", Name: "get_weather", Input: json.RawMessage(`{"city":"Paris"}`)},
+			{Type: "text", Text: "Done."},
+		},
+	}
+
+	data := ExtractStructuredResponseContent(resp, false)
+	want := `[{"text":"Checking the weather.","type":"text"},{"id":"toolu_1","input":{"city":"Paris"},"name":"get_weather","type":"tool_use"},{"text":"Done.","type":"text"}]`
+	if data.OutputResponse != want {
+		t.Errorf("OutputResponse = %s, want %s", data.OutputResponse, want)
+	}
+	if data.ResponseID != "msg_1" || data.PromptsTruncated {
+		t.Errorf("ResponseID = %q, PromptsTruncated = %v", data.ResponseID, data.PromptsTruncated)
+	}
+
+	// Long text is truncated per block so the output stays valid JSON
+	resp.Content = []anthropic.ContentBlockUnion{{Type: "text", Text: strings.Repeat("a", MaxPromptLength)}}
+	data = ExtractStructuredResponseContent(resp, false)
+	if !data.PromptsTruncated || !json.Valid([]byte(data.OutputResponse)) {
+		t.Errorf("truncated output: PromptsTruncated = %v, valid JSON = %v", data.PromptsTruncated, json.Valid([]byte(data.OutputResponse)))
+	}
+}
+
+func TestTruncateWithMarkerStrategies(t *testing.T) {
+	s := "héllo wörld, the latest turn"
+	limit := 12 + len(TruncationMarker)
+
+	tests := []struct {
+		strategy   string
+		wantPrefix string
+		wantSuffix string
+	}{
+		{TruncationStrategyHead, "héllo wörl", TruncationMarker},
+		{TruncationStrategyTail, TruncationMarker, "latest turn"},
+		{TruncationStrategyMiddle, "héllo", "t turn"},
+	}
+	for _, tt := range tests {
+		got := truncateWithMarker(s, limit, tt.strategy)
+		if len(got) > limit {
+			t.Errorf("%s: len = %d, want at most %d", tt.strategy, len(got), limit)
+		}
+		if !utf8.ValidString(got) {
+			t.Errorf("%s: %q is not valid UTF-8", tt.strategy, got)
+		}
+		if !strings.HasPrefix(got, tt.wantPrefix) || !strings.HasSuffix(got, tt.wantSuffix) {
+			t.Errorf("%s: got %q", tt.strategy, got)
+		}
+		if !strings.Contains(got, TruncationMarker) {
+			t.Errorf("%s: %q has no truncation marker", tt.strategy, got)
+		}
+	}
+}
+
+func TestWithTruncationStrategyFallsBackToHead(t *testing.T) {
+	cfg := &Config{}
+	WithTruncationStrategy("sideways")(cfg)
+	if cfg.TruncationStrategy != TruncationStrategyHead {
+		t.Errorf("TruncationStrategy = %q, want head", cfg.TruncationStrategy)
+	}
+	if got := truncationStrategy(nil); got != TruncationStrategyHead {
+		t.Errorf("truncationStrategy(nil) = %q, want head", got)
+	}
+}
+
+func TestPerFieldTruncationFlags(t *testing.T) {
+	params := textRequest("short question")
+	params.System = []anthropic.TextBlockParam{{Text: strings.Repeat("s", MaxPromptLength+1)}}
+	data := ExtractPromptsFromParams(params)
+	if !data.SystemPromptTruncated || data.InputMessagesTruncated {
+		t.Errorf("SystemPromptTruncated = %v, InputMessagesTruncated = %v; want true, false", data.SystemPromptTruncated, data.InputMessagesTruncated)
+	}
+
+	resp := &anthropic.Message{Content: []anthropic.ContentBlockUnion{{Type: "text", Text: strings.Repeat("r", MaxPromptLength+1)}}}
+	response := ExtractResponseContent(resp, data.PromptsTruncated)
+	if !response.OutputResponseTruncated {
+		t.Error("OutputResponseTruncated not set for an oversized response")
+	}
+
+	payload := map[string]interface{}{}
+	data.OutputResponseTruncated = response.OutputResponseTruncated
+	AddPromptDataToPayload(payload, data)
+	attrs := payloadAttributes(t, payload)
+	if attrs["systemPromptTruncated"] != true || attrs["outputResponseTruncated"] != true {
+		t.Errorf("attributes = %v, want system prompt and output response flagged", attrs)
+	}
+	if _, ok := attrs["inputMessagesTruncated"]; ok {
+		t.Error("inputMessagesTruncated set although no message was cut")
+	}
+}
+
+func TestToolCallLinkageCaptured(t *testing.T) {
+	params := textRequest("what's the weather?")
+	params.Messages = append(params.Messages,
+		anthropic.NewAssistantMessage(anthropic.NewToolUseBlock("toolu_1", map[string]string{"city": "Paris"}, "get_weather")),
+		anthropic.NewUserMessage(anthropic.NewToolResultBlock("toolu_1", "sunny", false)),
+	)
+	data := ExtractPromptsFromParams(params)
+	if len(data.ToolResultIDs) != 1 || data.ToolResultIDs[0] != "toolu_1" {
+		t.Errorf("ToolResultIDs = %v, want [toolu_1]", data.ToolResultIDs)
+	}
+
+	resp := &anthropic.Message{Content: []anthropic.ContentBlockUnion{
+		{Type: "text", Text: "Checking"},
+		{Type: "tool_use", ID: "toolu_2", Name: "get_forecast"},
+	}}
+	response := ExtractResponseContent(resp, false)
+	if len(response.ToolCalls) != 1 || response.ToolCalls[0] != (ToolCallRef{ID: "toolu_2", Name: "get_forecast"}) {
+		t.Errorf("ToolCalls = %v, want [{toolu_2 get_forecast}]", response.ToolCalls)
+	}
+
+	payload := map[string]interface{}{}
+	data.ToolCalls = response.ToolCalls
+	AddPromptDataToPayload(payload, data)
+	attrs := payloadAttributes(t, payload)
+	if attrs["toolCalls"] == nil || attrs["toolResultIds"] == nil {
+		t.Errorf("attributes = %v, want toolCalls and toolResultIds", attrs)
+	}
+}
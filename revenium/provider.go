@@ -10,6 +10,7 @@ type Provider string
 const (
 	ProviderAnthropic Provider = "ANTHROPIC"
 	ProviderBedrock   Provider = "AWS"
+	ProviderMock      Provider = "MOCK" // Canned responses for tests, see WithMockResponses
 )
 
 // DetectProvider detects which provider is being used based on configuration
@@ -18,6 +19,11 @@ func DetectProvider(cfg *Config) Provider {
 		return ProviderAnthropic
 	}
 
+	// Canned responses always take precedence so tests never reach the network
+	if len(cfg.MockResponses) > 0 {
+		return ProviderMock
+	}
+
 	// If Bedrock is explicitly disabled, use Anthropic
 	if cfg.BedrockDisabled {
 		return ProviderAnthropic
@@ -47,7 +53,31 @@ func (p Provider) IsBedrock() bool {
 	return p == ProviderBedrock
 }
 
+// IsMock returns true if the provider serves canned test responses
+func (p Provider) IsMock() bool {
+	return p == ProviderMock
+}
+
 // String returns the string representation of the provider
 func (p Provider) String() string {
 	return string(p)
 }
+
+// modelFamilies are the Claude model families recognized by detectModelFamily
+var modelFamilies = []string{"haiku", "sonnet", "opus"}
+
+// detectModelFamily returns the Claude model family ("haiku", "sonnet" or "opus") of a
+// model name, Bedrock model ID or ARN regardless of version, or "" if unrecognized.
+// For example claude-3-5-sonnet-20241022 and claude-sonnet-4-5 both map to "sonnet"
+func detectModelFamily(model string) string {
+	if converted, err := ConvertBedrockARNToAnthropicModel(model); err == nil {
+		model = converted
+	}
+	model = strings.ToLower(model)
+	for _, family := range modelFamilies {
+		if strings.Contains(model, family) {
+			return family
+		}
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+package revenium
+
+import "testing"
+
+func TestDetectModelFamily(t *testing.T) {
+	tests := map[string]string{
+		"claude-3-5-sonnet-20241022":                  "sonnet",
+		"claude-sonnet-4-5":                           "sonnet",
+		"claude-3-5-haiku-latest":                     "haiku",
+		"Claude-Opus-4-1":                             "opus",
+		"us.anthropic.claude-3-5-haiku-20241022-v1:0": "haiku",
+		"anthropic.claude-3-opus-20240229-v1:0":       "opus",
+		"gpt-4o":                                      "",
+		"":                                            "",
+	}
+	for model, want := range tests {
+		if got := detectModelFamily(model); got != want {
+			t.Errorf("detectModelFamily(%q) = %q, want %q", model, got, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package revenium
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// InstallShutdownHandler registers an opt-in SIGTERM/SIGINT handler that flushes the
+// global client's pending metering (bounded by timeout) when a signal arrives.
+//
+// It is never installed automatically, so applications that manage their own signal
+// handling are unaffected. After flushing, the handler stops listening and calls
+// onSignal with the received signal; the exit behavior is left to the caller, e.g.
+// cancelling the application's root context or calling os.Exit. The signal is not
+// re-raised. With a nil onSignal the handler only flushes and returns, and a second
+// signal gets Go's default behavior. The returned function uninstalls the handler.
+func InstallShutdownHandler(timeout time.Duration, onSignal func(os.Signal)) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			Info("Received %v, flushing metering before shutdown", sig)
+			if err := flushOnShutdown(timeout); err != nil {
+				Warn("Metering flush on shutdown incomplete: %v", err)
+			}
+			signal.Stop(signals)
+			if onSignal != nil {
+				onSignal(sig)
+			}
+		case <-done:
+			signal.Stop(signals)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Shutdown flushes the global client's pending metering and closes it. Go has no
+// exit hook, so metering goroutines still running when main returns are lost; call
+// it before exiting, typically right after Initialize:
+//
+//	if err := revenium.Initialize(); err != nil { ... }
+//	defer revenium.Shutdown()
+//
+// It unpublishes the client, as Reset does, waits up to the metering timeout and logs
+// a warning if events remain pending. It is a no-op when the middleware is not initialized
+func Shutdown() error {
+	globalMu.Lock()
+	client := globalClient.Swap(nil)
+	globalMu.Unlock()
+	if client == nil {
+		Debug("No global client to shut down")
+		return nil
+	}
+
+	timeout := meteringContextTimeout
+	if cfg := client.GetConfig(); cfg != nil && cfg.MeteringTimeout > 0 {
+		timeout = cfg.MeteringTimeout
+	}
+	if err := client.FlushWithTimeout(timeout); err != nil {
+		Warn("Shutdown with %d metering events still pending: %v", client.MeteringStats().Pending, err)
+		client.beat.close() // Close would wait on the pending events, so only stop the heartbeat
+		return err
+	}
+	return client.Close()
+}
+
+// flushOnShutdown flushes the global client, if initialized, within timeout
+func flushOnShutdown(timeout time.Duration) error {
+	client, err := GetClient()
+	if err != nil {
+		Debug("No global client to flush on shutdown: %v", err)
+		return nil
+	}
+	return client.FlushWithTimeout(timeout)
+}
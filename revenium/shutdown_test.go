@@ -0,0 +1,107 @@
+package revenium
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+// recordingLogger keeps every formatted warning
+type recordingLogger struct {
+	*DefaultLogger
+	mu    sync.Mutex
+	warns []string
+}
+
+func (l *recordingLogger) Warn(message string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warns = append(l.warns, fmt.Sprintf(message, args...))
+}
+
+func (l *recordingLogger) warnings() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.warns...)
+}
+
+func TestShutdownUnpublishesGlobalClient(t *testing.T) {
+	t.Setenv("REVENIUM_METERING_API_KEY", "hak_test")
+	t.Cleanup(Reset)
+
+	if err := Initialize(); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if err := Shutdown(); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if client, err := GetClient(); err == nil {
+		t.Fatalf("GetClient returned %p after Shutdown", client)
+	}
+	if IsInitialized() {
+		t.Error("IsInitialized = true after Shutdown")
+	}
+
+	// A second Shutdown is a no-op
+	if err := Shutdown(); err != nil {
+		t.Errorf("second Shutdown: %v", err)
+	}
+}
+
+func TestShutdownWarnsAboutPendingEvents(t *testing.T) {
+	t.Setenv("REVENIUM_METERING_API_KEY", "hak_test")
+
+	logger := &recordingLogger{DefaultLogger: NewDefaultLogger()}
+	previous := GetLogger()
+	SetLogger(logger)
+
+	release := make(chan struct{})
+	sender := func(ctx context.Context, payload map[string]interface{}) error {
+		<-release
+		return nil
+	}
+	if err := Initialize(
+		WithMockResponses([]anthropic.Message{{Model: "claude-3-5-haiku-latest"}}),
+		WithMeteringSender(sender),
+		WithMeteringTimeout(50*time.Millisecond),
+	); err != nil {
+		SetLogger(previous)
+		t.Fatalf("Initialize: %v", err)
+	}
+	client, err := GetClient()
+	if err != nil {
+		SetLogger(previous)
+		t.Fatalf("GetClient: %v", err)
+	}
+	t.Cleanup(func() {
+		close(release)
+		client.Flush()
+		SetLogger(previous)
+	})
+
+	_, err = client.Messages().CreateMessage(context.Background(), anthropic.MessageNewParams{
+		Model:     "claude-3-5-haiku-latest",
+		MaxTokens: 16,
+		Messages:  []anthropic.MessageParam{anthropic.NewUserMessage(anthropic.NewTextBlock("hi"))},
+	})
+	if err != nil {
+		t.Fatalf("CreateMessage: %v", err)
+	}
+
+	if err := Shutdown(); err == nil {
+		t.Fatal("Shutdown returned nil with a metering event still pending")
+	}
+	if _, err := GetClient(); err == nil {
+		t.Error("GetClient succeeded after a timed out Shutdown")
+	}
+
+	warnings := logger.warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "1 metering events still pending") {
+		t.Errorf("warnings = %q, want one pending events warning", warnings)
+	}
+}
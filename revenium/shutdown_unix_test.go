@@ -0,0 +1,30 @@
+//go:build unix
+
+package revenium
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestShutdownHandlerHandsSignalToCaller(t *testing.T) {
+	received := make(chan os.Signal, 1)
+	uninstall := InstallShutdownHandler(time.Second, func(sig os.Signal) { received <- sig })
+	defer uninstall()
+
+	// The handler intercepts the signal, so the test process is not terminated
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatalf("Kill: %v", err)
+	}
+
+	select {
+	case sig := <-received:
+		if sig != syscall.SIGTERM {
+			t.Errorf("onSignal got %v, want SIGTERM", sig)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("onSignal was not called")
+	}
+}
@@ -0,0 +1,389 @@
+package revenium
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyWindowSize bounds the number of recent durations kept for percentiles
+const latencyWindowSize = 1024
+
+// meteringEnabled is the process-wide metering kill switch
+var meteringEnabled atomic.Bool
+
+func init() {
+	meteringEnabled.Store(true)
+}
+
+// SetMeteringEnabled turns metering on or off for all clients at runtime
+// While disabled, meter events are skipped (and counted as skipped) but requests
+// still run normally. Use it as an operational kill switch, e.g. during an outage
+func SetMeteringEnabled(enabled bool) {
+	meteringEnabled.Store(enabled)
+	if enabled {
+		Info("Metering enabled")
+	} else {
+		Warn("Metering disabled, meter events will be skipped")
+	}
+}
+
+// IsMeteringEnabled reports whether the metering kill switch allows sending events
+func IsMeteringEnabled() bool {
+	return meteringEnabled.Load()
+}
+
+// MeteringStats is a snapshot of a client's metering counters
+type MeteringStats struct {
+	// Sent is the number of meter events delivered to Revenium
+	Sent int64
+	// Failed is the number of meter events that could not be delivered
+	Failed int64
+	// Skipped is the number of meter events not sent because metering was disabled
+	// or the model was excluded by WithMeteringOnlyForModels
+	Skipped int64
+	// Pending is the number of background metering goroutines still in flight
+	Pending int64
+	// SendLatency summarizes the duration of individual metering HTTP sends
+	SendLatency LatencyStats
+}
+
+// LatencyStats summarizes metering send latency
+// Count and Mean cover every send; P95 is computed over the most recent sends
+type LatencyStats struct {
+	Count int64
+	Mean  time.Duration
+	P95   time.Duration
+}
+
+// meteringCounters holds the live counters shared by a client's MessagesInterface values
+type meteringCounters struct {
+	sent    atomic.Int64
+	failed  atomic.Int64
+	skipped atomic.Int64
+	pending atomic.Int64
+
+	sendLatency    durationWindow // metering HTTP send latency
+	requestLatency durationWindow // provider request durations
+}
+
+// LatencyQuantiles summarizes request durations over the client's recent requests
+// Count covers every request; the percentiles cover the most recent 1024
+type LatencyQuantiles struct {
+	Count int64
+	P50   time.Duration
+	P95   time.Duration
+	P99   time.Duration
+}
+
+// durationWindow tracks a running count and mean plus a bounded ring buffer of
+// recent durations for percentile estimates
+type durationWindow struct {
+	mu     sync.Mutex
+	count  int64
+	total  time.Duration
+	values []time.Duration
+	next   int
+}
+
+// record adds one duration, overwriting the oldest once the window is full
+func (w *durationWindow) record(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.count++
+	w.total += d
+	if len(w.values) < latencyWindowSize {
+		w.values = append(w.values, d)
+		return
+	}
+	w.values[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// summary returns the total count, the mean, and the sorted recent durations
+func (w *durationWindow) summary() (int64, time.Duration, []time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.count == 0 {
+		return 0, 0, nil
+	}
+	sorted := append([]time.Duration(nil), w.values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return w.count, w.total / time.Duration(w.count), sorted
+}
+
+// percentile returns the nearest-rank percentile p (0-100) of sorted durations
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := (len(sorted)*p+99)/100 - 1
+	if idx < 0 {
+		idx = 0
+	}
+	return sorted[idx]
+}
+
+// snapshot returns the current counter values
+func (c *meteringCounters) snapshot() MeteringStats {
+	if c == nil {
+		return MeteringStats{}
+	}
+	return MeteringStats{
+		Sent:        c.sent.Load(),
+		Failed:      c.failed.Load(),
+		Skipped:     c.skipped.Load(),
+		Pending:     c.pending.Load(),
+		SendLatency: c.latencySnapshot(),
+	}
+}
+
+// recordLatency records the duration of one metering HTTP send
+func (c *meteringCounters) recordLatency(d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.sendLatency.record(d)
+}
+
+// latencySnapshot computes aggregate metering send latency stats
+func (c *meteringCounters) latencySnapshot() LatencyStats {
+	count, mean, sorted := c.sendLatency.summary()
+	return LatencyStats{
+		Count: count,
+		Mean:  mean,
+		P95:   percentile(sorted, 95),
+	}
+}
+
+// recordRequest records the duration of one provider request
+func (c *meteringCounters) recordRequest(d time.Duration) {
+	if c == nil {
+		return
+	}
+	c.requestLatency.record(d)
+}
+
+// requestQuantiles computes request duration percentiles
+func (c *meteringCounters) requestQuantiles() LatencyQuantiles {
+	if c == nil {
+		return LatencyQuantiles{}
+	}
+	count, _, sorted := c.requestLatency.summary()
+	return LatencyQuantiles{
+		Count: count,
+		P50:   percentile(sorted, 50),
+		P95:   percentile(sorted, 95),
+		P99:   percentile(sorted, 99),
+	}
+}
+
+// recordSend records the outcome of one meter event delivery
+func (c *meteringCounters) recordSend(err error) {
+	if c == nil {
+		return
+	}
+	if err != nil {
+		c.failed.Add(1)
+	} else {
+		c.sent.Add(1)
+	}
+}
+
+// recordSkipped records a meter event that was skipped
+func (c *meteringCounters) recordSkipped() {
+	if c == nil {
+		return
+	}
+	c.skipped.Add(1)
+}
+
+// payloadHistory is a bounded, concurrency-safe ring buffer of recent metering payloads
+type payloadHistory struct {
+	mu       sync.Mutex
+	payloads []map[string]interface{}
+	next     int
+	size     int
+}
+
+// newPayloadHistory returns a history holding up to size payloads, or nil when disabled
+func newPayloadHistory(size int) *payloadHistory {
+	if size <= 0 {
+		return nil
+	}
+	return &payloadHistory{size: size}
+}
+
+// record stores a copy of payload, evicting the oldest entry when full
+func (h *payloadHistory) record(payload map[string]interface{}) {
+	if h == nil {
+		return
+	}
+	entry := copyPayload(payload)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.payloads) < h.size {
+		h.payloads = append(h.payloads, entry)
+		return
+	}
+	h.payloads[h.next] = entry
+	h.next = (h.next + 1) % h.size
+}
+
+// recent returns copies of the stored payloads, oldest first
+func (h *payloadHistory) recent() []map[string]interface{} {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make([]map[string]interface{}, 0, len(h.payloads))
+	for i := 0; i < len(h.payloads); i++ {
+		result = append(result, copyPayload(h.payloads[(h.next+i)%len(h.payloads)]))
+	}
+	return result
+}
+
+// copyPayload copies a payload and its attributes map so later mutation doesn't leak
+func copyPayload(payload map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(payload))
+	for k, v := range payload {
+		if attrs, ok := v.(map[string]interface{}); ok {
+			attrsCopy := make(map[string]interface{}, len(attrs))
+			for ak, av := range attrs {
+				attrsCopy[ak] = av
+			}
+			v = attrsCopy
+		}
+		copied[k] = v
+	}
+	return copied
+}
+
+// maxTrackedSubscribers caps the subscriber aggregator; the least recently seen
+// subscriber is evicted when the cap is reached
+const maxTrackedSubscribers = 10000
+
+// SubscriberUsage is the locally aggregated usage for one subscriber
+type SubscriberUsage struct {
+	Requests     int64
+	InputTokens  int64
+	OutputTokens int64
+	TotalTokens  int64
+	LastSeen     time.Time
+}
+
+// subscriberAggregator tallies requests and tokens per subscriber ID with LRU eviction
+type subscriberAggregator struct {
+	mu      sync.Mutex
+	limit   int
+	entries map[string]*list.Element
+	order   *list.List // front = most recently seen
+}
+
+type subscriberEntry struct {
+	id    string
+	usage SubscriberUsage
+}
+
+// newSubscriberAggregator returns an aggregator, or nil when aggregation is disabled
+func newSubscriberAggregator(enabled bool) *subscriberAggregator {
+	if !enabled {
+		return nil
+	}
+	return &subscriberAggregator{
+		limit:   maxTrackedSubscribers,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// record adds one request's usage from a metering payload
+func (a *subscriberAggregator) record(payload map[string]interface{}) {
+	if a == nil {
+		return
+	}
+	id := subscriberIDFromPayload(payload)
+	if id == "" {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	elem, ok := a.entries[id]
+	if ok {
+		a.order.MoveToFront(elem)
+	} else {
+		if a.order.Len() >= a.limit {
+			oldest := a.order.Back()
+			a.order.Remove(oldest)
+			delete(a.entries, oldest.Value.(*subscriberEntry).id)
+		}
+		elem = a.order.PushFront(&subscriberEntry{id: id})
+		a.entries[id] = elem
+	}
+
+	entry := elem.Value.(*subscriberEntry)
+	entry.usage.Requests++
+	entry.usage.InputTokens += toInt64(payload["inputTokenCount"])
+	entry.usage.OutputTokens += toInt64(payload["outputTokenCount"])
+	entry.usage.TotalTokens += toInt64(payload["totalTokenCount"])
+	entry.usage.LastSeen = time.Now()
+}
+
+// snapshot returns a copy of the aggregated usage keyed by subscriber ID
+func (a *subscriberAggregator) snapshot() map[string]SubscriberUsage {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := make(map[string]SubscriberUsage, len(a.entries))
+	for id, elem := range a.entries {
+		result[id] = elem.Value.(*subscriberEntry).usage
+	}
+	return result
+}
+
+// subscriberIDFromPayload returns the subscriber ID carried by a payload, if any
+func subscriberIDFromPayload(payload map[string]interface{}) string {
+	switch subscriber := payload["subscriber"].(type) {
+	case map[string]interface{}:
+		if id, ok := subscriber["id"].(string); ok {
+			return id
+		}
+	case map[string]string:
+		return subscriber["id"]
+	case *Subscriber:
+		if subscriber != nil {
+			return subscriber.ID
+		}
+	case Subscriber:
+		return subscriber.ID
+	}
+	return ""
+}
+
+// toInt64 converts the numeric types used for payload token counts to int64
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	default:
+		return 0
+	}
+}
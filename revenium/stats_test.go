@@ -0,0 +1,89 @@
+package revenium
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendLatencyStats(t *testing.T) {
+	var counters meteringCounters
+	if got := counters.snapshot().SendLatency; got != (LatencyStats{}) {
+		t.Fatalf("latency before any send = %+v, want zero", got)
+	}
+
+	for i := 100; i >= 1; i-- {
+		counters.recordLatency(time.Duration(i) * time.Millisecond)
+	}
+	got := counters.snapshot().SendLatency
+	want := LatencyStats{Count: 100, Mean: 50500 * time.Microsecond, P95: 95 * time.Millisecond}
+	if got != want {
+		t.Errorf("latency = %+v, want %+v", got, want)
+	}
+
+	// Once the window is full, P95 only reflects the most recent sends
+	for i := 0; i < latencyWindowSize; i++ {
+		counters.recordLatency(time.Second)
+	}
+	if got := counters.snapshot().SendLatency; got.P95 != time.Second || got.Count != 100+latencyWindowSize {
+		t.Errorf("latency after a full window = %+v, want P95 1s over %d sends", got, 100+latencyWindowSize)
+	}
+}
+
+func TestPayloadHistoryKeepsMostRecent(t *testing.T) {
+	if newPayloadHistory(0) != nil {
+		t.Fatal("history enabled with size 0")
+	}
+
+	history := newPayloadHistory(2)
+	for _, model := range []string{"a", "b", "c"} {
+		history.record(map[string]interface{}{"model": model, "attributes": map[string]interface{}{"n": model}})
+	}
+
+	recent := history.recent()
+	if len(recent) != 2 || recent[0]["model"] != "b" || recent[1]["model"] != "c" {
+		t.Fatalf("recent payloads = %v, want b then c", recent)
+	}
+
+	// Returned payloads are copies, including their attributes
+	recent[0]["attributes"].(map[string]interface{})["n"] = "changed"
+	if got := history.recent()[0]["attributes"].(map[string]interface{})["n"]; got != "b" {
+		t.Errorf("stored attributes were modified through a returned copy: %v", got)
+	}
+}
+
+func TestSubscriberAggregationEvictsLeastRecentlySeen(t *testing.T) {
+	if newSubscriberAggregator(false) != nil {
+		t.Fatal("aggregator enabled when disabled")
+	}
+
+	agg := newSubscriberAggregator(true)
+	agg.limit = 2
+	agg.record(map[string]interface{}{"subscriber": map[string]interface{}{"id": "a"}, "inputTokenCount": 3, "outputTokenCount": 2, "totalTokenCount": 5})
+	agg.record(map[string]interface{}{"subscriber": &Subscriber{ID: "b"}, "inputTokenCount": int64(1)})
+	agg.record(map[string]interface{}{"subscriber": map[string]string{"id": "a"}, "inputTokenCount": 4.0})
+	agg.record(map[string]interface{}{"inputTokenCount": 100}) // no subscriber, not tallied
+	agg.record(map[string]interface{}{"subscriber": Subscriber{ID: "c"}})
+
+	stats := agg.snapshot()
+	if _, ok := stats["b"]; ok || len(stats) != 2 {
+		t.Fatalf("subscribers = %v, want a and c with b evicted", stats)
+	}
+	if a := stats["a"]; a.Requests != 2 || a.InputTokens != 7 || a.OutputTokens != 2 || a.TotalTokens != 5 {
+		t.Errorf("usage for a = %+v, want 2 requests, 7 input, 2 output, 5 total", a)
+	}
+}
+
+func TestRequestLatencyQuantiles(t *testing.T) {
+	var counters meteringCounters
+	if got := counters.requestQuantiles(); got != (LatencyQuantiles{}) {
+		t.Fatalf("quantiles before any request = %+v, want zero", got)
+	}
+
+	for i := 1; i <= 100; i++ {
+		counters.recordRequest(time.Duration(i) * time.Millisecond)
+	}
+	want := LatencyQuantiles{Count: 100, P50: 50 * time.Millisecond, P95: 95 * time.Millisecond, P99: 99 * time.Millisecond}
+	if got := counters.requestQuantiles(); got != want {
+		t.Errorf("quantiles = %+v, want %+v", got, want)
+	}
+}
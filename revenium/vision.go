@@ -4,6 +4,10 @@
 package revenium
 
 import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+
 	"github.com/anthropics/anthropic-sdk-go"
 )
 
@@ -65,8 +69,17 @@ func processBase64ImageSource(src *anthropic.Base64ImageSourceParam, result *Vis
 		return
 	}
 
-	// Track media type
+	// Clients sometimes send a data URI or line-wrapped base64 in the Data field
+	data, uriMediaType := normalizeBase64Data(src.Data)
+
+	// Track media type, falling back to the data URI and then to sniffing the data
 	mediaType := string(src.MediaType)
+	if mediaType == "" {
+		mediaType = uriMediaType
+	}
+	if mediaType == "" {
+		mediaType = sniffImageMediaType(data)
+	}
 	if mediaType != "" && !containsString(result.MediaTypes, mediaType) {
 		result.MediaTypes = append(result.MediaTypes, mediaType)
 	}
@@ -74,13 +87,13 @@ func processBase64ImageSource(src *anthropic.Base64ImageSourceParam, result *Vis
 	// Calculate estimated decoded size from base64
 	// Base64 encoding increases size by ~4/3, so decoded = base64_len * 3 / 4
 	// Account for padding characters (=) which don't represent data
-	if src.Data != "" {
-		base64Length := len(src.Data)
+	if data != "" {
+		base64Length := len(data)
 		// Count padding characters at the end
 		padding := 0
-		if base64Length > 0 && src.Data[base64Length-1] == '=' {
+		if base64Length > 0 && data[base64Length-1] == '=' {
 			padding++
-			if base64Length > 1 && src.Data[base64Length-2] == '=' {
+			if base64Length > 1 && data[base64Length-2] == '=' {
 				padding++
 			}
 		}
@@ -89,6 +102,63 @@ func processBase64ImageSource(src *anthropic.Base64ImageSourceParam, result *Vis
 	}
 }
 
+// normalizeBase64Data strips a "data:<media type>;base64," prefix and any whitespace
+// (line-wrapped encodings) from base64 image data, returning the bare base64 and the
+// media type named by the data URI, if any
+func normalizeBase64Data(data string) (string, string) {
+	mediaType := ""
+	if strings.HasPrefix(data, "data:") {
+		if comma := strings.IndexByte(data, ','); comma >= 0 {
+			header := data[len("data:"):comma]
+			if strings.HasSuffix(header, ";base64") {
+				mediaType = strings.TrimSuffix(header, ";base64")
+				data = data[comma+1:]
+			}
+		}
+	}
+
+	if strings.ContainsAny(data, " \t\r\n") {
+		data = strings.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, data)
+	}
+	return data, mediaType
+}
+
+// sniffImageMediaType detects the media type of base64 image data from its magic
+// bytes, returning "" when the format is not recognized
+func sniffImageMediaType(data string) string {
+	// 16 base64 characters decode to the first 12 bytes, enough for every signature
+	prefix := data
+	if len(prefix) > 16 {
+		prefix = prefix[:16]
+	}
+	header, err := base64.StdEncoding.DecodeString(prefix)
+	if err != nil {
+		header, err = base64.RawStdEncoding.DecodeString(prefix)
+		if err != nil {
+			return ""
+		}
+	}
+
+	switch {
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		return "image/png"
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return "image/jpeg"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return "image/gif"
+	case len(header) >= 12 && bytes.Equal(header[:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		return "image/webp"
+	default:
+		return ""
+	}
+}
+
 // containsString checks if a string slice contains a value
 func containsString(slice []string, val string) bool {
 	for _, item := range slice {
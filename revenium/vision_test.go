@@ -0,0 +1,66 @@
+package revenium
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/anthropics/anthropic-sdk-go"
+)
+
+func TestSniffImageMediaType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR", "image/png"},
+		{"jpeg", "\xff\xd8\xff\xe0\x00\x10JFIF\x00", "image/jpeg"},
+		{"gif", "GIF89a\x01\x00\x01\x00", "image/gif"},
+		{"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", "image/webp"},
+		{"unknown", "plain text data", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := base64.StdEncoding.EncodeToString([]byte(tt.header))
+			if got := sniffImageMediaType(data); got != tt.want {
+				t.Errorf("sniffImageMediaType = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := sniffImageMediaType("not base64!"); got != "" {
+		t.Errorf("sniffImageMediaType(invalid) = %q, want empty", got)
+	}
+}
+
+func TestBase64ImageSizeIgnoresDataURIAndWhitespace(t *testing.T) {
+	raw := make([]byte, 100)
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	wrapped := encoded[:40] + "\n" + encoded[40:80] + "\r\n" + encoded[80:]
+
+	tests := []struct {
+		name          string
+		data          string
+		wantMediaType string
+	}{
+		{"bare", encoded, ""},
+		{"line wrapped", wrapped, ""},
+		{"data uri", "data:image/png;base64," + wrapped, "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := VisionDetectionResult{MediaTypes: []string{}}
+			processBase64ImageSource(&anthropic.Base64ImageSourceParam{Data: tt.data}, &result)
+			if result.TotalImageSizeBytes != len(raw) {
+				t.Errorf("TotalImageSizeBytes = %d, want %d", result.TotalImageSizeBytes, len(raw))
+			}
+			gotMediaType := ""
+			if len(result.MediaTypes) > 0 {
+				gotMediaType = result.MediaTypes[0]
+			}
+			if gotMediaType != tt.wantMediaType {
+				t.Errorf("media type = %q, want %q", gotMediaType, tt.wantMediaType)
+			}
+		})
+	}
+}